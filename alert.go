@@ -0,0 +1,119 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AlertCode identifies the reason why a peer aborted a run of one of the
+// protocols.
+type AlertCode int
+
+// Alert codes. The codes are deliberately coarse: all failures which depend on
+// the password, the user's record or the keys of the peers are reported as
+// AlertAuthFailed, so that a peer can't learn why authentication failed.
+const (
+	AlertInternalError AlertCode = iota + 1
+	AlertVersionMismatch
+	AlertMalformedMessage
+	AlertUnexpectedMessage
+	AlertRateLimited
+	AlertAuthFailed
+)
+
+var alertNames = map[AlertCode]string{
+	AlertInternalError:     "internal error",
+	AlertVersionMismatch:   "version mismatch",
+	AlertMalformedMessage:  "malformed message",
+	AlertUnexpectedMessage: "unexpected message",
+	AlertRateLimited:       "rate limited",
+	AlertAuthFailed:        "authentication failed",
+}
+
+func (c AlertCode) String() string {
+	if name, ok := alertNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown alert %d", int(c))
+}
+
+// Alert is a message which can be sent in place of any protocol message to
+// tell the peer that the protocol run has been aborted. Use NewAlert to create
+// an Alert from an error and Alert.Err to turn a received Alert into an error.
+type Alert struct {
+	Code AlertCode
+}
+
+// AlertError is the type of the errors corresponding to alerts.
+type AlertError struct {
+	Code AlertCode
+}
+
+func (e *AlertError) Error() string {
+	return e.Code.String()
+}
+
+// ProtocolVersion is the version of the password registration and
+// authentication protocols. Clients send it in PwRegMsg1 and AuthMsg1, and the
+// server aborts with ErrVersionMismatch if it's another version. Messages
+// without a version come from clients which predate it and are accepted.
+//
+// Version 2 changed how H' hashes to the group and how the DH secrets are
+// hashed. Users registered with version 1 can't authenticate with version 2,
+// so they all have to register again.
+const ProtocolVersion = 2
+
+// checkVersion returns ErrVersionMismatch unless version, which is from a
+// PwRegMsg1 or an AuthMsg1, is ProtocolVersion or missing.
+func checkVersion(version int) error {
+	if version != 0 && version != ProtocolVersion {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// Errors corresponding to the alert codes. Alert.Err returns one of these, so
+// they can be compared with ==.
+var (
+	ErrInternal          = &AlertError{AlertInternalError}
+	ErrVersionMismatch   = &AlertError{AlertVersionMismatch}
+	ErrMalformedMessage  = &AlertError{AlertMalformedMessage}
+	ErrUnexpectedMessage = &AlertError{AlertUnexpectedMessage}
+	ErrRateLimited       = &AlertError{AlertRateLimited}
+	ErrAuthFailed        = &AlertError{AlertAuthFailed}
+)
+
+// NewAlert returns the Alert that should be sent to the peer when a protocol
+// run is aborted because of err.
+//
+// If err is, or wraps, an *AlertError its code is used. In particular, failures
+// of the random source wrap ErrInternal. ErrOverloaded and ErrPuzzle are
+// reported as AlertRateLimited. All other errors are reported
+// as AlertAuthFailed, which means that the peer can't tell apart, e.g., an
+// unknown user from a wrong password or a corrupt envelope.
+func NewAlert(err error) Alert {
+	var alertErr *AlertError
+	switch {
+	case errors.As(err, &alertErr):
+		return Alert{Code: alertErr.Code}
+	case errors.Is(err, ErrOverloaded), errors.Is(err, ErrPuzzle):
+		return Alert{Code: AlertRateLimited}
+	default:
+		return Alert{Code: AlertAuthFailed}
+	}
+}
+
+// Err returns the error corresponding to a received alert.
+func (a Alert) Err() error {
+	for _, err := range []*AlertError{ErrInternal, ErrVersionMismatch, ErrMalformedMessage, ErrUnexpectedMessage, ErrRateLimited, ErrAuthFailed} {
+		if err.Code == a.Code {
+			return err
+		}
+	}
+	return &AlertError{a.Code}
+}
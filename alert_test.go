@@ -0,0 +1,107 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/frekui/opaque/internal/pkg/authenc"
+)
+
+func TestAlert(t *testing.T) {
+	for idx, tst := range []struct {
+		err  error
+		code AlertCode
+	}{
+		{ErrMalformedMessage, AlertMalformedMessage},
+		{fmt.Errorf("decoding: %w", ErrMalformedMessage), AlertMalformedMessage},
+		{ErrVersionMismatch, AlertVersionMismatch},
+		{ErrOverloaded, AlertRateLimited},
+		{ErrPuzzle, AlertRateLimited},
+		// Authentication failures can't be told apart.
+		{authenc.AuthtagMismatch, AlertAuthFailed},
+		{rsa.ErrVerification, AlertAuthFailed},
+		{errors.New("MAC mismatch"), AlertAuthFailed},
+		{ErrUsernameDecrypt, AlertAuthFailed},
+		{ErrInvalidRegCode, AlertAuthFailed},
+	} {
+		alert := NewAlert(tst.err)
+		if alert.Code != tst.code {
+			t.Fatalf("Test %d: got %v, expected %v", idx, alert.Code, tst.code)
+		}
+		var alertErr *AlertError
+		if !errors.As(alert.Err(), &alertErr) || alertErr.Code != tst.code {
+			t.Fatalf("Test %d: Err() returned %v", idx, alert.Err())
+		}
+	}
+	if (Alert{Code: AlertAuthFailed}).Err() != ErrAuthFailed {
+		t.Fatalf("Err() didn't return ErrAuthFailed")
+	}
+	if err := (Alert{Code: 1000}).Err(); err.Error() != "unknown alert 1000" {
+		t.Fatalf("Unexpected error '%s'", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func TestAlertCauses(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Servers reject first messages of other versions.
+	_, amsg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amsg1.Version != ProtocolVersion {
+		t.Fatalf("AuthMsg1 has version %d", amsg1.Version)
+	}
+	amsg1.Version = ProtocolVersion + 1
+	if _, _, err := Auth1(privS, user, amsg1); NewAlert(err).Code != AlertVersionMismatch {
+		t.Fatalf("Auth1: got error %v", err)
+	}
+	// Messages without a version are accepted.
+	amsg1.Version = 0
+	if _, _, err := Auth1(privS, user, amsg1); err != nil {
+		t.Fatal(err)
+	}
+	_, pmsg1, err := PwRegInit("user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pmsg1.Version = ProtocolVersion + 1
+	if _, _, err := PwReg1(privS, pmsg1); NewAlert(err).Code != AlertVersionMismatch {
+		t.Fatalf("PwReg1: got error %v", err)
+	}
+
+	// Failures of the random source are internal errors.
+	SetRandom(failingReader{})
+	_, _, err = AuthInit("user", "password")
+	SetRandom(nil)
+	if NewAlert(err).Code != AlertInternalError || !errors.Is(err, ErrInternal) {
+		t.Fatalf("AuthInit: got error %v", err)
+	}
+	SetRandom(io.LimitReader(randr, 0))
+	_, _, err = PwRegInit("user", "password", 512)
+	SetRandom(nil)
+	if NewAlert(err).Code != AlertInternalError {
+		t.Fatalf("PwRegInit: got error %v", err)
+	}
+}
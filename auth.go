@@ -9,12 +9,15 @@ import (
 	"crypto/hmac"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"io"
 	"math/big"
+	"time"
 
 	"github.com/frekui/opaque/internal/pkg/authenc"
+	"github.com/frekui/opaque/oprf"
 	"golang.org/x/crypto/hkdf"
 )
 
@@ -24,8 +27,38 @@ type AuthClientSession struct {
 	// Client ephemeral private D-H key for this session.
 	x           *big.Int
 	dhPubClient *big.Int
-	r           *big.Int
+	blind       *oprf.State
+	username    string
 	password    string
+
+	// RwdU and the decrypted envelope. Set by Auth2 on success.
+	rwdU []byte
+	env  *envU
+
+	// Set by Auth2 if the server has asked for a credential upgrade.
+	upgrade bool
+
+	// Second factor challenge and the MAC key of the session. Set by
+	// Auth2 if the server has asked for a second factor.
+	challenge []byte
+	dhMacKey  []byte
+
+	// Set by Auth2 if the server has asked for a password change.
+	passwordChange bool
+
+	// Public metadata of the POPRF, nil unless AuthInitWithInfo is used.
+	info []byte
+
+	// Secret of the two-message mode. Set by Auth2 if msg2 was created
+	// by Auth1Implicit.
+	implicitSecret []byte
+
+	// Id of the device whose envelope was requested, empty for the
+	// primary envelope.
+	deviceID string
+
+	// Id of the credential used, empty for the primary credential.
+	credentialID string
 }
 
 // AuthServerSession keeps track of state needed on the server-side during a
@@ -40,6 +73,31 @@ type AuthServerSession struct {
 	pubS           *rsa.PublicKey
 
 	user *User
+
+	// Set by Auth3 on success.
+	authenticated bool
+
+	// Id of the credential used, empty for the primary credential.
+	credentialID string
+
+	// Set if the credential is unknown. Auth3 fails for such sessions.
+	fake bool
+
+	// Set by Auth1Implicit, together with the secret of the session. The
+	// session is unconfirmed until Confirm has returned successfully.
+	implicit       bool
+	implicitSecret []byte
+
+	// Second factor challenge, nil if the user doesn't have a second
+	// factor.
+	challenge []byte
+
+	// Set by Auth1 if the client is asked to change the password.
+	passwordChange bool
+
+	// Changes to the user made in this session which haven't been
+	// applied by UpdateUser yet.
+	updates []func(*User)
 }
 
 // AuthMsg1 is the first message in the authentication protocol. It is sent from
@@ -52,6 +110,9 @@ type AuthMsg1 struct {
 	// From the I-D:
 	//   Uid, a=H'(PwdU)*g^r, KE1
 
+	// Version is ProtocolVersion.
+	Version int `json:",omitempty"`
+
 	Username string
 
 	// a=H'(x)*g^r
@@ -59,6 +120,20 @@ type AuthMsg1 struct {
 
 	// First message of D-H key-exchange (KE1): g^x
 	DhPubClient *big.Int
+
+	// Username encrypted to the server's UsernameKey. Only set if
+	// EncryptUsername is used, in which case Username is empty.
+	EncUsername []byte `json:",omitempty"`
+
+	// Id of the credential to use, empty for the primary credential.
+	CredentialID string `json:",omitempty"`
+
+	// Id of the device whose envelope is requested, empty for the
+	// primary envelope. Only set if AuthInitWithDevice is used.
+	DeviceID string `json:",omitempty"`
+
+	// Public metadata of the POPRF. Only set if AuthInitWithInfo is used.
+	Info []byte `json:",omitempty"`
 }
 
 // AuthMsg2 is the second message in the authentication protocol. It is sent
@@ -79,9 +154,14 @@ type AuthMsg2 struct {
 	B *big.Int
 
 	// EnvU contains data encrypted by the client which is stored
-	// server-side.
+	// server-side. It's the envelope of the requested device if
+	// AuthMsg1.DeviceID is set.
 	EnvU []byte
 
+	// If the user has honey envelopes, EnvU is empty and HoneyEnvU holds
+	// the real envelope and the decoys. The client tries each of them.
+	HoneyEnvU [][]byte `json:",omitempty"`
+
 	// Second message of D-H key-exchange (KE2): g^y, Sig(PrivS; g^x, g^y), Mac(Km1; IdS)
 	// g^y
 	DhPubServer *big.Int
@@ -90,8 +170,24 @@ type AuthMsg2 struct {
 	// RSASSA-PSS is used to compute dhSig.
 	DhSig []byte
 
-	// Mac(Km1; IdS)
+	// Mac(Km1; IdS, flags)
 	DhMac []byte
+
+	// Upgrade is set if the server wants the client to upgrade the
+	// user's record. See Auth1WithUpgrade. It is covered by DhMac.
+	Upgrade bool `json:",omitempty"`
+
+	// EncKey is a random key encrypted to PubU. It is only set by
+	// Auth1Implicit and it is covered by DhMac.
+	EncKey []byte `json:",omitempty"`
+
+	// SecondFactor is an encrypted second factor challenge. It is only
+	// set if the user has a second factor and it is covered by DhMac.
+	SecondFactor []byte `json:",omitempty"`
+
+	// PasswordChange is set if the password has expired or a change has
+	// been forced. It is covered by DhMac.
+	PasswordChange bool `json:",omitempty"`
 }
 
 // After receiving AuthMsg2 client can compute RwdU as H(x, v, b*v^{-r}).
@@ -116,6 +212,10 @@ type AuthMsg3 struct {
 
 	// Mac(Km2; IdU)
 	DhMac []byte
+
+	// SecondFactor is the encrypted answer to the second factor
+	// challenge in AuthMsg2. See AnswerSecondFactor.
+	SecondFactor []byte `json:",omitempty"`
 }
 
 // AuthInit initiates the authentication protocol. It's run on the client and,
@@ -126,17 +226,31 @@ type AuthMsg3 struct {
 //
 // See also Auth1, Auth2, and Auth3.
 func AuthInit(username, password string) (*AuthClientSession, AuthMsg1, error) {
+	return AuthInitWithCredential(username, "", password)
+}
+
+// AuthInitWithCredential is like AuthInit but the user authenticates with the
+// credential identified by credentialID (see NewCredentialInit) instead of the
+// primary credential. If credentialID is empty AuthInitWithCredential is
+// equivalent to AuthInit.
+func AuthInitWithCredential(username, credentialID, password string) (*AuthClientSession, AuthMsg1, error) {
 	var sess AuthClientSession
+	sess.username = username
 	sess.password = password
+	sess.credentialID = credentialID
 	var msg1 AuthMsg1
 	var err error
+	msg1.Version = ProtocolVersion
 	msg1.Username = username
+	msg1.CredentialID = credentialID
 
-	msg1.A, sess.r, err = dhOprf1(password)
+	var blinded oprf.BlindedElement
+	sess.blind, blinded, err = oprf.Blind([]byte(password))
 	if err != nil {
 		return nil, AuthMsg1{}, err
 	}
-	sess.x, err = dhGroup.GeneratePrivateKey()
+	msg1.A = blinded.A
+	sess.x, err = dhGroup.GeneratePrivateKey(randr)
 	if err != nil {
 		return nil, AuthMsg1{}, err
 	}
@@ -146,6 +260,20 @@ func AuthInit(username, password string) (*AuthClientSession, AuthMsg1, error) {
 	return &sess, msg1, nil
 }
 
+// AuthInitWithDevice is like AuthInit but the server is asked for the envelope
+// of the device identified by deviceID (see AddDevice) instead of the primary
+// envelope. The envelope is opened with Auth2WithDevice. If deviceID is empty
+// AuthInitWithDevice is equivalent to AuthInit.
+func AuthInitWithDevice(username, deviceID, password string) (*AuthClientSession, AuthMsg1, error) {
+	sess, msg1, err := AuthInit(username, password)
+	if err != nil {
+		return nil, AuthMsg1{}, err
+	}
+	sess.deviceID = deviceID
+	msg1.DeviceID = deviceID
+	return sess, msg1, nil
+}
+
 // Auth1 is the processing done by the server when it receives an AuthMsg1
 // struct. On success a nil error is returned together with a AuthServerSession
 // and an AuthMsg2 struct. The AuthMsg2 struct should be sent to the client.
@@ -158,23 +286,73 @@ func AuthInit(username, password string) (*AuthClientSession, AuthMsg1, error) {
 //
 // See also AuthInit, Auth2, and Auth3.
 func Auth1(privS *rsa.PrivateKey, user *User, msg1 AuthMsg1) (*AuthServerSession, AuthMsg2, error) {
-	y, err := dhGroup.GeneratePrivateKey()
+	return Auth1WithUpgrade(privS, user, msg1, false)
+}
+
+// Auth1WithUpgrade is like Auth1 but if upgrade is true the client is told
+// that user's record is outdated (e.g., because it was created with a smaller
+// RSA key than the server currently requires). After a successful run of the
+// authentication protocol the client can then create a new record with
+// UpgradeInit, see Upgrade1. Upgrades are only requested when the client uses
+// the primary credential and CanUpgrade returns true for user.
+func Auth1WithUpgrade(privS *rsa.PrivateKey, user *User, msg1 AuthMsg1, upgrade bool) (*AuthServerSession, AuthMsg2, error) {
+	return auth1(privS, nil, nil, user, msg1, upgrade, nil)
+}
+
+// Auth1WithKeyPool is like Auth1WithUpgrade but the server's ephemeral D-H key
+// pair is taken from pool if it isn't empty. See KeyPool. pool may be nil.
+func Auth1WithKeyPool(privS *rsa.PrivateKey, pool *KeyPool, user *User, msg1 AuthMsg1, upgrade bool) (*AuthServerSession, AuthMsg2, error) {
+	return auth1(privS, nil, pool, user, msg1, upgrade, nil)
+}
+
+// auth1 implements Auth1WithUpgrade, Auth1WithMasterKey, Auth1WithKeyPool and
+// Auth1Implicit. mk is the master key, nil if none is used. pool is the pool of
+// ephemeral key pairs, nil if none is used. encKey is the key encapsulated to
+// PubU by Auth1Implicit, nil otherwise.
+func auth1(privS *rsa.PrivateKey, mk *MasterKey, pool *KeyPool, user *User, msg1 AuthMsg1, upgrade bool, encKey []byte) (*AuthServerSession, AuthMsg2, error) {
+	if err := checkVersion(msg1.Version); err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	if err := checkDhPub(msg1.DhPubClient); err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	key, encryptedEnvU, known := user.credential(privS, msg1.CredentialID)
+	eval, err := evaluateOprf(mk, user, key, msg1)
 	if err != nil {
 		return nil, AuthMsg2{}, err
 	}
-	var msg2 AuthMsg2
-
-	msg2.V, msg2.B, err = dhOprf2(msg1.A, user.K)
+	passwordChange, err := user.checkLogin(time.Now())
+	if err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	ephemeral, err := ephemeralKey(pool)
 	if err != nil {
 		return nil, AuthMsg2{}, err
 	}
-	msg2.EnvU = user.EnvU
-	msg2.DhPubServer = dhGroup.GeneratePublicKey(y)
+	y := ephemeral.priv
+	var msg2 AuthMsg2
+	msg2.V, msg2.B = eval.V, eval.B
+	msg2.EnvU = encryptedEnvU
+	if msg1.DeviceID != "" {
+		if msg1.CredentialID != "" || user.HoneyEnvU != nil {
+			return nil, AuthMsg2{}, errors.New("devices can't be combined with credentials or honey envelopes")
+		}
+		msg2.EnvU = deviceEnvelope(privS, user, msg1.DeviceID)
+	}
+	if msg1.CredentialID == "" {
+		msg2.Upgrade = upgrade && CanUpgrade(user)
+		msg2.PasswordChange = passwordChange
+		for _, env := range user.HoneyEnvU {
+			msg2.HoneyEnvU = append(msg2.HoneyEnvU, env.EnvU)
+		}
+	}
+	msg2.EncKey = encKey
+	msg2.DhPubServer = ephemeral.pub
 
 	h := hasher()
 	h.Write(dhGroup.Bytes(msg1.DhPubClient))
 	h.Write(dhGroup.Bytes(msg2.DhPubServer))
-	sig, err := rsa.SignPSS(randr, privS, hasherId, h.Sum(nil), nil)
+	sig, err := rsa.SignPSS(rsaRandom(), privS, hasherId, h.Sum(nil), nil)
 	if err != nil {
 		return nil, AuthMsg2{}, err
 	}
@@ -183,7 +361,14 @@ func Auth1(privS *rsa.PrivateKey, user *User, msg1 AuthMsg1) (*AuthServerSession
 	if err != nil {
 		return nil, AuthMsg2{}, err
 	}
-	msg2.DhMac = computeDhMac(dhMacKey, &privS.PublicKey)
+	var challenge []byte
+	if user.TOTPSecret != nil {
+		challenge, msg2.SecondFactor, err = newSecondFactorChallenge(dhMacKey)
+		if err != nil {
+			return nil, AuthMsg2{}, err
+		}
+	}
+	msg2.DhMac = computeDhMac(dhMacKey, &privS.PublicKey, msg2Flags(&msg2))
 	session := &AuthServerSession{
 		y:              y,
 		dhPubServer:    msg2.DhPubServer,
@@ -192,6 +377,10 @@ func Auth1(privS *rsa.PrivateKey, user *User, msg1 AuthMsg1) (*AuthServerSession
 		user:           user,
 		dhMacKey:       dhMacKey,
 		dhSharedSecret: dhSharedSecret,
+		credentialID:   msg1.CredentialID,
+		fake:           !known,
+		challenge:      challenge,
+		passwordChange: msg2.PasswordChange,
 	}
 	return session, msg2, nil
 }
@@ -207,15 +396,60 @@ func Auth1(privS *rsa.PrivateKey, user *User, msg1 AuthMsg1) (*AuthServerSession
 // (i.e., the server has proved to the client that it posses information
 // obtained from the password registration protocol for this user).
 //
+// If msg2 was created by Auth1Implicit the secret also depends on a key that
+// only the holder of PrivU can decrypt, and msg3 doesn't need to be sent.
+// Instead, the client sends the MAC from ConfirmationMac, which confirms the
+// session to the server (see AuthServerSession.Confirm).
+//
+// If the user has honey envelopes (see AddHoneyEnvelopes) and the password
+// doesn't open any of them, Auth2 doesn't return an error. The returned AuthMsg3
+// is rejected by the server, just as for a decoy password, so the client only
+// learns that the login failed from the server. The server hasn't been
+// authenticated in that case.
+//
 // A non-nil error is returned on failure.
 //
 // See also InitAuth, Auth1, and Auth3.
 func Auth2(sess *AuthClientSession, msg2 AuthMsg2) (secret []byte, msg3 AuthMsg3, err error) {
-	rwdU, err := dhOprf3(sess.password, msg2.V, msg2.B, sess.r)
+	return Auth2WithDevice(sess, msg2, "", nil)
+}
+
+// Auth2WithDevice is like Auth2 but the envelope is decrypted using a key
+// derived from both RwdU and deviceSecret. deviceID must be the id given to
+// AuthInitWithDevice: the empty string for the primary envelope created by
+// PwReg2WithDevice and other ids for envelopes added with AddDevice. The server
+// doesn't tell whether a device exists, so an unknown device id fails like a
+// wrong password. If deviceID is empty and deviceSecret is nil Auth2WithDevice
+// is equivalent to Auth2.
+func Auth2WithDevice(sess *AuthClientSession, msg2 AuthMsg2, deviceID string, deviceSecret []byte) (secret []byte, msg3 AuthMsg3, err error) {
+	if err := checkDhPub(msg2.DhPubServer); err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	rwdU, err := finalizeOprf(sess.blind, sess.info, msg2.V, msg2.B)
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	if deviceID != sess.deviceID {
+		return nil, AuthMsg3{}, errors.New("device id mismatch")
+	}
+	key, err := envelopeKey(rwdU, deviceSecret)
 	if err != nil {
 		return nil, AuthMsg3{}, err
 	}
-	encodedEnvU, err := authenc.AuthDec(rwdU[:16], msg2.EnvU)
+	encodedEnvU, err := authenc.AuthDec(key, msg2.EnvU)
+	if deviceID == "" && len(msg2.HoneyEnvU) > 0 {
+		// At most one of the envelopes can be opened with the
+		// password.
+		for _, env := range msg2.HoneyEnvU {
+			encodedEnvU, err = authenc.AuthDec(key, env)
+			if err == nil {
+				break
+			}
+		}
+	}
+	if err != nil && deviceID == "" && len(msg2.HoneyEnvU) > 0 {
+		return honeyFailure(sess, msg2)
+	}
 	if err != nil {
 		return nil, AuthMsg3{}, err
 	}
@@ -234,14 +468,32 @@ func Auth2(sess *AuthClientSession, msg2 AuthMsg2) (secret []byte, msg3 AuthMsg3
 	if err != nil {
 		return nil, AuthMsg3{}, err
 	}
-	if !verifyDhMac(dhMacKey, envU.pubS, msg2.DhMac) {
+	if !verifyDhMac(dhMacKey, envU.pubS, msg2Flags(&msg2), msg2.DhMac) {
 		return nil, AuthMsg3{}, errors.New("MAC mismatch")
 	}
-	sig, err := rsa.SignPSS(randr, envU.privU, hasherId, h.Sum(nil), nil)
+	sig, err := rsa.SignPSS(rsaRandom(), envU.privU, hasherId, h.Sum(nil), nil)
 	if err != nil {
 		return nil, AuthMsg3{}, err
 	}
-	mac := computeDhMac(dhMacKey, &envU.privU.PublicKey)
+	mac := computeDhMac(dhMacKey, &envU.privU.PublicKey, nil)
+	if msg2.SecondFactor != nil {
+		sess.challenge, err = openSecondFactorChallenge(dhMacKey, msg2.SecondFactor)
+		if err != nil {
+			return nil, AuthMsg3{}, err
+		}
+		sess.dhMacKey = dhMacKey
+	}
+	if msg2.EncKey != nil {
+		dhSharedSecret, err = implicitSecret(dhSharedSecret, envU.privU, msg2.EncKey)
+		if err != nil {
+			return nil, AuthMsg3{}, err
+		}
+		sess.implicitSecret = dhSharedSecret
+	}
+	sess.rwdU = rwdU
+	sess.env = &envU
+	sess.upgrade = msg2.Upgrade
+	sess.passwordChange = msg2.PasswordChange
 	return dhSharedSecret, AuthMsg3{DhSig: sig, DhMac: mac}, nil
 }
 
@@ -255,24 +507,70 @@ func Auth2(sess *AuthClientSession, msg2 AuthMsg2) (secret []byte, msg3 AuthMsg3
 // the client has proved to the server that it posses information used when the
 // password registration protocol ran for this user).
 //
+// Auth3 records the login, or the failed attempt, as a change to the user. The
+// server should store it with UpdateUser whether or not Auth3 succeeds.
+//
 // A non-nil error is returned on failure.
 //
 // See also AuthInit, Auth1, and Auth2.
 func Auth3(sess *AuthServerSession, msg3 AuthMsg3) (secret []byte, err error) {
+	if sess.user.HoneyEnvU != nil {
+		return nil, errors.New("user has honey envelopes, use Auth3WithHoney")
+	}
+	if sess.implicit {
+		return nil, errors.New("session uses implicit authentication")
+	}
+	if err := verifyAuthMsg3(sess, sess.user.PubU, msg3); err != nil {
+		sess.loginFailed()
+		return nil, err
+	}
+	if err := verifySecondFactor(sess, msg3); err != nil {
+		sess.loginFailed()
+		return nil, err
+	}
+	sess.loginSucceeded()
+	return sess.dhSharedSecret, nil
+}
+
+// verifyAuthMsg3 verifies the signature and MAC in msg3 using the client's
+// public key pubU.
+func verifyAuthMsg3(sess *AuthServerSession, pubU *rsa.PublicKey, msg3 AuthMsg3) error {
+	if sess.fake {
+		return rsa.ErrVerification
+	}
 	h := hasher()
 	h.Write(dhGroup.Bytes(sess.dhPubClient))
 	h.Write(dhGroup.Bytes(sess.dhPubServer))
-	err = rsa.VerifyPSS(sess.user.PubU, hasherId, h.Sum(nil), msg3.DhSig, nil)
+	err := rsa.VerifyPSS(pubU, hasherId, h.Sum(nil), msg3.DhSig, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if !verifyDhMac(sess.dhMacKey, sess.user.PubU, msg3.DhMac) {
-		return nil, errors.New("MAC mismatch")
+	if !verifyDhMac(sess.dhMacKey, pubU, nil, msg3.DhMac) {
+		return errors.New("MAC mismatch")
 	}
-	return sess.dhSharedSecret, nil
+	return nil
+}
+
+// EnvelopeData returns the application data stored in the envelope by
+// PwReg2WithData. It returns nil before Auth2 has returned successfully and if
+// the envelope doesn't contain any application data.
+func (sess *AuthClientSession) EnvelopeData() *EnvelopeData {
+	if sess.env == nil {
+		return nil
+	}
+	return sess.env.data
 }
 
-func computeDhMac(key []byte, pk *rsa.PublicKey) []byte {
+// UpgradeRequested returns true if the server asked for the user's record to
+// be upgraded during the authentication protocol. It only returns true after
+// Auth2 has returned successfully.
+func (sess *AuthClientSession) UpgradeRequested() bool {
+	return sess.upgrade
+}
+
+// computeDhMac computes Mac(key; pk, flags). flags is nil if no flags are set,
+// in which case the MAC is the same as Mac(key; pk).
+func computeDhMac(key []byte, pk *rsa.PublicKey, flags []byte) []byte {
 	pemdata := pem.EncodeToMemory(
 		&pem.Block{
 			Type:  "RSA PUBLIC KEY",
@@ -281,14 +579,50 @@ func computeDhMac(key []byte, pk *rsa.PublicKey) []byte {
 	)
 	mac := hmac.New(hasher, key)
 	mac.Write(pemdata)
+	mac.Write(flags)
 	return mac.Sum(nil)
 }
 
-func verifyDhMac(key []byte, pk *rsa.PublicKey, origMac []byte) bool {
-	mac := computeDhMac(key, pk)
+// msg2Flags encodes the flags in msg2 which are covered by DhMac. Each field
+// is prefixed by its length, as in regCodeMac, so that the encoding is
+// unambiguous.
+func msg2Flags(msg2 *AuthMsg2) []byte {
+	var flags []byte
+	appendField := func(field []byte) {
+		flags = binary.BigEndian.AppendUint32(flags, uint32(len(field)))
+		flags = append(flags, field...)
+	}
+	if msg2.Upgrade {
+		appendField([]byte("upgrade"))
+	}
+	if msg2.PasswordChange {
+		appendField([]byte("password change"))
+	}
+	if msg2.EncKey != nil {
+		appendField([]byte("implicit"))
+		appendField(msg2.EncKey)
+	}
+	if msg2.SecondFactor != nil {
+		appendField([]byte("second factor"))
+		appendField(msg2.SecondFactor)
+	}
+	return flags
+}
+
+func verifyDhMac(key []byte, pk *rsa.PublicKey, flags []byte, origMac []byte) bool {
+	mac := computeDhMac(key, pk, flags)
 	return hmac.Equal(mac, origMac)
 }
 
+// checkDhPub checks that x, a D-H public key received from the peer, has order
+// q.
+func checkDhPub(x *big.Int) error {
+	if x == nil || !dhGroup.IsInGroup(x) || dhGroup.IsInSmallSubgroup(x) || !dhGroup.IsInSubgroup(x) {
+		return errors.New("invalid D-H public key")
+	}
+	return nil
+}
+
 func dhSecrets(dhPriv, dhPub *big.Int) (dhSharedSecret, dhMacKey []byte, err error) {
 	kdf := hkdf.New(hasher, dhGroup.SharedSecret(dhPriv, dhPub), nil, nil)
 	dhSharedSecret = make([]byte, 16)
@@ -3,6 +3,10 @@
 // Use of this source code is governed by the BSD-style license that can be
 // found in the LICENSE file.
 
+// The tests use 512-bit RSA keys to run quickly. crypto/rsa rejects keys below
+// 1024 bits unless this setting is given.
+//go:debug rsa1024min=0
+
 package opaque
 
 import (
@@ -78,7 +82,8 @@ func TestAuth(t *testing.T) {
 	}{
 		{func(msg1 *AuthMsg1) { msg1.A.SetInt64(0) }, nil, nil, "server: a is not in D-H group"},
 		{func(msg1 *AuthMsg1) { msg1.A.SetInt64(1) }, nil, nil, "server: a is in a small subgroup"},
-		{func(msg1 *AuthMsg1) { msg1.DhPubClient = big.NewInt(123) }, nil, nil, "client: crypto/rsa: verification error"},
+		{func(msg1 *AuthMsg1) { msg1.A.Sub(dhGroup.P, big.NewInt(4)) }, nil, nil, "server: a is not in the prime-order subgroup"},
+		{func(msg1 *AuthMsg1) { msg1.DhPubClient = big.NewInt(123) }, nil, nil, "server: invalid D-H public key"},
 
 		{nil, func(msg2 *AuthMsg2) { msg2.V.SetInt64(0) }, nil, "client: v is not in D-H group"},
 		{nil, func(msg2 *AuthMsg2) { msg2.V.SetInt64(1) }, nil, "client: v is in a small subgroup"},
@@ -87,8 +92,8 @@ func TestAuth(t *testing.T) {
 		{nil, func(msg2 *AuthMsg2) { msg2.EnvU = append([]byte(nil), msg2.EnvU...); msg2.EnvU[0] ^= 42 }, nil, "client: Authtag mismatch"},
 		{nil, func(msg2 *AuthMsg2) { msg2.DhSig[0] ^= 42 }, nil, "client: crypto/rsa: verification error"},
 		{nil, func(msg2 *AuthMsg2) { msg2.DhMac[0] ^= 42 }, nil, "client: MAC mismatch"},
-		{nil, func(msg2 *AuthMsg2) { msg2.DhPubServer = big.NewInt(-123) }, nil, "client: crypto/rsa: verification error"},
-		{nil, func(msg2 *AuthMsg2) { msg2.DhPubServer = big.NewInt(123) }, nil, "client: crypto/rsa: verification error"},
+		{nil, func(msg2 *AuthMsg2) { msg2.DhPubServer = big.NewInt(-123) }, nil, "client: invalid D-H public key"},
+		{nil, func(msg2 *AuthMsg2) { msg2.DhPubServer = big.NewInt(123) }, nil, "client: invalid D-H public key"},
 
 		{nil, nil, func(msg3 *AuthMsg3) { msg3.DhSig[0] ^= 42 }, "server: crypto/rsa: verification error"},
 		{nil, nil, func(msg3 *AuthMsg3) { msg3.DhMac[0] ^= 42 }, "server: MAC mismatch"},
@@ -145,7 +150,7 @@ func authenticate(privS *rsa.PrivateKey, user *User, password string, msg1Mod fu
 }
 
 func TestDhSecrets(t *testing.T) {
-	priv, err := dhGroup.GeneratePrivateKey()
+	priv, err := dhGroup.GeneratePrivateKey(randr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,3 +166,60 @@ func TestDhSecrets(t *testing.T) {
 		t.Fatalf("shared = key = %v", shared)
 	}
 }
+
+// benchmarkUser returns a server key and a registered user for the benchmarks.
+func benchmarkUser(b *testing.B) (*rsa.PrivateKey, *User) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		b.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return privS, user
+}
+
+func BenchmarkAuth1(b *testing.B) {
+	privS, user := benchmarkUser(b)
+	_, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := Auth1(privS, user, msg1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAuth2(b *testing.B) {
+	privS, user := benchmarkUser(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sess, msg1, err := AuthInit("user", "password")
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, msg2, err := Auth1(privS, user, msg1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if _, _, err := Auth2(sess, msg2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMsg2Flags(t *testing.T) {
+	// Without length prefixes both would be encoded as "implicit" || "key"
+	// || "second factor".
+	a := AuthMsg2{EncKey: []byte("keysecond factor")}
+	b := AuthMsg2{EncKey: []byte("key"), SecondFactor: []byte{}}
+	if bytes.Equal(msg2Flags(&a), msg2Flags(&b)) {
+		t.Fatal("Different flags have the same encoding")
+	}
+}
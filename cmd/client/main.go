@@ -7,14 +7,86 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/frekui/opaque"
 	"github.com/frekui/opaque/internal/pkg/util"
+	xed25519 "golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Options given on the command line which are used by doPwreg and doAuth.
+var (
+	// Server's username key. If non-nil, the username is encrypted.
+	usernameKey *big.Int
+
+	// One-time registration code.
+	regCode string
+
+	// Device id and device secret. The envelope is only bound to a
+	// device if deviceSecret is non-nil.
+	deviceID     string
+	deviceSecret []byte
+
+	// If non-empty, a new device with this id is added after
+	// authentication.
+	addDevice string
+
+	// Number of bits in the client's RSA key.
+	rsaBits int
+
+	// If true, the two-message mode of the authentication protocol is
+	// used.
+	implicit bool
+
+	// TOTP secret used to answer second factor challenges, and whether
+	// to enable TOTP after authentication.
+	totpSecret []byte
+	enableTOTP bool
+
+	// If non-empty, the password is changed to this after
+	// authentication.
+	changePassword string
+
+	// Credential to authenticate with, empty for the primary credential.
+	credentialID string
+
+	// If non-empty, a credential with this id is added after
+	// authentication. Its password is newPassword, or a generated
+	// recovery code if newPassword is empty.
+	addCredential string
+	newPassword   string
+
+	// If non-empty, the credential with this id is revoked after
+	// authentication.
+	revokeCredential string
+
+	// Number of anonymous tokens to request after authentication, and
+	// the issuer's public key which they are verified against.
+	numTokens int
+	issuerKey *big.Int
+
+	// Application data stored in the envelope during password
+	// registration. Nil if neither -identity nor -payload is given.
+	envelopeData *opaque.EnvelopeData
+
+	// If true, the password is sent to the server if it asks to migrate a
+	// legacy password hash. It's only sent over TLS, i.e., if secure is
+	// true.
+	migrate bool
+	secure  bool
 )
 
 func main() {
@@ -24,17 +96,99 @@ func main() {
 	}
 
 	addr := flag.String("conn", "localhost:9999", "Host to connect to.")
+	tlsCA := flag.String("tls-ca", "", "File with CA certificates (PEM). If given, the client connects with TLS and verifies the server's certificate against them.")
+	flag.BoolVar(&migrate, "migrate", false, "Send the password to the server if it asks to migrate a legacy password hash. Requires -tls-ca.")
 	pwreg := flag.Bool("pwreg", false, "Register password.")
 	auth := flag.Bool("auth", false, "Authenticate and send message to server")
 	username := flag.String("username", "", "Username")
 	password := flag.String("password", "", "Password")
+	serverKey := flag.String("server-key", "", "Server's username key (hex). If given, the username is encrypted.")
+	flag.StringVar(&regCode, "regcode", "", "One-time registration code issued by the server (only used with -pwreg).")
+	flag.StringVar(&deviceID, "device-id", "", "Id of this device. Empty for the device used during password registration.")
+	secretHex := flag.String("device-secret", "", "Device secret (hex). If given, the envelope is bound to this device.")
+	flag.StringVar(&addDevice, "add-device", "", "Add a device with this id after authentication and print its device secret.")
+	flag.IntVar(&rsaBits, "rsa-bits", 2048, "Number of bits in the client's RSA key.")
+	identity := flag.String("identity", "", "File with a private key (PEM or OpenSSH format) to store in the envelope (only used with -pwreg).")
+	payload := flag.String("payload", "", "Payload to store in the envelope (only used with -pwreg).")
+	flag.BoolVar(&implicit, "implicit", false, "Use the two-message mode of the authentication protocol (requires a key with at least 1024 bits).")
+	totpHex := flag.String("totp-secret", "", "TOTP secret (base32) used to answer second factor challenges.")
+	flag.BoolVar(&enableTOTP, "enable-totp", false, "Enable TOTP after authentication and print the TOTP secret.")
+	flag.StringVar(&changePassword, "change-password", "", "Change the password to this after authentication.")
+	flag.StringVar(&credentialID, "credential", "", "Id of the credential to authenticate with. Empty for the primary credential.")
+	flag.StringVar(&addCredential, "add-credential", "", "Add a credential with this id after authentication.")
+	flag.StringVar(&newPassword, "new-password", "", "Password of the credential added with -add-credential. If empty, a recovery code is generated and printed.")
+	flag.StringVar(&revokeCredential, "revoke-credential", "", "Revoke the credential with this id after authentication.")
+	flag.IntVar(&numTokens, "tokens", 0, "Request this many anonymous tokens after authentication and print them.")
+	issuerHex := flag.String("issuer-key", "", "Server's token issuer key (hex). Required with -tokens.")
+	redeem := flag.String("redeem", "", "Redeem a token printed by -tokens.")
 	flag.Parse()
-	if !*pwreg && !*auth {
-		fmt.Fprintf(os.Stderr, "Exactly one of -pwreg and -auth must be given.\n")
+	if *issuerHex != "" {
+		var ok bool
+		issuerKey, ok = new(big.Int).SetString(*issuerHex, 16)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Invalid -issuer-key.\n")
+			os.Exit(1)
+		}
+	}
+	if numTokens > 0 && issuerKey == nil {
+		fmt.Fprintf(os.Stderr, "-tokens requires -issuer-key.\n")
+		os.Exit(1)
+	}
+	if *serverKey != "" {
+		var ok bool
+		usernameKey, ok = new(big.Int).SetString(*serverKey, 16)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Invalid -server-key.\n")
+			os.Exit(1)
+		}
+	}
+	if *secretHex != "" {
+		var err error
+		deviceSecret, err = hex.DecodeString(*secretHex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -device-secret: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *totpHex != "" {
+		var err error
+		totpSecret, err = base32.StdEncoding.DecodeString(*totpHex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -totp-secret: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *identity != "" || *payload != "" {
+		envelopeData = &opaque.EnvelopeData{}
+		if *identity != "" {
+			key, err := loadIdentity(*identity)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid -identity: %s\n", err)
+				os.Exit(1)
+			}
+			envelopeData.Key = key
+		}
+		if *payload != "" {
+			envelopeData.Payload = []byte(*payload)
+		}
+	}
+	if !*pwreg && !*auth && *redeem == "" {
+		fmt.Fprintf(os.Stderr, "Exactly one of -pwreg, -auth and -redeem must be given.\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	conn, err := net.Dial("tcp", *addr)
+	if migrate && *tlsCA == "" {
+		fmt.Fprintf(os.Stderr, "-migrate requires -tls-ca.\n")
+		os.Exit(1)
+	}
+	var conn net.Conn
+	var err error
+	if *tlsCA != "" {
+		conn, err = dialTLS(*addr, *tlsCA)
+		secure = true
+	} else {
+		conn, err = net.Dial("tcp", *addr)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -52,10 +206,23 @@ func main() {
 			fmt.Fprintf(os.Stderr, "pwreg: %s\n", err)
 			os.Exit(1)
 		}
+	} else if *redeem != "" {
+		err := util.Write(w, []byte("redeem"))
+		if err == nil {
+			err = doRedeem(r, w, *redeem)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "redeem: %s\n", err)
+			os.Exit(1)
+		}
 	} else {
-		err := util.Write(w, []byte("auth"))
+		cmd := "auth"
+		if implicit {
+			cmd = "auth-implicit"
+		}
+		err := util.Write(w, []byte(cmd))
 		if err == nil {
-			err = doAuth(r, w, *username, *password, "Hello from client")
+			err = doAuth(r, w, *username, *password)
 		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "auth: %s\n", err)
@@ -65,15 +232,76 @@ func main() {
 }
 
 func doPwreg(r *bufio.Reader, w *bufio.Writer, username, password string) error {
-	sess, msg1, err := opaque.PwRegInit(username, password, 512)
+	var sess *opaque.PwRegClientSession
+	var msg1 opaque.PwRegMsg1
+	if regCode != "" {
+		code, err := opaque.ParseRegCode(regCode)
+		if err != nil {
+			return err
+		}
+		sess, msg1, err = opaque.PwRegInitWithCode(username, password, rsaBits, code)
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		sess, msg1, err = opaque.PwRegInit(username, password, rsaBits)
+		if err != nil {
+			return err
+		}
+	}
+	if usernameKey != nil {
+		if err := opaque.EncryptPwRegUsername(&msg1, usernameKey); err != nil {
+			return err
+		}
+	}
+	if err := util.WriteMsg(w, msg1); err != nil {
+		return err
+	}
+
+	var msg2 opaque.PwRegMsg2
+	if err := util.ReadMsg(r, &msg2); err != nil {
+		return err
+	}
+
+	msg3, err := opaque.PwReg2WithData(sess, msg2, deviceSecret, envelopeData)
+	if err != nil {
+		util.WriteAlert(w, err)
+		return err
+	}
+	if err := util.WriteMsg(w, msg3); err != nil {
+		return err
+	}
+
+	final, err := util.Read(r)
 	if err != nil {
 		return err
 	}
-	data1, err := json.Marshal(msg1)
+	if string(final) != "ok" {
+		return fmt.Errorf("expected final ok, got %s", string(final))
+	}
+
+	return nil
+}
+
+func doAuth(r *bufio.Reader, w *bufio.Writer, username, password string) error {
+	var sess *opaque.AuthClientSession
+	var msg1 opaque.AuthMsg1
+	var err error
+	if deviceID != "" {
+		sess, msg1, err = opaque.AuthInitWithDevice(username, deviceID, password)
+	} else {
+		sess, msg1, err = opaque.AuthInitWithCredential(username, credentialID, password)
+	}
 	if err != nil {
 		return err
 	}
-	if err := util.Write(w, data1); err != nil {
+	if usernameKey != nil {
+		if err := opaque.EncryptUsername(sess, &msg1, usernameKey); err != nil {
+			return err
+		}
+	}
+	if err := util.WriteMsg(w, msg1); err != nil {
 		return err
 	}
 
@@ -81,68 +309,368 @@ func doPwreg(r *bufio.Reader, w *bufio.Writer, username, password string) error
 	if err != nil {
 		return err
 	}
-	var msg2 opaque.PwRegMsg2
-	if err := json.Unmarshal(data2, &msg2); err != nil {
+	if string(data2) == "puzzle" {
+		// The server is under load and wants proof of work before
+		// it processes msg1.
+		if err := doPuzzle(r, w, msg1); err != nil {
+			return err
+		}
+		data2, err = util.Read(r)
+		if err != nil {
+			return err
+		}
+	}
+	if string(data2) == "migrate" {
+		// The server has a legacy password hash for the user. Send
+		// the password so that the server can verify it and create a
+		// record, then restart the authentication protocol. Anyone
+		// can ask for the password, so it's only sent if the user
+		// has asked for it and the server has been authenticated.
+		if !migrate || !secure {
+			return fmt.Errorf("The server asks for the password to migrate a legacy account; use -tls-ca and -migrate to send it over TLS")
+		}
+		if err := doMigrate(r, w, password); err != nil {
+			return err
+		}
+		return doAuth(r, w, username, password)
+	}
+	var msg2 opaque.AuthMsg2
+	if err := util.UnmarshalMsg(data2, &msg2); err != nil {
 		return err
 	}
 
-	msg3, err := opaque.PwReg2(sess, msg2)
+	sharedSecret, msg3, err := opaque.Auth2WithDevice(sess, msg2, deviceID, deviceSecret)
+	if err == nil && sess.SecondFactorRequired() {
+		// The example client acts as an authenticator app and
+		// computes the code itself.
+		if totpSecret == nil {
+			err = fmt.Errorf("Second factor required, use -totp-secret")
+		} else {
+			err = opaque.AnswerSecondFactor(sess, &msg3, opaque.TOTPCode(totpSecret))
+		}
+	}
 	if err != nil {
+		util.WriteAlert(w, err)
 		return err
 	}
-	data3, err := json.Marshal(msg3)
+	if !implicit {
+		if err := util.WriteMsg(w, msg3); err != nil {
+			return err
+		}
+
+		ok, err := util.Read(r)
+		if err != nil {
+			return err
+		}
+		if string(ok) != "ok" {
+			return fmt.Errorf("Expected ok, got '%s'", string(ok))
+		}
+	}
+	if data := sess.EnvelopeData(); data != nil {
+		if err := printEnvelopeData(data); err != nil {
+			return err
+		}
+	}
+
+	// FIXME: Use a PRF to have separate keys for client->server and
+	// server->client.
+	key := sharedSecret[:16]
+	plaintext, err := util.ReadAndDecrypt(r, key)
 	if err != nil {
 		return err
 	}
-	if err := util.Write(w, data3); err != nil {
+	fmt.Printf("Received '%s'\n", plaintext)
+	toServer := "Hi server!"
+	fmt.Printf("Sending '%s'\n", toServer)
+	if err := util.EncryptAndWrite(w, key, toServer); err != nil {
 		return err
 	}
+	if implicit {
+		// Prove to the server that we hold the secret.
+		if err := util.Write(w, sess.ConfirmationMac()); err != nil {
+			return err
+		}
+	}
+	if sess.PasswordChangeRequired() && changePassword == "" {
+		return fmt.Errorf("Password must be changed, use -change-password")
+	}
+	if changePassword != "" {
+		if err := doUpgrade(r, w, key, sess, changePassword); err != nil {
+			return err
+		}
+	} else if sess.UpgradeRequested() {
+		if err := doUpgrade(r, w, key, sess, ""); err != nil {
+			return err
+		}
+	}
+	if addDevice != "" {
+		if err := doAddDevice(r, w, key, sess); err != nil {
+			return err
+		}
+	}
+	if addCredential != "" {
+		if err := doAddCredential(r, w, key, sess); err != nil {
+			return err
+		}
+	}
+	if revokeCredential != "" {
+		if err := doRevokeCredential(r, w, key); err != nil {
+			return err
+		}
+	}
+	if enableTOTP {
+		if err := doEnableTOTP(r, w, key); err != nil {
+			return err
+		}
+	}
+	if numTokens > 0 {
+		if err := doTokens(r, w, key, sess); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	final, err := util.Read(r)
+// doTokens requests anonymous tokens, protected by key, and prints them in the
+// form accepted by -redeem.
+func doTokens(r *bufio.Reader, w *bufio.Writer, key []byte, sess *opaque.AuthClientSession) error {
+	tsess, req, err := opaque.NewTokenRequest(sess, numTokens)
 	if err != nil {
 		return err
 	}
-	if string(final) != "ok" {
-		return fmt.Errorf("expected final ok, got %s", string(final))
+	if err := util.EncryptAndWrite(w, key, "tokens"); err != nil {
+		return err
 	}
+	if err := util.EncryptAndWriteMsg(w, key, req); err != nil {
+		return err
+	}
+	var resp opaque.TokenResponse
+	if err := util.ReadAndDecryptMsg(r, key, &resp); err != nil {
+		return err
+	}
+	if err := readOk(r, key); err != nil {
+		return err
+	}
+	tokens, err := opaque.FinalizeTokens(tsess, issuerKey, resp)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		fmt.Printf("Token: %x.%x\n", token.Nonce, token.Output)
+	}
+	return nil
+}
 
+// doRedeem redeems a token printed by doTokens. The connection isn't
+// authenticated.
+func doRedeem(r *bufio.Reader, w *bufio.Writer, s string) error {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return fmt.Errorf("Malformed token")
+	}
+	var token opaque.Token
+	var err error
+	if token.Nonce, err = hex.DecodeString(parts[0]); err != nil {
+		return err
+	}
+	if token.Output, err = hex.DecodeString(parts[1]); err != nil {
+		return err
+	}
+	if err := util.WriteMsg(w, token); err != nil {
+		return err
+	}
+	ok, err := util.Read(r)
+	if err != nil {
+		return err
+	}
+	if string(ok) != "ok" {
+		return fmt.Errorf("Expected ok, got '%s'", string(ok))
+	}
+	fmt.Printf("Token redeemed\n")
 	return nil
 }
 
-func doAuth(r *bufio.Reader, w *bufio.Writer, username, password, msg string) error {
-	sess, msg1, err := opaque.AuthInit(username, password)
+// doEnableTOTP enables TOTP for the user, protected by key.
+func doEnableTOTP(r *bufio.Reader, w *bufio.Writer, key []byte) error {
+	if err := util.EncryptAndWrite(w, key, "enable-totp"); err != nil {
+		return err
+	}
+	secret, err := util.ReadAndDecrypt(r, key)
 	if err != nil {
 		return err
 	}
-	data1, err := json.Marshal(msg1)
+	if err := readOk(r, key); err != nil {
+		return err
+	}
+	fmt.Printf("Enabled TOTP with secret %s\n", secret)
+	return nil
+}
+
+// doAddCredential adds a credential to the user, protected by key.
+func doAddCredential(r *bufio.Reader, w *bufio.Writer, key []byte, sess *opaque.AuthClientSession) error {
+	password := newPassword
+	if password == "" {
+		var err error
+		password, err = opaque.NewRecoveryCode()
+		if err != nil {
+			return err
+		}
+	}
+	regSess, msg1, err := opaque.NewCredentialInit(sess, addCredential, password)
+	if err != nil {
+		return err
+	}
+	if err := util.EncryptAndWrite(w, key, "add-credential"); err != nil {
+		return err
+	}
+	if err := util.EncryptAndWriteMsg(w, key, msg1); err != nil {
+		return err
+	}
+	var msg2 opaque.PwRegMsg2
+	if err := util.ReadAndDecryptMsg(r, key, &msg2); err != nil {
+		return err
+	}
+	msg3, err := opaque.PwReg2(regSess, msg2)
 	if err != nil {
 		return err
 	}
-	if err := util.Write(w, data1); err != nil {
+	if err := util.EncryptAndWriteMsg(w, key, msg3); err != nil {
+		return err
+	}
+	if err := readOk(r, key); err != nil {
+		return err
+	}
+	if newPassword == "" {
+		fmt.Printf("Added credential '%s' with recovery code %s\n", addCredential, password)
+	} else {
+		fmt.Printf("Added credential '%s'\n", addCredential)
+	}
+	return nil
+}
+
+// doRevokeCredential revokes a credential of the user, protected by key.
+func doRevokeCredential(r *bufio.Reader, w *bufio.Writer, key []byte) error {
+	if err := util.EncryptAndWrite(w, key, "revoke-credential"); err != nil {
+		return err
+	}
+	if err := util.EncryptAndWrite(w, key, revokeCredential); err != nil {
+		return err
+	}
+	if err := readOk(r, key); err != nil {
 		return err
 	}
+	fmt.Printf("Revoked credential '%s'\n", revokeCredential)
+	return nil
+}
 
-	data2, err := util.Read(r)
+// readOk reads an encrypted "ok" from the server.
+func readOk(r *bufio.Reader, key []byte) error {
+	ok, err := util.ReadAndDecrypt(r, key)
 	if err != nil {
 		return err
 	}
-	var msg2 opaque.AuthMsg2
-	if err := json.Unmarshal(data2, &msg2); err != nil {
+	if ok != "ok" {
+		return fmt.Errorf("Expected ok, got '%s'", ok)
+	}
+	return nil
+}
+
+// doUpgrade creates a new record for the user, protected by key. If
+// newPassword is non-empty the record is created for the new password.
+func doUpgrade(r *bufio.Reader, w *bufio.Writer, key []byte, sess *opaque.AuthClientSession, newPassword string) error {
+	var regSess *opaque.PwRegClientSession
+	var msg1 opaque.PwRegMsg1
+	var err error
+	if newPassword != "" {
+		regSess, msg1, err = opaque.ChangePasswordInit(sess, newPassword, rsaBits)
+	} else {
+		regSess, msg1, err = opaque.UpgradeInit(sess, rsaBits)
+	}
+	if err != nil {
+		return err
+	}
+	if err := util.EncryptAndWrite(w, key, "upgrade"); err != nil {
+		return err
+	}
+	if err := util.EncryptAndWriteMsg(w, key, msg1); err != nil {
+		return err
+	}
+	var msg2 opaque.PwRegMsg2
+	if err := util.ReadAndDecryptMsg(r, key, &msg2); err != nil {
+		return err
+	}
+	msg3, err := opaque.PwReg2WithDevice(regSess, msg2, deviceSecret)
+	if err != nil {
+		return err
+	}
+	if err := util.EncryptAndWriteMsg(w, key, msg3); err != nil {
 		return err
 	}
+	if err := readOk(r, key); err != nil {
+		return err
+	}
+	if newPassword != "" {
+		fmt.Printf("Changed password\n")
+	} else {
+		fmt.Printf("Upgraded record to a %d bit key\n", rsaBits)
+	}
+	return nil
+}
 
-	sharedSecret, msg3, err := opaque.Auth2(sess, msg2)
+// doAddDevice adds a device with id addDevice and prints the secret which must
+// be given to the new device.
+func doAddDevice(r *bufio.Reader, w *bufio.Writer, key []byte, sess *opaque.AuthClientSession) error {
+	secret, err := opaque.NewDeviceSecret()
 	if err != nil {
 		return err
 	}
-	data3, err := json.Marshal(msg3)
+	msg, err := opaque.NewDeviceEnvelope(sess, addDevice, secret)
 	if err != nil {
 		return err
 	}
-	if err := util.Write(w, data3); err != nil {
+	if err := util.EncryptAndWrite(w, key, "add-device"); err != nil {
+		return err
+	}
+	if err := util.EncryptAndWriteMsg(w, key, msg); err != nil {
+		return err
+	}
+	if err := readOk(r, key); err != nil {
+		return err
+	}
+	fmt.Printf("Added device '%s' with device secret %x\n", addDevice, secret)
+	return nil
+}
+
+func doPuzzle(r *bufio.Reader, w *bufio.Writer, msg1 opaque.AuthMsg1) error {
+	var puzzle opaque.Puzzle
+	if err := util.ReadMsg(r, &puzzle); err != nil {
+		return err
+	}
+	sol, err := opaque.SolvePuzzle(puzzle, msg1)
+	if err != nil {
 		return err
 	}
+	return util.WriteMsg(w, sol)
+}
+
+// dialTLS connects to addr with TLS and verifies the server's certificate
+// against the CA certificates in the file at caPath.
+func dialTLS(addr, caPath string) (net.Conn, error) {
+	pemdata, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pemdata) {
+		return nil, fmt.Errorf("%s: no certificates found", caPath)
+	}
+	return tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+}
 
+func doMigrate(r *bufio.Reader, w *bufio.Writer, password string) error {
+	if err := util.Write(w, []byte(password)); err != nil {
+		return err
+	}
 	ok, err := util.Read(r)
 	if err != nil {
 		return err
@@ -150,19 +678,46 @@ func doAuth(r *bufio.Reader, w *bufio.Writer, username, password, msg string) er
 	if string(ok) != "ok" {
 		return fmt.Errorf("Expected ok, got '%s'", string(ok))
 	}
+	return nil
+}
 
-	// FIXME: Use a PRF to have separate keys for client->server and
-	// server->client.
-	key := sharedSecret[:16]
-	plaintext, err := util.ReadAndDecrypt(r, key)
+// loadIdentity reads a private key from the file at path.
+func loadIdentity(path string) (crypto.PrivateKey, error) {
+	pemdata, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Printf("Received '%s'\n", plaintext)
-	toServer := "Hi server!"
-	fmt.Printf("Sending '%s'\n", toServer)
-	if err := util.EncryptAndWrite(w, key, toServer); err != nil {
-		return err
+	key, err := ssh.ParseRawPrivateKey(pemdata)
+	if err != nil {
+		return nil, err
+	}
+	// Ed25519 keys in OpenSSH format are returned as x/crypto keys, which
+	// can't be marshalled by crypto/x509.
+	if k, ok := key.(*xed25519.PrivateKey); ok {
+		return ed25519.PrivateKey(*k), nil
+	}
+	return key, nil
+}
+
+// printEnvelopeData prints the application data stored in the envelope.
+func printEnvelopeData(data *opaque.EnvelopeData) error {
+	if data.Key != nil {
+		signer, ok := data.Key.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("unsupported identity type %T", data.Key)
+		}
+		pub := signer.Public()
+		if k, ok := pub.(ed25519.PublicKey); ok {
+			pub = xed25519.PublicKey(k)
+		}
+		sshPub, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Identity: %s", ssh.MarshalAuthorizedKey(sshPub))
+	}
+	if data.Payload != nil {
+		fmt.Printf("Payload: '%s'\n", data.Payload)
 	}
 	return nil
 }
@@ -0,0 +1,83 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// Signatures and the generated RSA keys are only deterministic with this
+// setting, see opaque.SetRandom.
+//go:debug cryptocustomrand=1
+
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/frekui/opaque"
+	"github.com/frekui/opaque/internal/pkg/drbg"
+)
+
+// A testCase is the input of a test vector. The RSA keys are generated from
+// the seed as well.
+type testCase struct {
+	seed     string
+	username string
+	password string
+	rsaBits  int
+}
+
+var testCases = []testCase{
+	{"opaque test vector 1", "alice", "password", 1024},
+	{"opaque test vector 2", "bob", "correct horse battery staple", 1024},
+	{"opaque test vector 3", "åsa", "lösenord ☃", 1024},
+}
+
+func generate(tc testCase) (*opaque.TestVector, error) {
+	keys := drbg.New([]byte(tc.seed + " RSA keys"))
+	privS, err := rsa.GenerateKey(drbg.IgnoreMaybeReadByte(keys), tc.rsaBits)
+	if err != nil {
+		return nil, err
+	}
+	privU, err := rsa.GenerateKey(drbg.IgnoreMaybeReadByte(keys), tc.rsaBits)
+	if err != nil {
+		return nil, err
+	}
+	return opaque.NewTestVector([]byte(tc.seed), tc.username, tc.password, privS, privU)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s writes known-answer test vectors for password registration and authentication as JSON. They are checked by TestVectors in the opaque package.\nUsage:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	out := flag.String("o", "", "File to write the vectors to, e.g., testdata/vectors.json. Standard output is used if empty.")
+	flag.Parse()
+
+	var vectors []*opaque.TestVector
+	for _, tc := range testCases {
+		tv, err := generate(tc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", tc.seed, err)
+			os.Exit(1)
+		}
+		vectors = append(vectors, tv)
+	}
+	data, err := json.MarshalIndent(vectors, "", "\t")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	data = append(data, '\n')
+	if *out == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
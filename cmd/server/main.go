@@ -7,24 +7,79 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
-	"encoding/json"
+	"crypto/tls"
+	"encoding/base32"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/frekui/opaque"
+	"github.com/frekui/opaque/internal/pkg/legacy"
 	"github.com/frekui/opaque/internal/pkg/util"
+	"github.com/frekui/opaque/oprf"
 )
 
 // Server's private RSA key.
 var privS *rsa.PrivateKey
 
+// Server's key for decrypting encrypted usernames.
+var usernameKey *opaque.UsernameKey
+
+// Client puzzles and admission control for expensive handshake steps.
+var puzzles *opaque.PuzzleIssuer
+var admission *opaque.Admission
+
+// Precomputed ephemeral D-H key pairs for Auth1. If keyPool is nil, Auth1
+// generates them itself.
+var keyPool *opaque.KeyPool
+
+// Decoy passwords for which honey envelopes are added to new records, and the
+// checker which knows the real envelopes.
+var honeyPasswords []string
+var honey *opaque.HoneyChecker
+
+// Users are locked for lockout after maxFailed failed logins in a row. New
+// passwords expire after passwordLifetime. Zero values disable the policies.
+var maxFailed int
+var lockout time.Duration
+var passwordLifetime time.Duration
+
+// Key for issuing anonymous tokens, the number of tokens issued to each user
+// in the last day and the store of redeemed tokens.
+var tokenKey *oprf.Key
+var tokenQuota = opaque.NewTokenQuota(24 * time.Hour)
+var tokenStore *opaque.TokenStore
+
+// Records with an RSA key smaller than this are upgraded when the user logs in.
+var minRSABits int
+
+// Protects users and legacyUsers.
+var mu sync.Mutex
+
 // Map usernames to users.
 var users = map[string]*opaque.User{}
 
+// Map usernames to password hashes from a legacy password database. A user is
+// moved from legacyUsers to users the first time the user logs in.
+var legacyUsers = map[string]string{}
+
+// Counts the users that have been migrated from legacyUsers to users.
+var migrator opaque.Migrator
+
+// One-time registration codes. If regCodes is nil, registration doesn't require
+// a code.
+var regCodes *opaque.RegCodeStore
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "%s is a simple example server of the opaque package. It can be used together with cmd/client.\nUsage:\n", os.Args[0])
@@ -32,39 +87,153 @@ func main() {
 	}
 
 	addr := flag.String("l", ":9999", "Address to listen on.")
+	tlsAddr := flag.String("tls-l", ":9998", "Address to listen on for TLS connections (only used with -tls-cert).")
+	tlsCert := flag.String("tls-cert", "", "File with the server's TLS certificate (PEM). If given, the server also accepts TLS connections, which are required to migrate legacy users.")
+	tlsKey := flag.String("tls-key", "", "File with the private key of the TLS certificate (PEM).")
+	numRegCodes := flag.Int("regcodes", 0, "Number of one-time registration codes to issue. If non-zero, password registration requires a code.")
+	regCodeTTL := flag.Duration("regcode-ttl", 24*time.Hour, "Validity of issued registration codes.")
+	legacyFile := flag.String("legacy", "", "File with legacy password hashes to migrate, one 'username:hash' per line.")
+	workers := flag.Int("workers", runtime.NumCPU(), "Maximum number of expensive handshake steps that run concurrently.")
+	maxPending := flag.Int("max-pending", 64, "Maximum number of handshake steps that are running or waiting for a worker.")
+	difficulty := flag.Int("puzzle-difficulty", 16, "Difficulty of client puzzles when all workers are busy.")
+	flag.IntVar(&minRSABits, "min-rsa-bits", 2048, "Ask clients to upgrade records with smaller RSA keys than this.")
+	honeyList := flag.String("honey-passwords", "", "Comma-separated decoy passwords. Honey envelopes for them are added to new records and their use raises an alarm.")
+	flag.IntVar(&maxFailed, "max-failed", 0, "Lock users after this many failed logins in a row (0 disables locking).")
+	flag.DurationVar(&lockout, "lockout", 15*time.Minute, "How long users are locked after too many failed logins.")
+	flag.DurationVar(&passwordLifetime, "password-lifetime", 0, "Lifetime of new passwords (0 means that passwords don't expire).")
+	keyPoolSize := flag.Int("key-pool", 0, "Number of ephemeral D-H key pairs to precompute for logins (0 disables the pool).")
+	keyPoolRate := flag.Float64("key-pool-rate", 0, "Maximum number of key pairs generated per second when refilling the key pool (0 means no limit).")
 	flag.Parse()
 
 	var err error
-	privS, err = rsa.GenerateKey(rand.Reader, 512)
+	privS, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	usernameKey, err = opaque.GenerateUsernameKey()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Username key: %x\n", usernameKey.Pub)
+	tokenKey, err = oprf.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	tokenStore = opaque.NewTokenStore(tokenKey)
+	fmt.Printf("Token issuer key: %x\n", tokenKey.V)
+	puzzles, err = opaque.NewPuzzleIssuer(time.Minute)
 	if err != nil {
 		panic(err)
 	}
+	admission = opaque.NewAdmission(*workers, *maxPending, *difficulty)
+	if *keyPoolSize > 0 {
+		keyPool = opaque.NewKeyPool(*keyPoolSize, *keyPoolRate)
+	}
+	if *honeyList != "" {
+		// Records with honey envelopes can't be upgraded, so their
+		// passwords can't be changed either.
+		if passwordLifetime > 0 {
+			fmt.Fprintf(os.Stderr, "Honey passwords can't be combined with a password lifetime\n")
+			os.Exit(2)
+		}
+		honeyPasswords = strings.Split(*honeyList, ",")
+	}
+	// The checker's key is only kept in memory, apart from the records.
+	honey, err = opaque.NewHoneyChecker(nil, func(username string) {
+		fmt.Printf("ALARM: Honey envelope used for user '%s'. The user database may have leaked.\n", username)
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if *legacyFile != "" {
+		if err := loadLegacyUsers(*legacyFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Loaded %d legacy users\n", len(legacyUsers))
+	}
+
+	if *numRegCodes > 0 {
+		regCodes = opaque.NewRegCodeStore()
+		for i := 0; i < *numRegCodes; i++ {
+			code, err := regCodes.Issue(*regCodeTTL)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("Registration code: %s\n", code)
+		}
+	}
+
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		ln, err := tls.Listen("tcp", *tlsAddr, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		go serve(ln, true)
+	} else if len(legacyUsers) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: legacy users can only be migrated over TLS, see -tls-cert.\n")
+	}
 
 	ln, err := net.Listen("tcp", *addr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
+	serve(ln, false)
+}
 
+// serve accepts connections on ln. secure is true if ln authenticates the
+// server and encrypts the connections, i.e., for TLS.
+func serve(ln net.Listener, secure bool) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			continue
 		}
-		go handleConn(conn)
+		go handleConn(conn, secure)
 	}
 }
 
-func handleConn(conn net.Conn) {
+// loadLegacyUsers reads password hashes from a legacy password database into
+// legacyUsers.
+func loadLegacyUsers(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for idx, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: expected 'username:hash'", path, idx+1)
+		}
+		legacyUsers[line[:i]] = line[i+1:]
+	}
+	return nil
+}
+
+func handleConn(conn net.Conn, secure bool) {
 	defer conn.Close()
 	fmt.Printf("Got connection from %s\n", conn.RemoteAddr())
-	if err := doHandleConn(conn); err != nil {
+	if err := doHandleConn(conn, secure); err != nil {
 		fmt.Printf("doHandleConn: %s\n", err)
 	}
 }
 
-func doHandleConn(conn net.Conn) error {
+func doHandleConn(conn net.Conn, secure bool) error {
 	r := bufio.NewReader(conn)
 	cmd, err := util.Read(r)
 	if err != nil {
@@ -73,112 +242,471 @@ func doHandleConn(conn net.Conn) error {
 	w := bufio.NewWriter(conn)
 	switch string(cmd) {
 	case "pwreg":
-		if err := handlePwReg(r, w); err != nil {
-			return fmt.Errorf("pwreg: %s", err)
-		}
+		err = handlePwReg(r, w)
 	case "auth":
-		if err := handleAuth(r, w); err != nil {
-			return fmt.Errorf("auth: %s", err)
-		}
+		err = handleAuth(r, w, false, secure)
+	case "auth-implicit":
+		err = handleAuth(r, w, true, secure)
+	case "redeem":
+		err = handleRedeem(r, w)
 	default:
-		return fmt.Errorf("Unknown command '%s'\n", string(cmd))
+		err = fmt.Errorf("Unknown command '%s': %w", string(cmd), opaque.ErrUnexpectedMessage)
+	}
+	if err != nil {
+		// Tell the client that the protocol run has been aborted. The
+		// alert doesn't reveal the details of err to the client.
+		util.WriteAlert(w, err)
+		return fmt.Errorf("%s: %s", string(cmd), err)
 	}
 
 	return nil
 }
 
-func handleAuth(r *bufio.Reader, w *bufio.Writer) error {
-	data1, err := util.Read(r)
-	if err != nil {
-		return err
-	}
+// handleAuth runs the authentication protocol. If implicit is true the
+// two-message mode is used and the client is authenticated by its first
+// record. Legacy users are only migrated if secure is true, see
+// handleMigration.
+func handleAuth(r *bufio.Reader, w *bufio.Writer, implicit, secure bool) error {
 	var msg1 opaque.AuthMsg1
-	if err := json.Unmarshal(data1, &msg1); err != nil {
+	if err := util.ReadMsg(r, &msg1); err != nil {
 		return err
 	}
+	if d := admission.PuzzleDifficulty(); d > 0 {
+		if err := requirePuzzle(r, w, d, msg1); err != nil {
+			return err
+		}
+	}
+	if len(msg1.EncUsername) > 0 {
+		// Usernames which can't be decrypted are treated as unknown
+		// users.
+		if err := opaque.DecryptUsername(usernameKey, &msg1); err != nil {
+			return fmt.Errorf("No such user")
+		}
+	}
+	mu.Lock()
 	user, ok := users[msg1.Username]
+	legacyHash, isLegacy := legacyUsers[msg1.Username]
+	mu.Unlock()
+	if !ok && isLegacy {
+		if err := handleMigration(r, w, msg1.Username, legacyHash, secure); err != nil {
+			return fmt.Errorf("migration: %w", err)
+		}
+		// The client restarts the authentication protocol now that
+		// there is a record for the user.
+		return handleAuth(r, w, implicit, secure)
+	}
 	if !ok {
 		return fmt.Errorf("No such user")
 	}
-	session, msg2, err := opaque.Auth1(privS, user, msg1)
+	var session *opaque.AuthServerSession
+	var msg2 opaque.AuthMsg2
+	var sharedSecret []byte
+	err := admission.Do(func() error {
+		var err error
+		if implicit {
+			session, msg2, sharedSecret, err = opaque.Auth1ImplicitWithKeyPool(privS, keyPool, user, msg1)
+			return err
+		}
+		// The key size of records with honey envelopes isn't known.
+		outdated := user.PubU != nil && user.PubU.N.BitLen() < minRSABits
+		session, msg2, err = opaque.Auth1WithKeyPool(privS, keyPool, user, msg1, outdated)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	data2, err := json.Marshal(msg2)
-	if err != nil {
+	if err := util.WriteMsg(w, msg2); err != nil {
 		return err
 	}
-	if err := util.Write(w, data2); err != nil {
-		return err
+
+	if !implicit {
+		var msg3 opaque.AuthMsg3
+		if err := util.ReadMsg(r, &msg3); err != nil {
+			return err
+		}
+		err = admission.Do(func() error {
+			var err error
+			sharedSecret, err = opaque.Auth3WithHoney(session, msg3, honey)
+			// Auth3WithHoney records the time step of the TOTP
+			// code and counts wrong codes.
+			saveUser(session)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := util.Write(w, []byte("ok")); err != nil {
+			return err
+		}
 	}
 
-	data3, err := util.Read(r)
+	key := sharedSecret[:16]
+	toClient := "Hi client!"
+	fmt.Printf("Sending '%s'\n", toClient)
+	if err := util.EncryptAndWrite(w, key, toClient); err != nil {
+		return err
+	}
+	plaintext, err := util.ReadAndDecrypt(r, key)
 	if err != nil {
 		return err
 	}
-	var msg3 opaque.AuthMsg3
-	if err := json.Unmarshal(data3, &msg3); err != nil {
+	if implicit {
+		mac, err := util.Read(r)
+		if err != nil {
+			return err
+		}
+		err = session.Confirm(mac)
+		saveUser(session)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Confirmed client '%s'\n", msg1.Username)
+	}
+	fmt.Printf("Received '%s'\n", plaintext)
+	return handleRequests(r, w, key, session)
+}
+
+// handleRequests handles requests sent by the client after a successful run of
+// the authentication protocol. The requests are encrypted with key. It returns
+// when the client closes the connection.
+func handleRequests(r *bufio.Reader, w *bufio.Writer, key []byte, session *opaque.AuthServerSession) error {
+	for {
+		req, err := util.ReadAndDecrypt(r, key)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// A user whose password must be changed may only change it.
+		if session.PasswordChangeRequired() && req != "upgrade" {
+			return fmt.Errorf("Request '%s' before password change: %w", req, opaque.ErrUnexpectedMessage)
+		}
+		switch req {
+		case "add-device":
+			var msg opaque.AddDeviceMsg
+			if err := util.ReadAndDecryptMsg(r, key, &msg); err != nil {
+				return err
+			}
+			if err := opaque.AddDevice(session, msg); err != nil {
+				return err
+			}
+			saveUser(session)
+			fmt.Printf("Added device '%s'\n", msg.DeviceID)
+		case "upgrade":
+			if err := handleUpgrade(r, w, key, session); err != nil {
+				return fmt.Errorf("upgrade: %w", err)
+			}
+		case "add-credential":
+			if err := handleAddCredential(r, w, key, session); err != nil {
+				return fmt.Errorf("add-credential: %w", err)
+			}
+		case "enable-totp":
+			secret, err := opaque.EnableTOTP(session)
+			if err != nil {
+				return err
+			}
+			saveUser(session)
+			if err := util.EncryptAndWrite(w, key, base32.StdEncoding.EncodeToString(secret)); err != nil {
+				return err
+			}
+			fmt.Printf("Enabled TOTP\n")
+		case "revoke-credential":
+			id, err := util.ReadAndDecrypt(r, key)
+			if err != nil {
+				return err
+			}
+			if err := opaque.RevokeCredential(session, id); err != nil {
+				return err
+			}
+			saveUser(session)
+			fmt.Printf("Revoked credential '%s'\n", id)
+		case "tokens":
+			var req opaque.TokenRequest
+			if err := util.ReadAndDecryptMsg(r, key, &req); err != nil {
+				return err
+			}
+			resp, err := opaque.IssueTokens(tokenKey, tokenQuota, session, req)
+			if err != nil {
+				return err
+			}
+			if err := util.EncryptAndWriteMsg(w, key, resp); err != nil {
+				return err
+			}
+			fmt.Printf("Issued %d tokens\n", len(req.Blinded))
+		default:
+			return fmt.Errorf("Unknown request '%s': %w", req, opaque.ErrUnexpectedMessage)
+		}
+		if err := util.EncryptAndWrite(w, key, "ok"); err != nil {
+			return err
+		}
+	}
+}
+
+// saveUser stores the changes made to the user of session and locks the user
+// after too many failed logins.
+func saveUser(session *opaque.AuthServerSession) {
+	mu.Lock()
+	defer mu.Unlock()
+	user, ok := users[session.Username()]
+	if !ok {
+		return
+	}
+	user = session.UpdateUser(user)
+	if maxFailed > 0 && user.FailedAttempts >= maxFailed {
+		fmt.Printf("Locking user '%s' after %d failed logins\n", user.Username, user.FailedAttempts)
+		user.LockedUntil = time.Now().Add(lockout)
+		user.FailedAttempts = 0
+	}
+	users[user.Username] = user
+}
+
+// handleUpgrade runs the password registration protocol, protected by key, and
+// replaces the user's record with the new one.
+func handleUpgrade(r *bufio.Reader, w *bufio.Writer, key []byte, session *opaque.AuthServerSession) error {
+	var msg1 opaque.PwRegMsg1
+	if err := util.ReadAndDecryptMsg(r, key, &msg1); err != nil {
 		return err
 	}
-	sharedSecret, err := opaque.Auth3(session, msg3)
+	regSession, msg2, err := opaque.Upgrade1(privS, session, msg1)
 	if err != nil {
 		return err
 	}
-
-	if err := util.Write(w, []byte("ok")); err != nil {
+	if err := util.EncryptAndWriteMsg(w, key, msg2); err != nil {
+		return err
+	}
+	var msg3 opaque.PwRegMsg3
+	if err := util.ReadAndDecryptMsg(r, key, &msg3); err != nil {
+		return err
+	}
+	user := opaque.Upgrade3(session, regSession, msg3)
+	bits := user.PubU.N.BitLen()
+	if session.PasswordChangeRequired() {
+		setPasswordExpiry(user)
+	}
+	if err := addHoney(user); err != nil {
 		return err
 	}
+	mu.Lock()
+	// Devices and credentials added since Upgrade1 would be lost.
+	if !opaque.CanUpgrade(users[user.Username]) {
+		mu.Unlock()
+		return opaque.ErrUpgradeNotPossible
+	}
+	users[user.Username] = user
+	mu.Unlock()
+	if session.PasswordChangeRequired() {
+		fmt.Printf("Changed password for user '%s'\n", user.Username)
+	} else {
+		fmt.Printf("Upgraded user '%s' to a %d bit key\n", user.Username, bits)
+	}
+	return nil
+}
 
-	key := sharedSecret[:16]
-	toClient := "Hi client!"
-	fmt.Printf("Sending '%s'\n", toClient)
-	if err := util.EncryptAndWrite(w, key, toClient); err != nil {
+// handleAddCredential runs the password registration protocol, protected by
+// key, and adds the new credential to the user of session.
+func handleAddCredential(r *bufio.Reader, w *bufio.Writer, key []byte, session *opaque.AuthServerSession) error {
+	var msg1 opaque.PwRegMsg1
+	if err := util.ReadAndDecryptMsg(r, key, &msg1); err != nil {
 		return err
 	}
-	plaintext, err := util.ReadAndDecrypt(r, key)
+	regSession, msg2, err := opaque.AddCredential1(privS, session, msg1)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Received '%s'\n", plaintext)
+	if err := util.EncryptAndWriteMsg(w, key, msg2); err != nil {
+		return err
+	}
+	var msg3 opaque.PwRegMsg3
+	if err := util.ReadAndDecryptMsg(r, key, &msg3); err != nil {
+		return err
+	}
+	if err := opaque.AddCredential3(session, regSession, msg3); err != nil {
+		return err
+	}
+	saveUser(session)
+	fmt.Printf("Added credential '%s'\n", msg1.CredentialID)
 	return nil
 }
 
-func handlePwReg(r *bufio.Reader, w *bufio.Writer) error {
-	data1, err := util.Read(r)
-	if err != nil {
+// handleRedeem redeems an anonymous token. The connection isn't
+// authenticated, so the server doesn't learn who spends the token.
+func handleRedeem(r *bufio.Reader, w *bufio.Writer) error {
+	var token opaque.Token
+	if err := util.ReadMsg(r, &token); err != nil {
 		return err
 	}
-	var msg1 opaque.PwRegMsg1
-	if err := json.Unmarshal(data1, &msg1); err != nil {
+	if err := tokenStore.Redeem(token); err != nil {
 		return err
 	}
-	session, msg2, err := opaque.PwReg1(privS, msg1)
+	fmt.Printf("Redeemed a token (%d redeemed in total)\n", tokenStore.Len())
+	return util.Write(w, []byte("ok"))
+}
+
+// requirePuzzle sends a puzzle with the given difficulty to the client and
+// verifies the solution, which must be bound to msg1.
+func requirePuzzle(r *bufio.Reader, w *bufio.Writer, difficulty int, msg1 opaque.AuthMsg1) error {
+	puzzle, err := puzzles.Issue(difficulty)
 	if err != nil {
 		return err
 	}
+	if err := util.Write(w, []byte("puzzle")); err != nil {
+		return err
+	}
+	if err := util.WriteMsg(w, puzzle); err != nil {
+		return err
+	}
+	var sol opaque.PuzzleSolution
+	if err := util.ReadMsg(r, &sol); err != nil {
+		return err
+	}
+	// Only accept a solution of the puzzle sent on this connection.
+	if !bytes.Equal(sol.Puzzle.Nonce, puzzle.Nonce) {
+		return opaque.ErrPuzzle
+	}
+	return puzzles.Verify(sol, msg1)
+}
 
-	data2, err := json.Marshal(msg2)
+// handleMigration verifies the user's password against the legacy password hash
+// and replaces the legacy record with an opaque.User.
+//
+// The password is sent from the client to the server, so it's only read if
+// secure is true, i.e., over TLS. On other connections the client is told that
+// the user must be migrated, and the protocol run ends there.
+func handleMigration(r *bufio.Reader, w *bufio.Writer, username, legacyHash string, secure bool) error {
+	if err := util.Write(w, []byte("migrate")); err != nil {
+		return err
+	}
+	if !secure {
+		return fmt.Errorf("User '%s' must connect over TLS to be migrated", username)
+	}
+	password, err := util.Read(r)
 	if err != nil {
 		return err
 	}
-	if err := util.Write(w, data2); err != nil {
+	if err := legacy.Verify(legacyHash, string(password)); err != nil {
 		return err
 	}
+	var remaining int
+	err = admission.Do(func() error {
+		_, err := migrator.Migrate(privS, username, string(password), 2048, func(user *opaque.User) error {
+			setPasswordExpiry(user)
+			if err := addHoney(user); err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if legacyUsers[username] != legacyHash {
+				return fmt.Errorf("Legacy record for '%s' changed during migration", username)
+			}
+			if _, ok := users[username]; ok {
+				return fmt.Errorf("User '%s' registered during migration", username)
+			}
+			users[username] = user
+			delete(legacyUsers, username)
+			remaining = len(legacyUsers)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated user '%s' (%d users migrated, %d remaining)\n", username, migrator.Migrated(), remaining)
+	return util.Write(w, []byte("ok"))
+}
+
+// setPasswordExpiry sets the expiry of user's password according to
+// passwordLifetime.
+func setPasswordExpiry(user *opaque.User) {
+	if passwordLifetime > 0 {
+		user.PasswordExpires = user.PasswordChanged.Add(passwordLifetime)
+	}
+}
+
+// addHoney adds honey envelopes for honeyPasswords to user.
+func addHoney(user *opaque.User) error {
+	if len(honeyPasswords) == 0 {
+		return nil
+	}
+	return opaque.AddHoneyEnvelopes(privS, honey, user, honeyPasswords)
+}
 
-	data3, err := util.Read(r)
+func handlePwReg(r *bufio.Reader, w *bufio.Writer) error {
+	var msg1 opaque.PwRegMsg1
+	if err := util.ReadMsg(r, &msg1); err != nil {
+		return err
+	}
+	if len(msg1.EncUsername) > 0 {
+		if err := opaque.DecryptPwRegUsername(usernameKey, &msg1); err != nil {
+			return err
+		}
+	}
+	// Registration isn't authenticated, so it must not replace an existing
+	// user. The check is repeated when the user is stored, and done here
+	// as well so that a registration code isn't used up in vain.
+	if userExists(msg1.Username) {
+		return fmt.Errorf("User '%s' already exists", msg1.Username)
+	}
+	var session *opaque.PwRegServerSession
+	var msg2 opaque.PwRegMsg2
+	var err error
+	if regCodes != nil {
+		session, msg2, err = opaque.PwReg1WithCode(privS, regCodes, msg1)
+	} else {
+		session, msg2, err = opaque.PwReg1(privS, msg1)
+	}
 	if err != nil {
 		return err
 	}
+
+	if err := util.WriteMsg(w, msg2); err != nil {
+		return err
+	}
+
 	var msg3 opaque.PwRegMsg3
-	if err := json.Unmarshal(data3, &msg3); err != nil {
+	if err := util.ReadMsg(r, &msg3); err != nil {
+		return err
+	}
+	var user *opaque.User
+	if regCodes != nil {
+		user, err = opaque.PwReg3WithCode(session, msg3)
+		if err != nil {
+			return err
+		}
+	} else {
+		user = opaque.PwReg3(session, msg3)
+	}
+	setPasswordExpiry(user)
+	if err := addHoney(user); err != nil {
 		return err
 	}
-	user := opaque.PwReg3(session, msg3)
+	mu.Lock()
+	_, exists := users[user.Username]
+	_, legacy := legacyUsers[user.Username]
+	if !exists && !legacy {
+		users[user.Username] = user
+	}
+	mu.Unlock()
+	if exists || legacy {
+		return fmt.Errorf("User '%s' already exists", user.Username)
+	}
 	if err := util.Write(w, []byte("ok")); err != nil {
 		return err
 	}
 	fmt.Printf("Added user '%s'\n", user.Username)
-	users[user.Username] = user
 	return nil
 }
+
+// userExists returns true if there is a user or a legacy user with the given
+// name.
+func userExists(username string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, exists := users[username]
+	_, legacy := legacyUsers[username]
+	return exists || legacy
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains an implementation of CPace, a balanced PAKE, described in
+// https://tools.ietf.org/html/draft-irtf-cfrg-cpace. In contrast to OPAQUE
+// neither party holds a registration record, both parties know the same
+// password (e.g., a short code shown on one device and typed into another).
+//
+// CPace runs in the same D-H group as OPAQUE. The generator is derived from the
+// password and the session id by hashing to the group with H' (the same hash
+// function as in DH-OPRF) and squaring the result, so that it lies in the
+// subgroup of order (p-1)/2.
+//
+// The protocol is run with CPaceInit, CPace1, CPace2, and CPace3, in the same
+// way as the authentication protocol. The messages include explicit key
+// confirmation.
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/frekui/opaque/internal/pkg/dh"
+	"golang.org/x/crypto/hkdf"
+)
+
+// CPaceSession keeps track of state needed by either party during a run of
+// CPace.
+type CPaceSession struct {
+	// Group with the password-derived generator.
+	group dh.Group
+
+	sid []byte
+
+	// Ephemeral private key and public key for this session.
+	y   *big.Int
+	pub *big.Int
+
+	// Public key of the initiator. Only set on the responder.
+	pubInitiator *big.Int
+
+	secret         []byte
+	macKeyResponse []byte
+	macKeyInit     []byte
+}
+
+// CPaceMsg1 is the first message in CPace. It is sent from the initiator to
+// the responder.
+//
+// Users of package opaque does not need to read nor write to any fields in this
+// struct except to serialize and deserialize the struct when it's sent between
+// the peers.
+type CPaceMsg1 struct {
+	// Session id, chosen by the initiator.
+	Sid []byte
+
+	// Ya = g'^ya, where g' is the password-derived generator.
+	Ya *big.Int
+}
+
+// CPaceMsg2 is the second message in CPace. It is sent from the responder to
+// the initiator.
+type CPaceMsg2 struct {
+	// Yb = g'^yb
+	Yb *big.Int
+
+	// Mac(Kb; Ya, Yb)
+	Mac []byte
+}
+
+// CPaceMsg3 is the third and final message in CPace. It is sent from the
+// initiator to the responder.
+type CPaceMsg3 struct {
+	// Mac(Ka; Yb, Ya)
+	Mac []byte
+}
+
+// CPaceInit initiates CPace. It's run by the initiator. password is the secret
+// shared by the two parties and ci is channel identifier (e.g., the names of
+// the two parties), which must be the same on both sides. ci may be nil.
+//
+// On success a nil error is returned together with a session and a CPaceMsg1
+// struct, which should be sent to the responder.
+//
+// See also CPace1, CPace2, and CPace3.
+func CPaceInit(password string, ci []byte) (*CPaceSession, CPaceMsg1, error) {
+	sid := make([]byte, 16)
+	if _, err := io.ReadFull(randr, sid); err != nil {
+		return nil, CPaceMsg1{}, err
+	}
+	sess, err := newCPaceSession(password, ci, sid)
+	if err != nil {
+		return nil, CPaceMsg1{}, err
+	}
+	return sess, CPaceMsg1{Sid: sid, Ya: sess.pub}, nil
+}
+
+// CPace1 is run by the responder when it receives a CPaceMsg1 struct. password
+// and ci must be the same as the initiator passed to CPaceInit. On success a
+// nil error is returned together with a session and a CPaceMsg2 struct, which
+// should be sent to the initiator.
+//
+// See also CPaceInit, CPace2, and CPace3.
+func CPace1(password string, ci []byte, msg1 CPaceMsg1) (*CPaceSession, CPaceMsg2, error) {
+	if len(msg1.Sid) < 16 {
+		return nil, CPaceMsg2{}, errors.New("sid too short")
+	}
+	sess, err := newCPaceSession(password, ci, msg1.Sid)
+	if err != nil {
+		return nil, CPaceMsg2{}, err
+	}
+	if err := sess.deriveKeys(msg1.Ya, sess.pub, msg1.Ya); err != nil {
+		return nil, CPaceMsg2{}, err
+	}
+	sess.pubInitiator = msg1.Ya
+	mac := cpaceMac(sess.macKeyResponse, sess.group, msg1.Ya, sess.pub)
+	return sess, CPaceMsg2{Yb: sess.pub, Mac: mac}, nil
+}
+
+// CPace2 is run by the initiator when it receives a CPaceMsg2 struct. On
+// success a nil error is returned together with a secret and a CPaceMsg3
+// struct. The CPaceMsg3 struct should be sent to the responder. On successful
+// completion of the protocol the secret is shared between the initiator and
+// the responder. CPace2 is the final round for the initiator.
+//
+// If CPace2 returns a nil error the responder has proved that it knows the
+// password.
+//
+// See also CPaceInit, CPace1, and CPace3.
+func CPace2(sess *CPaceSession, msg2 CPaceMsg2) (secret []byte, msg3 CPaceMsg3, err error) {
+	if err := sess.deriveKeys(sess.pub, msg2.Yb, msg2.Yb); err != nil {
+		return nil, CPaceMsg3{}, err
+	}
+	if !hmac.Equal(cpaceMac(sess.macKeyResponse, sess.group, sess.pub, msg2.Yb), msg2.Mac) {
+		return nil, CPaceMsg3{}, errors.New("MAC mismatch")
+	}
+	mac := cpaceMac(sess.macKeyInit, sess.group, msg2.Yb, sess.pub)
+	return sess.secret, CPaceMsg3{Mac: mac}, nil
+}
+
+// CPace3 is run by the responder when it receives a CPaceMsg3 struct. On
+// success a nil error is returned together with a secret, which is equal to
+// the secret returned by CPace2 on the initiator.
+//
+// If CPace3 returns a nil error the initiator has proved that it knows the
+// password.
+//
+// See also CPaceInit, CPace1, and CPace2.
+func CPace3(sess *CPaceSession, msg3 CPaceMsg3) (secret []byte, err error) {
+	if !hmac.Equal(cpaceMac(sess.macKeyInit, sess.group, sess.pub, sess.pubInitiator), msg3.Mac) {
+		return nil, errors.New("MAC mismatch")
+	}
+	return sess.secret, nil
+}
+
+// newCPaceSession computes the generator and an ephemeral key pair.
+func newCPaceSession(password string, ci, sid []byte) (*CPaceSession, error) {
+	group := dh.Group{G: cpaceGenerator(password, ci, sid), P: dhGroup.P}
+	y, err := group.GeneratePrivateKey(randr)
+	if err != nil {
+		return nil, err
+	}
+	return &CPaceSession{
+		group: group,
+		sid:   sid,
+		y:     y,
+		pub:   group.GeneratePublicKey(y),
+	}, nil
+}
+
+// cpaceGenerator computes g' = H'(password, ci, sid)^2.
+func cpaceGenerator(password string, ci, sid []byte) *big.Int {
+	var data []byte
+	for _, p := range [][]byte{[]byte("CPace"), []byte(password), ci, sid} {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(p)))
+		data = append(data, l[:]...)
+		data = append(data, p...)
+	}
+	for {
+		g := dhGroup.HashToGroup(data, []byte("HashToGroup-CPace-MODP"))
+		// g' is 1 with negligible probability. In that case a zero
+		// byte is appended to data and we try again.
+		if !dhGroup.IsInSmallSubgroup(g) {
+			return g
+		}
+		data = append(data, 0)
+	}
+}
+
+// deriveKeys derives the shared secret and the two MAC keys from the D-H
+// shared secret and the transcript. peer is the public key received from the
+// other party, i.e., either ya or yb.
+func (sess *CPaceSession) deriveKeys(ya, yb, peer *big.Int) error {
+	// From the I-D: all received values are checked to be non-unit
+	// elements of the group.
+	if peer == nil || !sess.group.IsInGroup(peer) {
+		return errors.New("Y is not in D-H group")
+	}
+	if sess.group.IsInSmallSubgroup(peer) {
+		return errors.New("Y is in a small subgroup")
+	}
+	if !sess.group.IsInSubgroup(peer) {
+		return errors.New("Y is not in the prime-order subgroup")
+	}
+	info := append([]byte(nil), sess.sid...)
+	info = append(info, sess.group.Bytes(ya)...)
+	info = append(info, sess.group.Bytes(yb)...)
+	kdf := hkdf.New(hasher, sess.group.SharedSecret(sess.y, peer), nil, info)
+	sess.secret = make([]byte, 16)
+	sess.macKeyResponse = make([]byte, 16)
+	sess.macKeyInit = make([]byte, 16)
+	for _, k := range [][]byte{sess.secret, sess.macKeyResponse, sess.macKeyInit} {
+		if _, err := io.ReadFull(kdf, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cpaceMac(key []byte, group dh.Group, y1, y2 *big.Int) []byte {
+	mac := hmac.New(hasher, key)
+	mac.Write(group.Bytes(y1))
+	mac.Write(group.Bytes(y2))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+// cpace runs CPace between an initiator and a responder.
+func cpace(pwInit, pwResp string, ciInit, ciResp []byte, msg1Mod func(*CPaceMsg1), msg2Mod func(*CPaceMsg2), msg3Mod func(*CPaceMsg3)) error {
+	iSess, msg1, err := CPaceInit(pwInit, ciInit)
+	if err != nil {
+		return err
+	}
+	if msg1Mod != nil {
+		msg1Mod(&msg1)
+	}
+	rSess, msg2, err := CPace1(pwResp, ciResp, msg1)
+	if err != nil {
+		return fmt.Errorf("responder: %s", err)
+	}
+	if msg2Mod != nil {
+		msg2Mod(&msg2)
+	}
+	iSecret, msg3, err := CPace2(iSess, msg2)
+	if err != nil {
+		return fmt.Errorf("initiator: %s", err)
+	}
+	if msg3Mod != nil {
+		msg3Mod(&msg3)
+	}
+	rSecret, err := CPace3(rSess, msg3)
+	if err != nil {
+		return fmt.Errorf("responder: %s", err)
+	}
+	if !bytes.Equal(iSecret, rSecret) {
+		return fmt.Errorf("Shared secrets differ")
+	}
+	return nil
+}
+
+func TestCPace(t *testing.T) {
+	ci := []byte("device A, device B")
+	for idx, tst := range []struct {
+		pwResp  string
+		ciResp  []byte
+		msg1Mod func(*CPaceMsg1)
+		msg2Mod func(*CPaceMsg2)
+		msg3Mod func(*CPaceMsg3)
+		err     string
+	}{
+		{"1234", ci, nil, nil, nil, ""},
+		{"1235", ci, nil, nil, nil, "initiator: MAC mismatch"},
+		{"1234", []byte("device A, device C"), nil, nil, nil, "initiator: MAC mismatch"},
+		{"1234", ci, func(msg1 *CPaceMsg1) { msg1.Sid = msg1.Sid[:8] }, nil, nil, "responder: sid too short"},
+		{"1234", ci, func(msg1 *CPaceMsg1) { msg1.Sid[0] ^= 42 }, nil, nil, "initiator: MAC mismatch"},
+		{"1234", ci, func(msg1 *CPaceMsg1) { msg1.Ya = big.NewInt(0) }, nil, nil, "responder: Y is not in D-H group"},
+		{"1234", ci, func(msg1 *CPaceMsg1) { msg1.Ya = big.NewInt(1) }, nil, nil, "responder: Y is in a small subgroup"},
+		{"1234", ci, func(msg1 *CPaceMsg1) { msg1.Ya = big.NewInt(121) }, nil, nil, "initiator: MAC mismatch"},
+		{"1234", ci, func(msg1 *CPaceMsg1) { msg1.Ya = big.NewInt(123) }, nil, nil, "responder: Y is not in the prime-order subgroup"},
+		{"1234", ci, nil, func(msg2 *CPaceMsg2) { msg2.Yb = nil }, nil, "initiator: Y is not in D-H group"},
+		{"1234", ci, nil, func(msg2 *CPaceMsg2) { msg2.Yb = new(big.Int).Sub(dhGroup.P, big.NewInt(1)) }, nil, "initiator: Y is in a small subgroup"},
+		{"1234", ci, nil, func(msg2 *CPaceMsg2) { msg2.Mac[0] ^= 42 }, nil, "initiator: MAC mismatch"},
+		{"1234", ci, nil, nil, func(msg3 *CPaceMsg3) { msg3.Mac[0] ^= 42 }, "responder: MAC mismatch"},
+	} {
+		err := cpace("1234", tst.pwResp, ci, tst.ciResp, tst.msg1Mod, tst.msg2Mod, tst.msg3Mod)
+		if err == nil {
+			if tst.err != "" {
+				t.Fatalf("Test %d: expected error '%s', got nil", idx, tst.err)
+			}
+		} else if err.Error() != tst.err {
+			t.Fatalf("Test %d: expected error '%s', got '%s'", idx, tst.err, err)
+		}
+	}
+}
+
+func TestCPaceGenerator(t *testing.T) {
+	g1 := cpaceGenerator("1234", nil, []byte("sid"))
+	g2 := cpaceGenerator("1234", nil, []byte("sid"))
+	if g1.Cmp(g2) != 0 {
+		t.Fatalf("Generator isn't deterministic")
+	}
+	// The length prefixes make the encoding unambiguous.
+	if g1.Cmp(cpaceGenerator("123", []byte("4"), []byte("sid"))) == 0 {
+		t.Fatalf("Generator collision")
+	}
+	// g' is a square, so it has order (p-1)/2.
+	q := new(big.Int).Rsh(dhGroup.P, 1)
+	if new(big.Int).Exp(g1, q, dhGroup.P).Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("Generator not in subgroup of order q")
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains support for multiple credentials per account. The
+// credential created during password registration is the primary credential
+// (User.K, User.V and User.EnvU). Further credentials, such as per-device
+// passwords or printed recovery codes, are added from an authenticated session:
+//
+//     Client                                 Server
+//     NewCredentialInit        PwRegMsg1 ->  AddCredential1
+//     PwReg2               <-  PwRegMsg2
+//                              PwRegMsg3 ->  AddCredential3
+//
+// Each credential has its own OPRF key and envelope, but all envelopes contain
+// the same keys (PrivU, PubS) and application data. All credentials therefore
+// unlock the same account identity and export key (see ExportKey). A client
+// selects a credential with AuthInitWithCredential.
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base32"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/frekui/opaque/oprf"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Credential is the state that the server stores for an additional credential
+// of a user. Values of this struct are created by AddCredential3.
+type Credential struct {
+	// OPRF key for this credential.
+	K *big.Int
+
+	V *big.Int
+
+	// Envelope, encrypted with the output of the OPRF.
+	EnvU []byte
+}
+
+// credential returns the OPRF key and envelope of the credential with the given
+// id. The empty id selects the primary credential. The key is nil if the user
+// was registered under a master key. The key uses the stored V, so g^k isn't
+// recomputed on each login.
+//
+// For unknown ids a fake key and envelope, which are the same on every call,
+// are returned together with false. The client then fails to open the envelope
+// just as with a wrong password, so Auth1 doesn't reveal which credentials
+// exist.
+func (user *User) credential(privS *rsa.PrivateKey, credentialID string) (*oprf.Key, []byte, bool) {
+	if credentialID == "" {
+		return storedKey(user.K, user.V), user.EnvU, true
+	}
+	cred, ok := user.Credentials[credentialID]
+	if !ok {
+		seed := fakeBytes(privS, 32, "credential key", []byte(user.Username), []byte(credentialID))
+		k := dhGroup.HashToScalar(seed, []byte("opaque fake credential"))
+		env := fakeBytes(privS, len(user.EnvU), "credential envelope", []byte(user.Username), []byte(credentialID))
+		return oprf.NewKey(k), env, false
+	}
+	return storedKey(cred.K, cred.V), cred.EnvU, true
+}
+
+// storedKey returns the OPRF key with secret k and public key v as stored in a
+// record, or nil if k is nil. If v is nil it's computed from k.
+func storedKey(k, v *big.Int) *oprf.Key {
+	if k == nil {
+		return nil
+	}
+	return &oprf.Key{K: k, V: v}
+}
+
+// NewCredentialInit is invoked on the client after Auth2 has returned
+// successfully. It starts a run of the password registration protocol which
+// adds a credential, identified by credentialID, with the given password to the
+// user of sess. The rest of the registration is done with PwReg2 (or
+// PwReg2WithDevice) as usual, and the new envelope contains the same keys and
+// application data as the envelope used in sess.
+//
+// The password can be any secret, e.g., a recovery code from NewRecoveryCode.
+func NewCredentialInit(sess *AuthClientSession, credentialID, password string) (*PwRegClientSession, PwRegMsg1, error) {
+	if sess.env == nil {
+		return nil, PwRegMsg1{}, errors.New("authentication not completed")
+	}
+	if credentialID == "" {
+		return nil, PwRegMsg1{}, errors.New("empty credential id")
+	}
+	regSess, msg1, err := PwRegInit(sess.username, password, sess.env.privU.N.BitLen())
+	if err != nil {
+		return nil, PwRegMsg1{}, err
+	}
+	regSess.privU = sess.env.privU
+	regSess.data = sess.env.data
+	msg1.CredentialID = credentialID
+	return regSess, msg1, nil
+}
+
+// ErrPrimaryCredentialRequired is returned by AddCredential1, AddCredential3
+// and RevokeCredential if the client didn't authenticate with the primary
+// credential. A recovery code, for example, shouldn't be enough to add or
+// revoke other credentials.
+var ErrPrimaryCredentialRequired = errors.New("credentials can only be managed with the primary credential")
+
+// AddCredential1 is like PwReg1 but it is invoked on the server for a
+// PwRegMsg1 created by NewCredentialInit. It verifies that the authentication
+// protocol has completed successfully for sess, using the primary credential,
+// and that msg1 is for the same user.
+func AddCredential1(privS *rsa.PrivateKey, sess *AuthServerSession, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMsg2, error) {
+	if err := checkSessionUser(sess, msg1); err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	if sess.credentialID != "" {
+		return nil, PwRegMsg2{}, ErrPrimaryCredentialRequired
+	}
+	if msg1.CredentialID == "" {
+		return nil, PwRegMsg2{}, errors.New("empty credential id")
+	}
+	regSess, msg2, err := PwReg1(privS, msg1)
+	if err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	regSess.credentialID = msg1.CredentialID
+	return regSess, msg2, nil
+}
+
+// AddCredential3 is invoked on the server when it has received the PwRegMsg3
+// for regSess, which must have been created by AddCredential1. It adds the
+// credential to the user of sess, replacing any credential with the same id.
+// The server needs to store the updated User, see UpdateUser.
+func AddCredential3(sess *AuthServerSession, regSess *PwRegServerSession, msg3 PwRegMsg3) error {
+	if !sess.authenticated {
+		return errors.New("authentication not completed")
+	}
+	if sess.credentialID != "" {
+		return ErrPrimaryCredentialRequired
+	}
+	if regSess.credentialID == "" {
+		return errors.New("empty credential id")
+	}
+	if sess.user.HoneyEnvU != nil {
+		return errors.New("honey envelopes can't be combined with credentials")
+	}
+	// The new envelope must unlock the same account identity.
+	if msg3.PubU == nil || msg3.PubU.E != sess.user.PubU.E || msg3.PubU.N.Cmp(sess.user.PubU.N) != 0 {
+		return errors.New("PubU mismatch")
+	}
+	cred := &Credential{
+		K:    regSess.k,
+		V:    regSess.v,
+		EnvU: msg3.EnvU,
+	}
+	sess.updates = append(sess.updates, func(user *User) {
+		if user.Credentials == nil {
+			user.Credentials = map[string]*Credential{}
+		}
+		user.Credentials[regSess.credentialID] = cred
+	})
+	return nil
+}
+
+// RevokeCredential removes the credential with the given id from the user of
+// sess. RevokeCredential must only be called after Auth3 has returned
+// successfully for sess, using the primary credential. The primary credential
+// can't be revoked. The server needs to store the updated User, see
+// UpdateUser.
+func RevokeCredential(sess *AuthServerSession, credentialID string) error {
+	if !sess.authenticated {
+		return errors.New("authentication not completed")
+	}
+	if sess.credentialID != "" {
+		return ErrPrimaryCredentialRequired
+	}
+	if credentialID == "" {
+		return errors.New("the primary credential can't be revoked")
+	}
+	if _, ok := sess.user.Credentials[credentialID]; !ok {
+		return errors.New("unknown credential")
+	}
+	sess.updates = append(sess.updates, func(user *User) {
+		delete(user.Credentials, credentialID)
+	})
+	return nil
+}
+
+// NewRecoveryCode generates a random recovery code with 100 bits of entropy,
+// formatted as four groups of five characters. A recovery code is meant to be
+// printed and used as the password of a credential added with
+// NewCredentialInit.
+func NewRecoveryCode() (string, error) {
+	buf := make([]byte, 20*5/8)
+	if _, err := io.ReadFull(randr, buf); err != nil {
+		return "", err
+	}
+	s := base32.StdEncoding.EncodeToString(buf)
+	groups := []string{s[0:5], s[5:10], s[10:15], s[15:20]}
+	return strings.Join(groups, "-"), nil
+}
+
+// ExportKey returns a key which only the client can compute. It is derived
+// from the account's private key and is the same for all credentials of the
+// account, so it can be used to encrypt application data stored elsewhere. It
+// returns nil before Auth2 has returned successfully.
+func (sess *AuthClientSession) ExportKey() []byte {
+	if sess.env == nil {
+		return nil
+	}
+	kdf := hkdf.New(hasher, x509.MarshalPKCS1PrivateKey(sess.env.privU), nil, []byte("opaque export key"))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// CredentialID returns the id of the credential used in sess. The empty string
+// is returned for the primary credential.
+func (sess *AuthServerSession) CredentialID() string {
+	return sess.credentialID
+}
+
+// checkSessionUser verifies that the authentication protocol has completed
+// successfully for sess and that msg1 is for the same user.
+func checkSessionUser(sess *AuthServerSession, msg1 PwRegMsg1) error {
+	if !sess.authenticated {
+		return errors.New("authentication not completed")
+	}
+	if msg1.Username != sess.user.Username {
+		return errors.New("username mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+// authenticateCredential runs the authentication protocol with the credential
+// identified by credentialID. On success the client and server sessions are
+// returned.
+func authenticateCredential(privS *rsa.PrivateKey, user *User, credentialID, password string) (*AuthClientSession, *AuthServerSession, error) {
+	cSess, msg1, err := AuthInitWithCredential(user.Username, credentialID, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	sSess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("server: %s", err)
+	}
+	cSecret, msg3, err := Auth2(cSess, msg2)
+	if err != nil {
+		return nil, nil, fmt.Errorf("client: %s", err)
+	}
+	sSecret, err := Auth3(sSess, msg3)
+	if err != nil {
+		return nil, nil, fmt.Errorf("server: %s", err)
+	}
+	if !bytes.Equal(cSecret, sSecret) {
+		return nil, nil, fmt.Errorf("Shared secrets differ")
+	}
+	return cSess, sSess, nil
+}
+
+// addCredential adds a credential to the user of the authenticated sessions.
+func addCredential(privS *rsa.PrivateKey, cSess *AuthClientSession, sSess *AuthServerSession, credentialID, password string) error {
+	regClient, msg1, err := NewCredentialInit(cSess, credentialID, password)
+	if err != nil {
+		return err
+	}
+	regServer, msg2, err := AddCredential1(privS, sSess, msg1)
+	if err != nil {
+		return err
+	}
+	msg3, err := PwReg2(regClient, msg2)
+	if err != nil {
+		return err
+	}
+	return AddCredential3(sSess, regServer, msg3)
+}
+
+func TestCredentials(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cAuth, sAuth, err := authenticateCredential(privS, user, "", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportKey := cAuth.ExportKey()
+
+	code, err := NewRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[A-Z2-7]{5}(-[A-Z2-7]{5}){3}$`).MatchString(code) {
+		t.Fatalf("Unexpected recovery code %q", code)
+	}
+	if err := addCredential(privS, cAuth, sAuth, "laptop", "laptop password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addCredential(privS, cAuth, sAuth, "recovery-1", code); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Credentials) != 0 {
+		t.Fatalf("AddCredential3 modified the user of the session")
+	}
+	user = sAuth.UpdateUser(user)
+	if len(user.Credentials) != 2 {
+		t.Fatalf("Expected 2 credentials, got %d", len(user.Credentials))
+	}
+
+	// All credentials unlock the same identity and export key.
+	for _, c := range []struct{ id, password string }{{"", "password"}, {"laptop", "laptop password"}, {"recovery-1", code}} {
+		cSess, sSess, err := authenticateCredential(privS, user, c.id, c.password)
+		if err != nil {
+			t.Fatalf("Credential %q: %s", c.id, err)
+		}
+		if sSess.CredentialID() != c.id {
+			t.Fatalf("Credential %q: server session has id %q", c.id, sSess.CredentialID())
+		}
+		if !bytes.Equal(cSess.ExportKey(), exportKey) {
+			t.Fatalf("Credential %q: export key differs", c.id)
+		}
+	}
+	if _, _, err := authenticateCredential(privS, user, "laptop", "password"); err == nil || err.Error() != "client: Authtag mismatch" {
+		t.Fatalf("Wrong password for credential: got %v", err)
+	}
+	// An unknown credential fails like a wrong password.
+	if _, _, err := authenticateCredential(privS, user, "phone", "password"); err == nil || err.Error() != "client: Authtag mismatch" {
+		t.Fatalf("Unknown credential: got %v", err)
+	}
+
+	// Other credentials can't manage credentials.
+	cRec, sRec, err := authenticateCredential(privS, user, "recovery-1", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeCredential(sRec, "laptop"); err != ErrPrimaryCredentialRequired {
+		t.Fatalf("Revoking with a recovery code: got %v", err)
+	}
+	if err := addCredential(privS, cRec, sRec, "phone", "phone password"); err != ErrPrimaryCredentialRequired {
+		t.Fatalf("Adding with a recovery code: got %v", err)
+	}
+
+	if err := RevokeCredential(sAuth, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	user = sAuth.UpdateUser(user)
+	if _, _, err := authenticateCredential(privS, user, "laptop", "laptop password"); err == nil || err.Error() != "client: Authtag mismatch" {
+		t.Fatalf("Revoked credential: got %v", err)
+	}
+	if err := RevokeCredential(sAuth, "laptop"); err == nil {
+		t.Fatalf("Revoking a revoked credential succeeded")
+	}
+	if err := RevokeCredential(sAuth, ""); err == nil {
+		t.Fatalf("Revoking the primary credential succeeded")
+	}
+
+	// Upgrades require the primary credential.
+	_, umsg1, err := UpgradeInit(cRec, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Upgrade1(privS, sRec, umsg1); err == nil {
+		t.Fatalf("Upgrade1 succeeded with a recovery code")
+	}
+
+	// Credentials can only be managed from authenticated sessions.
+	cSess, amsg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, _, err := Auth1(privS, user, amsg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewCredentialInit(cSess, "phone", "phone password"); err == nil {
+		t.Fatalf("NewCredentialInit succeeded before authentication")
+	}
+	if err := RevokeCredential(sSess, "recovery-1"); err == nil {
+		t.Fatalf("RevokeCredential succeeded before authentication")
+	}
+	_, cmsg1, err := NewCredentialInit(cAuth, "phone", "phone password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := AddCredential1(privS, sSess, cmsg1); err == nil {
+		t.Fatalf("AddCredential1 succeeded before authentication")
+	}
+}
@@ -8,13 +8,150 @@ package opaque
 import (
 	"crypto"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
 	"hash"
+	"io"
+	"math"
+	"sync"
 
 	"github.com/frekui/opaque/internal/pkg/dh"
+	"github.com/frekui/opaque/internal/pkg/drbg"
+	"github.com/frekui/opaque/oprf"
+	"golang.org/x/crypto/hkdf"
 )
 
-var randr = rand.Reader
+// randr is the source of randomness for everything in the package, including
+// package oprf and the RSA keys of users. It reads from randSrc, see
+// SetRandom.
+var randr io.Reader = sourceReader{}
+
+// randMu guards randSrc and customRandom, which are set by SetRandom.
+// customRandom is true if SetRandom has been called with a non-nil reader.
+var (
+	randMu       sync.RWMutex
+	randSrc      io.Reader = internalReader{rand.Reader}
+	customRandom bool
+)
+
+type sourceReader struct{}
+
+func (sourceReader) Read(p []byte) (int, error) {
+	randMu.RLock()
+	r := randSrc
+	randMu.RUnlock()
+	return r.Read(p)
+}
+
+// isCustomRandom returns customRandom.
+func isCustomRandom() bool {
+	randMu.RLock()
+	defer randMu.RUnlock()
+	return customRandom
+}
+
+// lockedReader serializes the reads from r, which might not be safe for
+// concurrent use.
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (r *lockedReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Read(p)
+}
+
+// internalReader reports the errors of the random source r as ErrInternal, so
+// that the peer is told that the failure has nothing to do with it.
+type internalReader struct {
+	r io.Reader
+}
+
+func (r internalReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil {
+		err = fmt.Errorf("%w: random source: %s", ErrInternal, err)
+	}
+	return n, err
+}
+
+// SetRandom sets the source of randomness used by the package and by package
+// oprf. A nil r restores the default, crypto/rand.Reader.
+//
+// With a deterministic r, such as a DRBG with a fixed seed, whole runs of the
+// password registration and authentication protocols are reproducible, which
+// is useful for known-answer tests and for reproducing failures. It must never
+// be used otherwise.
+//
+// As of Go 1.26 crypto/rsa ignores the reader it's given, and always uses
+// crypto/rand, unless the GODEBUG setting cryptocustomrand=1 is in effect. A
+// program which needs reproducible RSA keys, signatures and encryptions must
+// therefore be run with GODEBUG=cryptocustomrand=1 or have a
+// "//go:debug cryptocustomrand=1" line in its main package (or, for tests, in
+// one of the package's test files). crypto/rsa also reads a single byte, or
+// not, at random from such a reader; the package hides that read from r.
+//
+// SetRandom may be called concurrently with other functions of the package,
+// and reads from r are serialized. The outputs are only reproducible if no
+// other goroutine reads from r at the same time, though.
+func SetRandom(r io.Reader) {
+	var src io.Reader = internalReader{rand.Reader}
+	var oprfSrc io.Reader
+	if r != nil {
+		src = internalReader{&lockedReader{r: r}}
+		oprfSrc = src
+	}
+	randMu.Lock()
+	randSrc = src
+	customRandom = r != nil
+	randMu.Unlock()
+	oprf.SetRandom(oprfSrc)
+}
+
+// rsaRandom returns the reader to pass to a call into crypto/rsa. With a source
+// set by SetRandom, it keeps crypto/rsa's random single-byte read from shifting
+// the output of the source, see drbg.IgnoreMaybeReadByte.
+func rsaRandom() io.Reader {
+	if isCustomRandom() {
+		return drbg.IgnoreMaybeReadByte(randr)
+	}
+	return randr
+}
+
+// randIntn returns an integer read from randr which is uniformly distributed in
+// [0, n). n must be positive. (crypto/rand.Int isn't used since it ignores its
+// reader as of Go 1.26.)
+func randIntn(n int) (int, error) {
+	var buf [8]byte
+	// Reject values in the last, partial, multiple of n.
+	limit := math.MaxUint64 - math.MaxUint64%uint64(n)
+	for {
+		if _, err := io.ReadFull(randr, buf[:]); err != nil {
+			return 0, err
+		}
+		if v := binary.BigEndian.Uint64(buf[:]); v < limit {
+			return int(v % uint64(n)), nil
+		}
+	}
+}
+
+// fakeBytes derives n bytes from privS, label and parts. They stand in for
+// records the server doesn't have: the same request always gets the same
+// response, so it can't be told apart from a request for a real record.
+func fakeBytes(privS *rsa.PrivateKey, n int, label string, parts ...[]byte) []byte {
+	seed := regCodeMac(x509.MarshalPKCS1PrivateKey(privS), "fake "+label, parts...)
+	kdf := hkdf.New(hasher, seed, nil, nil)
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(kdf, buf); err != nil {
+		panic(err)
+	}
+	return buf
+}
 
 // This hash function is used as H from the I-D.
 func hasher() hash.Hash {
@@ -0,0 +1,142 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains support for device-bound envelopes. A device secret (e.g.,
+// a key stored in the OS keyring of a device) is combined with RwdU before the
+// envelope is encrypted, so that the password alone isn't enough to log in from
+// a device which doesn't hold the secret.
+//
+// The envelope created during password registration is the primary envelope
+// (User.EnvU). Further devices are added from an authenticated session with
+// NewDeviceEnvelope and AddDevice, each with its own secret and envelope
+// (User.DeviceEnvU). A device logs in with AuthInitWithDevice and the server
+// only sends the envelope of that device.
+
+import (
+	"crypto/rsa"
+	"errors"
+	"io"
+
+	"github.com/frekui/opaque/internal/pkg/authenc"
+	"golang.org/x/crypto/hkdf"
+)
+
+// AddDeviceMsg is sent from the client to the server to add a device. It must
+// be sent protected by the secret from a successful run of the authentication
+// protocol.
+//
+// Users of package opaque does not need to read nor write to any fields in this
+// struct except to serialize and deserialize the struct when it's sent between
+// the peers.
+type AddDeviceMsg struct {
+	DeviceID string
+	EnvU     []byte
+}
+
+// ErrDevicePrimaryCredential is returned by NewDeviceEnvelope and AddDevice if
+// the session didn't use the primary credential. Device envelopes are opened
+// with the primary credential's OPRF key, so a device added from a session
+// which used another credential could never log in.
+var ErrDevicePrimaryCredential = errors.New("devices can only be added with the primary credential")
+
+// NewDeviceSecret generates a new random device secret.
+func NewDeviceSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(randr, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// NewDeviceEnvelope is invoked on the client after Auth2 has returned
+// successfully. It creates an envelope for a new device, identified by
+// deviceID, which holds deviceSecret. The envelope contains the same keys as the
+// envelope used in sess, so the new device authenticates as the same user. The
+// returned AddDeviceMsg should be sent to the server, which calls AddDevice.
+//
+// The device secret is typically generated with NewDeviceSecret on the device
+// running this function and transferred to the new device over a secure
+// channel (e.g., a QR code or a CPace session).
+//
+// sess must have used the primary credential, otherwise
+// ErrDevicePrimaryCredential is returned.
+func NewDeviceEnvelope(sess *AuthClientSession, deviceID string, deviceSecret []byte) (AddDeviceMsg, error) {
+	if sess.env == nil {
+		return AddDeviceMsg{}, errors.New("authentication not completed")
+	}
+	if sess.credentialID != "" {
+		return AddDeviceMsg{}, ErrDevicePrimaryCredential
+	}
+	if deviceID == "" || len(deviceSecret) == 0 {
+		return AddDeviceMsg{}, errors.New("device id and device secret must be non-empty")
+	}
+	key, err := envelopeKey(sess.rwdU, deviceSecret)
+	if err != nil {
+		return AddDeviceMsg{}, err
+	}
+	encodedEnvU, err := encodeEnvU(sess.env)
+	if err != nil {
+		return AddDeviceMsg{}, err
+	}
+	encryptedEnvU, err := authenc.AuthEnc(randr, key, encodedEnvU)
+	if err != nil {
+		return AddDeviceMsg{}, err
+	}
+	return AddDeviceMsg{DeviceID: deviceID, EnvU: encryptedEnvU}, nil
+}
+
+// AddDevice is invoked on the server when it has received an AddDeviceMsg. It
+// adds the device's envelope to the user of sess, replacing any envelope with
+// the same device id. AddDevice must only be called after Auth3 has returned
+// successfully for sess, using the primary credential;
+// ErrDevicePrimaryCredential is returned otherwise. The server needs to store
+// the updated User, see UpdateUser.
+func AddDevice(sess *AuthServerSession, msg AddDeviceMsg) error {
+	if !sess.authenticated {
+		return errors.New("authentication not completed")
+	}
+	if sess.credentialID != "" {
+		return ErrDevicePrimaryCredential
+	}
+	if msg.DeviceID == "" {
+		return errors.New("empty device id")
+	}
+	if sess.user.HoneyEnvU != nil {
+		return errors.New("honey envelopes can't be combined with devices")
+	}
+	sess.updates = append(sess.updates, func(user *User) {
+		if user.DeviceEnvU == nil {
+			user.DeviceEnvU = map[string][]byte{}
+		}
+		user.DeviceEnvU[msg.DeviceID] = msg.EnvU
+	})
+	return nil
+}
+
+// deviceEnvelope returns the envelope of the device with the given id. For
+// unknown ids a fake envelope is returned, which is the same on every call, so
+// that the server's response doesn't reveal which devices exist.
+func deviceEnvelope(privS *rsa.PrivateKey, user *User, deviceID string) []byte {
+	if env, ok := user.DeviceEnvU[deviceID]; ok {
+		return env
+	}
+	return fakeBytes(privS, len(user.EnvU), "device", []byte(user.Username), []byte(deviceID))
+}
+
+// envelopeKey derives the key used to encrypt the envelope. If deviceSecret is
+// nil the key only depends on rwdU.
+func envelopeKey(rwdU, deviceSecret []byte) ([]byte, error) {
+	if deviceSecret == nil {
+		return rwdU[:16], nil
+	}
+	kdf := hkdf.New(hasher, rwdU, deviceSecret, []byte("opaque device"))
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
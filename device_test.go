@@ -0,0 +1,179 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"testing"
+)
+
+// authenticateDevice runs the authentication protocol from the device with the
+// given id and secret. On success the client and server sessions are returned.
+func authenticateDevice(privS *rsa.PrivateKey, user *User, password, deviceID string, deviceSecret []byte) (*AuthClientSession, *AuthServerSession, error) {
+	cSess, msg1, err := AuthInitWithDevice(user.Username, deviceID, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	sSess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("server: %s", err)
+	}
+	cSecret, msg3, err := Auth2WithDevice(cSess, msg2, deviceID, deviceSecret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("client: %s", err)
+	}
+	sSecret, err := Auth3(sSess, msg3)
+	if err != nil {
+		return nil, nil, fmt.Errorf("server: %s", err)
+	}
+	if !bytes.Equal(cSecret, sSecret) {
+		return nil, nil, fmt.Errorf("Shared secrets differ")
+	}
+	return cSess, sSess, nil
+}
+
+func TestDevice(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretA, err := NewDeviceSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cSess, msg1, err := PwRegInit("user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, msg2, err := PwReg1(privS, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := PwReg2WithDevice(cSess, msg2, secretA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := PwReg3(sSess, msg3)
+
+	// The password alone isn't enough.
+	if err := authenticate(privS, user, "password", nil, nil, nil, false); err == nil || err.Error() != "client: Authtag mismatch" {
+		t.Fatalf("Auth without device secret: got %v", err)
+	}
+	cAuth, sAuth, err := authenticateDevice(privS, user, "password", "", secretA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := authenticateDevice(privS, user, "wrong", "", secretA); err == nil || err.Error() != "client: Authtag mismatch" {
+		t.Fatalf("Auth with wrong password: got %v", err)
+	}
+
+	// Add a second device from the authenticated session.
+	secretB, err := NewDeviceSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addMsg, err := NewDeviceEnvelope(cAuth, "B", secretB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddDevice(sAuth, addMsg); err != nil {
+		t.Fatal(err)
+	}
+	if user.DeviceEnvU != nil {
+		t.Fatalf("AddDevice modified the user of the session")
+	}
+	user = sAuth.UpdateUser(user)
+	if _, _, err := authenticateDevice(privS, user, "password", "B", secretB); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := authenticateDevice(privS, user, "password", "B", secretA); err == nil || err.Error() != "client: Authtag mismatch" {
+		t.Fatalf("Auth with device A's secret as device B: got %v", err)
+	}
+	if _, _, err := authenticateDevice(privS, user, "password", "C", secretB); err == nil || err.Error() != "client: Authtag mismatch" {
+		t.Fatalf("Auth with unknown device: got %v", err)
+	}
+	// The server only sends the requested envelope, and the response for
+	// an unknown device is the same every time.
+	for _, id := range []string{"B", "C"} {
+		var envs [][]byte
+		for i := 0; i < 2; i++ {
+			_, amsg1, err := AuthInitWithDevice("user", id, "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, amsg2, err := Auth1(privS, user, amsg1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			envs = append(envs, amsg2.EnvU)
+		}
+		if !bytes.Equal(envs[0], envs[1]) || len(envs[0]) != len(user.EnvU) {
+			t.Fatalf("Envelope of device %s: got %x and %x", id, envs[0], envs[1])
+		}
+	}
+	// The primary device still works.
+	if _, _, err := authenticateDevice(privS, user, "password", "", secretA); err != nil {
+		t.Fatal(err)
+	}
+
+	// Devices can only be added from authenticated sessions.
+	cSess2, amsg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess2, _, err := Auth1(privS, user, amsg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDeviceEnvelope(cSess2, "C", secretB); err == nil {
+		t.Fatalf("NewDeviceEnvelope succeeded before authentication")
+	}
+	if err := AddDevice(sSess2, addMsg); err == nil {
+		t.Fatalf("AddDevice succeeded before authentication")
+	}
+}
+
+func TestDeviceWithCredential(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cAuth, sAuth, err := authenticateCredential(privS, user, "", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addCredential(privS, cAuth, sAuth, "recovery", "recovery code"); err != nil {
+		t.Fatal(err)
+	}
+	user = sAuth.UpdateUser(user)
+
+	// Devices can't be added from a session which used another credential,
+	// as the device couldn't log in.
+	cCred, sCred, err := authenticateCredential(privS, user, "recovery", "recovery code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := NewDeviceSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDeviceEnvelope(cCred, "B", secret); err != ErrDevicePrimaryCredential {
+		t.Fatalf("NewDeviceEnvelope with a credential: got %v", err)
+	}
+	addMsg, err := NewDeviceEnvelope(cAuth, "B", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddDevice(sCred, addMsg); err != ErrDevicePrimaryCredential {
+		t.Fatalf("AddDevice with a credential: got %v", err)
+	}
+}
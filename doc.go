@@ -15,10 +15,92 @@ assumption). The client initiates the password registration protocol by calling
 PwRegInit. Similarly, the authentication protocol is initiated by the client
 calling AuthInit.
 
+If no authenticated connection is available, for example when a user signs up
+for the first time, the server can issue one-time registration codes (see
+RegCodeStore). The registration is then started with PwRegInitWithCode and the
+server only accepts it if the client proves that it holds a valid code, and
+vice versa.
+
 If the authentication protocol finishes successfully a newly generated random
 secret is shared between the client and server. The secret can be used to
 protect any future communication between the peers.
 
+The envelope can also hold application data: a private key (e.g., an existing
+Ed25519 or SSH identity) and an arbitrary payload. The data is given to
+PwReg2WithData and returned by AuthClientSession.EnvelopeData after each
+successful login, so the server can act as a store for roaming credentials
+without ever seeing them in the clear. An RSA key is used as the user's key
+pair, so the account's identity is the supplied key.
+
+An account can hold several credentials, e.g., a main password, per-device
+passwords and printed recovery codes (see NewRecoveryCode). Each credential has
+its own OPRF key and envelope, but all of them unlock the same private key and
+export key (see AuthClientSession.ExportKey). Credentials are added with
+NewCredentialInit and AddCredential1 from a session authenticated with the
+primary credential, revoked with RevokeCredential, and selected with
+AuthInitWithCredential. An unknown credential fails like a wrong password.
+
+To detect a leaked user database, the server can add honey envelopes for
+likely-guessed passwords to a record with AddHoneyEnvelopes. Only a
+HoneyChecker, whose key is kept apart from the records, knows which envelope is
+the real one, and Auth3WithHoney raises an alarm when a decoy is used. Decoy
+and wrong passwords both fail in Auth3WithHoney with the same error.
+
+The authentication protocol can also run with two messages. The server uses
+Auth1Implicit, which encrypts a key to the client's public key and returns the
+secret right away, and AuthMsg3 is not sent. The client is then only
+authenticated implicitly: the server session stays unconfirmed until the client
+has sent the MAC from AuthClientSession.ConfirmationMac and
+AuthServerSession.Confirm has verified it.
+
+A server can precompute its ephemeral D-H key pairs in the background with a
+KeyPool and pass it to Auth1WithKeyPool, which lowers the latency of logins in
+a burst.
+
+A user can have a TOTP second factor (RFC 6238), enabled with EnableTOTP from
+an authenticated session. The server then adds an encrypted challenge to
+AuthMsg2, the client answers it with AnswerSecondFactor inside AuthMsg3, and
+Auth3 fails unless both the password proof and the code verify. After five
+wrong codes in a row the user is locked for 15 minutes.
+
+User records carry lifecycle metadata: creation time, last password change,
+last successful login, a counter of failed Auth3 calls, password expiry, and
+flags which force a password change or disable the user. Auth1 rejects logins for
+disabled or locked users and tells the client when the password must be
+changed, which is done with ChangePasswordInit, Upgrade1 and Upgrade3.
+
+All randomness is read from crypto/rand.Reader unless SetRandom is called with
+another source. With a deterministic source, such as a DRBG with a fixed seed,
+whole runs of the protocols are reproducible, which is meant for known-answer
+tests and for reproducing failures only. NewTestVector records such a run,
+and the vectors written by cmd/katgen are checked by the package's tests.
+The protocols follow the draft in [1] and not RFC 9807, and the OPRF works in
+finite field groups, while RFC 9497 only defines elliptic curve suites. The
+outputs are therefore not interoperable with those RFCs and their test vectors
+don't apply.
+
+The OPRF used by both protocols is available on its own in package
+github.com/frekui/opaque/oprf, with batched evaluation for servers which handle
+many inputs under the same key. It also has a partially-oblivious
+mode (POPRF), which lets the server register users under a single master key
+with public metadata such as a tenant id or key epoch (see
+PwRegInitWithInfo, PwReg1WithMasterKey and MasterKey.Retire). Besides the
+default group, package oprf offers suites over the larger RFC 3526 groups, the
+RFC 7919 ffdhe groups and validated custom parameters.
+
+After a successful login the server can issue a batch of anonymous tokens in
+the style of Privacy Pass (see NewTokenRequest, IssueTokens and
+FinalizeTokens). The tokens are created with the verifiable OPRF, so they can't
+be linked to the login, and each of them can be spent once on an anonymous
+request to a service which checks it with TokenStore.Redeem. A TokenQuota
+limits the number of tokens issued to each user within a time window.
+
+The package also contains an implementation of CPace, a balanced PAKE, for
+the case where both peers know the same password and neither holds a
+registration record (e.g., when pairing two devices using a short code). CPace
+is initiated by calling CPaceInit and it returns a shared secret in the same way
+as the authentication protocol.
+
 A number of structs with messages for the two protocols (AuthMsg1, AuthMsg2,
 AuthMsg3, PwRegMsg1, PwRegMsg2, PwRegMsg3) are defined in this package. It's up
 to the user of the package to serialize and deserialize these structs and send
@@ -26,6 +108,15 @@ them from the client/server to the peer on the other end. In the example server
 and client (cmd/server and cmd/client) the messages are serialized using JSON,
 which is simple and works but isn't the most efficient option.
 
+If a peer aborts a protocol run it can send an Alert in place of the next
+protocol message. NewAlert maps an error to an Alert and Alert.Err maps a
+received Alert back to an error. To avoid leaking information, all failures
+related to the password, the user's record, or the peers' keys are reported as
+AlertAuthFailed. Servers abort with AlertVersionMismatch if the client speaks
+another ProtocolVersion, and failures of the random source are reported as
+AlertInternalError. Records created with an older ProtocolVersion can't be
+used after an upgrade, so all users have to register again.
+
 IMPORTANT NOTE: This code has been written for educational purposes only. No
 experts in cryptography or IT security have reviewed it. Do not use it for
 anything important.
@@ -6,6 +6,7 @@
 package opaque
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -18,8 +19,37 @@ type envU struct {
 	// pubU is privU.Public()
 	privU *rsa.PrivateKey
 	pubS  *rsa.PublicKey
+
+	// Application data given to PwReg2WithData, nil if there is none.
+	data *EnvelopeData
 }
 
+// EnvelopeData is application data which is stored in the envelope together
+// with the keys used by the authentication protocol. It is given to the
+// password registration protocol by the client and returned to the client by
+// AuthClientSession.EnvelopeData after each successful run of the
+// authentication protocol. The server never sees the data in the clear.
+type EnvelopeData struct {
+	// Key is a private key, e.g., an existing Ed25519 or SSH identity. It
+	// must be of a type supported by x509.MarshalPKCS8PrivateKey
+	// (*rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, or
+	// *ecdh.PrivateKey). May be nil.
+	//
+	// An *rsa.PrivateKey is used as the user's key pair (PrivU and PubU),
+	// so that the account's identity is the supplied key, instead of a new
+	// key being generated. Keys of other types are stored next to PrivU,
+	// since the authentication protocol signs with RSA.
+	Key crypto.PrivateKey
+
+	// Payload is arbitrary application data, e.g., small secrets or
+	// recovery information. May be nil.
+	Payload []byte
+}
+
+// keyIsPrivU is the header of the PEM block which stands in for
+// EnvelopeData.Key if the key is privU, so that it isn't stored twice.
+const keyIsPrivU = "Key-Is-PrivU"
+
 // decodeEnvU decodes an envU from a slice of bytes.
 func decodeEnvU(pemdata []byte) (envU, error) {
 	privblock, pemdata := pem.Decode(pemdata)
@@ -33,7 +63,8 @@ func decodeEnvU(pemdata []byte) (envU, error) {
 	if err != nil {
 		return envU{}, err
 	}
-	pubblock, _ := pem.Decode(pemdata)
+	var pubblock *pem.Block
+	pubblock, pemdata = pem.Decode(pemdata)
 	if pubblock == nil {
 		return envU{}, fmt.Errorf("Failed to decode public key")
 	}
@@ -44,11 +75,38 @@ func decodeEnvU(pemdata []byte) (envU, error) {
 	if err != nil {
 		return envU{}, err
 	}
-	return envU{privU: privkey, pubS: pubkey}, nil
+	env := envU{privU: privkey, pubS: pubkey}
+	// Envelopes without application data end here.
+	for {
+		var block *pem.Block
+		block, pemdata = pem.Decode(pemdata)
+		if block == nil {
+			break
+		}
+		if env.data == nil {
+			env.data = &EnvelopeData{}
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			if block.Headers[keyIsPrivU] == "yes" {
+				env.data.Key = privkey
+				break
+			}
+			env.data.Key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return envU{}, err
+			}
+		case "PAYLOAD":
+			env.data.Payload = block.Bytes
+		default:
+			return envU{}, fmt.Errorf("Unexpected type of block: %s", block.Type)
+		}
+	}
+	return env, nil
 }
 
 // encodeEnvU encodes an envU as a slice of bytes.
-func encodeEnvU(env *envU) []byte {
+func encodeEnvU(env *envU) ([]byte, error) {
 	pemdata := pem.EncodeToMemory(
 		&pem.Block{
 			Type:  "RSA PRIVATE KEY",
@@ -61,5 +119,20 @@ func encodeEnvU(env *envU) []byte {
 			Bytes: x509.MarshalPKCS1PublicKey(env.pubS),
 		},
 	)...)
-	return pemdata
+	if env.data == nil {
+		return pemdata, nil
+	}
+	if key, ok := env.data.Key.(*rsa.PrivateKey); ok && key.Equal(env.privU) {
+		pemdata = append(pemdata, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Headers: map[string]string{keyIsPrivU: "yes"}})...)
+	} else if env.data.Key != nil {
+		der, err := x509.MarshalPKCS8PrivateKey(env.data.Key)
+		if err != nil {
+			return nil, err
+		}
+		pemdata = append(pemdata, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	}
+	if env.data.Payload != nil {
+		pemdata = append(pemdata, pem.EncodeToMemory(&pem.Block{Type: "PAYLOAD", Bytes: env.data.Payload})...)
+	}
+	return pemdata, nil
 }
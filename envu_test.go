@@ -6,6 +6,7 @@
 package opaque
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"testing"
@@ -24,7 +25,10 @@ func TestEnvU(t *testing.T) {
 	}
 	genEnvU := &envU{privU: privU, pubS: &privS.PublicKey}
 
-	encodedEnvU := encodeEnvU(genEnvU)
+	encodedEnvU, err := encodeEnvU(genEnvU)
+	if err != nil {
+		t.Fatalf("encoding failed: %s", err)
+	}
 	decodedEnvU, err := decodeEnvU(encodedEnvU)
 	if err != nil {
 		t.Fatalf("decoding failed: %s", err)
@@ -34,3 +38,172 @@ func TestEnvU(t *testing.T) {
 		t.Fatalf("envU not equal! %v", diff)
 	}
 }
+
+func TestEnvUData(t *testing.T) {
+	privU, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatalf("Failed to generate privU: %s", err)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	for _, data := range []*EnvelopeData{
+		{Key: key, Payload: []byte("payload")},
+		{Key: key},
+		{Payload: []byte("payload")},
+		{Key: privU},
+	} {
+		genEnvU := &envU{privU: privU, pubS: &privU.PublicKey, data: data}
+		encodedEnvU, err := encodeEnvU(genEnvU)
+		if err != nil {
+			t.Fatalf("encoding failed: %s", err)
+		}
+		decodedEnvU, err := decodeEnvU(encodedEnvU)
+		if err != nil {
+			t.Fatalf("decoding failed: %s", err)
+		}
+		if diff := deep.Equal(*genEnvU, decodedEnvU); diff != nil {
+			t.Fatalf("envU not equal! %v", diff)
+		}
+	}
+
+	if _, err := encodeEnvU(&envU{privU: privU, pubS: &privU.PublicKey, data: &EnvelopeData{Key: "not a key"}}); err == nil {
+		t.Fatalf("Encoding an unsupported key succeeded")
+	}
+}
+
+func TestEnvelopeData(t *testing.T) {
+	privS, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &EnvelopeData{Key: key, Payload: []byte("recovery info")}
+	cSess, msg1, err := PwRegInit("user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, msg2, err := PwReg1(privS, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := PwReg2WithData(cSess, msg2, nil, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := PwReg3(sSess, msg3)
+
+	cAuth, sAuth, err := authenticateDevice(privS, user, "password", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(cAuth.EnvelopeData(), data); diff != nil {
+		t.Fatalf("EnvelopeData differs: %v", diff)
+	}
+
+	// The data is carried over to upgraded records and devices.
+	upClient, umsg1, err := UpgradeInit(cAuth, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upServer, umsg2, err := Upgrade1(privS, sAuth, umsg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	umsg3, err := PwReg2(upClient, umsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cUp, _, err := authenticateDevice(privS, PwReg3(upServer, umsg3), "password", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(cUp.EnvelopeData(), data); diff != nil {
+		t.Fatalf("Upgraded EnvelopeData differs: %v", diff)
+	}
+
+	secret, err := NewDeviceSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addMsg, err := NewDeviceEnvelope(cAuth, "B", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddDevice(sAuth, addMsg); err != nil {
+		t.Fatal(err)
+	}
+	user = sAuth.UpdateUser(user)
+	cDev, _, err := authenticateDevice(privS, user, "password", "B", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(cDev.EnvelopeData(), data); diff != nil {
+		t.Fatalf("Device EnvelopeData differs: %v", diff)
+	}
+
+	// Records without application data return nil.
+	plainUser, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cPlain, _, err := authenticateDevice(privS, plainUser, "password", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cPlain.EnvelopeData() != nil {
+		t.Fatalf("Unexpected EnvelopeData %v", cPlain.EnvelopeData())
+	}
+}
+
+func TestEnvelopeDataRSAKey(t *testing.T) {
+	privS, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cSess, msg1, err := PwRegInit("user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, msg2, err := PwReg1(privS, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := PwReg2WithData(cSess, msg2, nil, &EnvelopeData{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := PwReg3(sSess, msg3)
+	// The supplied key is the user's key pair.
+	if !user.PubU.Equal(&key.PublicKey) {
+		t.Fatalf("PubU isn't the public part of the supplied key")
+	}
+	cAuth, _, err := authenticateDevice(privS, user, "password", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := cAuth.EnvelopeData(); data == nil || data.Key.(*rsa.PrivateKey) != cAuth.env.privU || !key.Equal(data.Key) {
+		t.Fatalf("Unexpected EnvelopeData %v", data)
+	}
+
+	// The key must be large enough.
+	cSess, msg1, err = PwRegInit("user", "password", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg2, err = PwReg1(privS, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PwReg2WithData(cSess, msg2, nil, &EnvelopeData{Key: key}); err == nil {
+		t.Fatalf("PwReg2WithData accepted a 512 bit key for 1024 bits")
+	}
+}
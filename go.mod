@@ -1,5 +1,11 @@
 module github.com/frekui/opaque
 
+go 1.24
+
+// The commands and tests get the GODEBUG defaults of the current Go release;
+// settings which they rely on are set with //go:debug lines.
+godebug default=go1.27
+
 require (
 	github.com/go-test/deep v1.0.1
 	golang.org/x/crypto v0.0.0-20181112202954-3d3f9f413869
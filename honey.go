@@ -0,0 +1,218 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains support for honey envelopes. An attacker who has stolen
+// the server's user database can run offline guesses against each user's OPRF
+// key and envelope. To detect this, the server can seal decoy envelopes for
+// likely-guessed passwords with the user's OPRF key (AddHoneyEnvelopes). The
+// real envelope is mixed with the decoys in random order and its position is
+// only recorded as a MAC under a key held by a HoneyChecker, which should be
+// stored separately from the user database. An attacker who finds a password
+// that opens one of the envelopes can't tell whether it's the real one without
+// logging in, and a login with a decoy password raises an alarm in
+// Auth3WithHoney.
+//
+// To the client a login with a decoy password looks like a login with a wrong
+// password: for users with honey envelopes Auth2 returns an AuthMsg3 even if no
+// envelope can be opened, and Auth3WithHoney rejects both with the same error
+// as for a bad signature, which NewAlert reports as AlertAuthFailed.
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/frekui/opaque/internal/pkg/authenc"
+	"github.com/frekui/opaque/oprf"
+)
+
+// HoneyEnvelope is an envelope and the public key it contains. The User struct
+// holds the real envelope and the decoys as HoneyEnvelopes after
+// AddHoneyEnvelopes has been called.
+type HoneyEnvelope struct {
+	EnvU []byte
+	PubU *rsa.PublicKey
+}
+
+// HoneyChecker knows which of a user's envelopes is the real one. Its key
+// should be kept apart from the user database (e.g., on a separate host) so
+// that a stolen database doesn't reveal it.
+type HoneyChecker struct {
+	key []byte
+
+	// Alarm is called by Auth3WithHoney when a decoy envelope is used.
+	// It's typically used to alert an operator that the user database
+	// has leaked. May be nil.
+	Alarm func(username string)
+}
+
+// NewHoneyChecker creates a HoneyChecker with the given key. The same key must
+// be used for as long as users with honey envelopes are stored. If key is nil a
+// random key is generated.
+func NewHoneyChecker(key []byte, alarm func(username string)) (*HoneyChecker, error) {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(randr, key); err != nil {
+			return nil, err
+		}
+	}
+	return &HoneyChecker{key: key, Alarm: alarm}, nil
+}
+
+// tag computes the MAC which marks index as the position of username's real
+// envelope.
+func (hc *HoneyChecker) tag(username string, index int) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(index))
+	return regCodeMac(hc.key, "honey", []byte(username), buf[:])
+}
+
+// AddHoneyEnvelopes seals a decoy envelope for each of the given passwords with
+// user's OPRF key and mixes them with the real envelope, which is moved from
+// user.EnvU and user.PubU to user.HoneyEnvU. The decoy keys have the same size
+// as user.PubU. Users with additional devices or credentials, or users
+// registered under a master key, can't have honey envelopes.
+//
+// The server learns the decoy passwords but never the real one. A decoy that
+// happens to equal the real password doesn't open the real envelope, it just
+// adds an envelope that is never used.
+func AddHoneyEnvelopes(privS *rsa.PrivateKey, hc *HoneyChecker, user *User, passwords []string) error {
+	if len(user.DeviceEnvU) != 0 || len(user.Credentials) != 0 {
+		return errors.New("honey envelopes can't be combined with devices or credentials")
+	}
+	if user.K == nil {
+		return errors.New("honey envelopes require a per-user OPRF key")
+	}
+	envs := user.HoneyEnvU
+	realIdx := -1
+	if envs == nil {
+		envs = []*HoneyEnvelope{{EnvU: user.EnvU, PubU: user.PubU}}
+		realIdx = 0
+	} else {
+		for i := range envs {
+			if hmac.Equal(hc.tag(user.Username, i), user.HoneyTag) {
+				realIdx = i
+			}
+		}
+		if realIdx < 0 {
+			return errors.New("real envelope not found")
+		}
+	}
+	bits := envs[realIdx].PubU.N.BitLen()
+	for _, password := range passwords {
+		env, err := newHoneyEnvelope(privS, user.K, password, bits)
+		if err != nil {
+			return err
+		}
+		envs = append(envs, env)
+	}
+	// Shuffle with Fisher-Yates and keep track of the real envelope.
+	for i := len(envs) - 1; i > 0; i-- {
+		j, err := randIntn(i + 1)
+		if err != nil {
+			return err
+		}
+		envs[i], envs[j] = envs[j], envs[i]
+		if realIdx == i {
+			realIdx = j
+		} else if realIdx == j {
+			realIdx = i
+		}
+	}
+	user.HoneyEnvU = envs
+	user.HoneyTag = hc.tag(user.Username, realIdx)
+	user.EnvU = nil
+	user.PubU = nil
+	return nil
+}
+
+// newHoneyEnvelope seals a new random private key in an envelope for password
+// and the OPRF key k.
+func newHoneyEnvelope(privS *rsa.PrivateKey, k *big.Int, password string, bits int) (*HoneyEnvelope, error) {
+	blind, blinded, err := oprf.Blind([]byte(password))
+	if err != nil {
+		return nil, err
+	}
+	eval, err := oprf.NewKey(k).Evaluate(blinded)
+	if err != nil {
+		return nil, err
+	}
+	rwdU, err := oprf.Finalize(blind, eval)
+	if err != nil {
+		return nil, err
+	}
+	privU, err := rsa.GenerateKey(rsaRandom(), bits)
+	if err != nil {
+		return nil, err
+	}
+	encodedEnvU, err := encodeEnvU(&envU{privU: privU, pubS: &privS.PublicKey})
+	if err != nil {
+		return nil, err
+	}
+	encryptedEnvU, err := authenc.AuthEnc(randr, rwdU[:16], encodedEnvU)
+	if err != nil {
+		return nil, err
+	}
+	return &HoneyEnvelope{EnvU: encryptedEnvU, PubU: &privU.PublicKey}, nil
+}
+
+// honeyFailure is called by Auth2 if the password doesn't open any of the honey
+// envelopes in msg2. It returns a secret and an AuthMsg3 with a random
+// signature and MAC, which Auth3WithHoney rejects.
+func honeyFailure(sess *AuthClientSession, msg2 AuthMsg2) ([]byte, AuthMsg3, error) {
+	dhSharedSecret, _, err := dhSecrets(sess.x, msg2.DhPubServer)
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	msg3 := AuthMsg3{DhSig: make([]byte, len(msg2.DhSig)), DhMac: make([]byte, hasher().Size())}
+	if _, err := io.ReadFull(randr, msg3.DhSig); err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	if _, err := io.ReadFull(randr, msg3.DhMac); err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	return dhSharedSecret, msg3, nil
+}
+
+// Auth3WithHoney is like Auth3 but it is used for users which may have honey
+// envelopes. If the client used a decoy envelope hc.Alarm is called in a new
+// goroutine and the same error as for a bad signature is returned. For users
+// without honey envelopes Auth3WithHoney is equivalent to Auth3.
+func Auth3WithHoney(sess *AuthServerSession, msg3 AuthMsg3, hc *HoneyChecker) (secret []byte, err error) {
+	user := sess.user
+	if user.HoneyEnvU == nil {
+		return Auth3(sess, msg3)
+	}
+	// All envelopes are checked so that the time taken doesn't depend on
+	// which one was used.
+	used := -1
+	for i, env := range user.HoneyEnvU {
+		if verifyAuthMsg3(sess, env.PubU, msg3) == nil {
+			used = i
+		}
+	}
+	if used < 0 {
+		sess.loginFailed()
+		return nil, rsa.ErrVerification
+	}
+	if !hmac.Equal(hc.tag(user.Username, used), user.HoneyTag) {
+		if hc.Alarm != nil {
+			go hc.Alarm(user.Username)
+		}
+		sess.loginFailed()
+		return nil, rsa.ErrVerification
+	}
+	if err := verifySecondFactor(sess, msg3); err != nil {
+		sess.loginFailed()
+		return nil, err
+	}
+	sess.loginSucceeded()
+	return sess.dhSharedSecret, nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+)
+
+// authenticateHoney runs the authentication protocol using Auth3WithHoney. The
+// error from Auth2 or Auth3WithHoney is returned.
+func authenticateHoney(privS *rsa.PrivateKey, hc *HoneyChecker, user *User, password string) error {
+	cSess, msg1, err := AuthInit(user.Username, password)
+	if err != nil {
+		return err
+	}
+	sSess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		return err
+	}
+	cSecret, msg3, err := Auth2(cSess, msg2)
+	if err != nil {
+		return err
+	}
+	sSecret, err := Auth3WithHoney(sSess, msg3, hc)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cSecret, sSecret) {
+		return errors.New("Shared secrets differ")
+	}
+	return nil
+}
+
+func TestHoney(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alarms := make(chan string, 10)
+	hc, err := NewHoneyChecker(nil, func(username string) { alarms <- username })
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddHoneyEnvelopes(privS, hc, user, []string{"123456", "qwerty"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddHoneyEnvelopes(privS, hc, user, []string{"letmein"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.HoneyEnvU) != 4 || user.EnvU != nil || user.PubU != nil {
+		t.Fatalf("Unexpected record after AddHoneyEnvelopes")
+	}
+
+	if err := authenticateHoney(privS, hc, user, "password"); err != nil {
+		t.Fatal(err)
+	}
+	// A wrong password doesn't open any envelope. It fails in
+	// Auth3WithHoney, just like a decoy password.
+	if err := authenticateHoney(privS, hc, user, "wrong"); err != rsa.ErrVerification {
+		t.Fatalf("Wrong password: got %v", err)
+	}
+	select {
+	case username := <-alarms:
+		t.Fatalf("Unexpected alarm for %s", username)
+	default:
+	}
+
+	// A decoy password opens a decoy envelope and raises the alarm. The
+	// error is the same as for a wrong password.
+	for _, decoy := range []string{"123456", "qwerty", "letmein"} {
+		if err := authenticateHoney(privS, hc, user, decoy); err != rsa.ErrVerification {
+			t.Fatalf("Decoy password %q: got %v", decoy, err)
+		}
+		select {
+		case username := <-alarms:
+			if username != "user" {
+				t.Fatalf("Alarm for %s", username)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No alarm for decoy password %q", decoy)
+		}
+	}
+
+	// Without the checker's key the real envelope can't be identified.
+	other, err := NewHoneyChecker(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticateHoney(privS, other, user, "password"); err != rsa.ErrVerification {
+		t.Fatalf("Other checker: got %v", err)
+	}
+	cSess, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg3, err := Auth2(cSess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Auth3(sSess, msg3); err == nil {
+		t.Fatalf("Auth3 succeeded for a user with honey envelopes")
+	}
+}
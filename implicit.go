@@ -0,0 +1,142 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains the two-message mode of the authentication protocol. The
+// server encrypts a random key to the client's public key PubU and mixes it
+// into the shared secret, so only a client which could open the envelope can
+// compute the secret:
+//
+//     Client                         Server
+//     AuthInit           AuthMsg1 -> Auth1Implicit
+//     Auth2          <-  AuthMsg2
+//
+// The server authenticates the client implicitly: it can use the secret right
+// away, but until the client has proved that it holds the secret the server
+// doesn't know whether anybody does. The server session is unconfirmed until
+// then. The client proves it with a MAC under the secret, which it sends
+// together with its first record (see AuthClientSession.ConfirmationMac and
+// AuthServerSession.Confirm).
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// implicitLabel is the OAEP label used when encrypting the key to PubU.
+var implicitLabel = []byte("opaque implicit")
+
+// Auth1Implicit is like Auth1 but it runs the two-message mode of the
+// authentication protocol. The returned AuthMsg2 should be sent to the client
+// and the returned secret is equal to the secret returned by Auth2 on the
+// client. Auth3 is not used.
+//
+// The session is unconfirmed: the server has not authenticated the client
+// yet. The server must call sess.Confirm with the MAC from the client's
+// ConfirmationMac. Until then the secret may be used to protect data sent to
+// the client, which only the holder of PrivU can read, but nothing received
+// under it may be trusted.
+//
+// User records with honey envelopes or a second factor can't be used in this
+// mode, as the latter is answered in AuthMsg3. The RSA key in
+// user's record must have at least 1024 bits.
+func Auth1Implicit(privS *rsa.PrivateKey, user *User, msg1 AuthMsg1) (sess *AuthServerSession, msg2 AuthMsg2, secret []byte, err error) {
+	return Auth1ImplicitWithKeyPool(privS, nil, user, msg1)
+}
+
+// Auth1ImplicitWithKeyPool is like Auth1Implicit but the server's ephemeral D-H
+// key pair is taken from pool if it isn't empty. See KeyPool.
+func Auth1ImplicitWithKeyPool(privS *rsa.PrivateKey, pool *KeyPool, user *User, msg1 AuthMsg1) (sess *AuthServerSession, msg2 AuthMsg2, secret []byte, err error) {
+	if user.PubU == nil {
+		return nil, AuthMsg2{}, nil, errors.New("implicit authentication isn't supported for users with honey envelopes")
+	}
+	if user.TOTPSecret != nil {
+		return nil, AuthMsg2{}, nil, errors.New("implicit authentication isn't supported for users with a second factor")
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(randr, key); err != nil {
+		return nil, AuthMsg2{}, nil, err
+	}
+	encKey, err := rsa.EncryptOAEP(hasher(), rsaRandom(), user.PubU, key, implicitLabel)
+	if err != nil {
+		return nil, AuthMsg2{}, nil, err
+	}
+	sess, msg2, err = auth1(privS, nil, pool, user, msg1, false, encKey)
+	if err != nil {
+		return nil, AuthMsg2{}, nil, err
+	}
+	secret, err = deriveImplicitSecret(sess.dhSharedSecret, key)
+	if err != nil {
+		return nil, AuthMsg2{}, nil, err
+	}
+	sess.implicit = true
+	sess.implicitSecret = secret
+	return sess, msg2, secret, nil
+}
+
+// ConfirmationMac returns the MAC which proves to the server that the client
+// holds the secret of the two-message mode, see AuthServerSession.Confirm. It
+// returns nil unless Auth2 has returned successfully for an AuthMsg2 created by
+// Auth1Implicit.
+func (sess *AuthClientSession) ConfirmationMac() []byte {
+	if sess.implicitSecret == nil {
+		return nil
+	}
+	return confirmationMac(sess.implicitSecret)
+}
+
+// Confirm verifies mac, which the client has computed with ConfirmationMac,
+// and marks an unconfirmed session created by Auth1Implicit as authenticated.
+// An error is returned if the MAC doesn't verify or if sess wasn't created by
+// Auth1Implicit. Like Auth3, Confirm records the login or the failed attempt as
+// a change to the user, see UpdateUser.
+func (sess *AuthServerSession) Confirm(mac []byte) error {
+	if !sess.implicit {
+		return errors.New("session doesn't use implicit authentication")
+	}
+	if sess.fake || !hmac.Equal(mac, confirmationMac(sess.implicitSecret)) {
+		sess.loginFailed()
+		return errors.New("MAC mismatch")
+	}
+	sess.loginSucceeded()
+	return nil
+}
+
+// Confirmed returns true if the client has been authenticated, i.e., if Auth3
+// or Confirm has returned successfully.
+func (sess *AuthServerSession) Confirmed() bool {
+	return sess.authenticated
+}
+
+// implicitSecret decrypts encKey with privU and derives the secret of the
+// two-message mode.
+func implicitSecret(dhSharedSecret []byte, privU *rsa.PrivateKey, encKey []byte) ([]byte, error) {
+	key, err := rsa.DecryptOAEP(hasher(), rsaRandom(), privU, encKey, implicitLabel)
+	if err != nil {
+		return nil, err
+	}
+	return deriveImplicitSecret(dhSharedSecret, key)
+}
+
+// confirmationMac computes the MAC which confirms a session of the two-message
+// mode.
+func confirmationMac(secret []byte) []byte {
+	return regCodeMac(secret, "opaque implicit confirmation")
+}
+
+// deriveImplicitSecret combines the D-H secret with the key encrypted to PubU.
+func deriveImplicitSecret(dhSharedSecret, key []byte) ([]byte, error) {
+	kdf := hkdf.New(hasher, dhSharedSecret, key, implicitLabel)
+	secret := make([]byte, len(dhSharedSecret))
+	if _, err := io.ReadFull(kdf, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
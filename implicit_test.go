@@ -0,0 +1,114 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestImplicit(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cSess, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, msg2, sSecret, err := Auth1Implicit(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// EncKey is covered by the MAC.
+	tampered := msg2
+	tampered.EncKey = nil
+	if _, _, err := Auth2(cSess, tampered); err == nil || err.Error() != "MAC mismatch" {
+		t.Fatalf("Stripped EncKey: got %v", err)
+	}
+	cSecret, msg3, err := Auth2(cSess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cSecret, sSecret) {
+		t.Fatalf("Shared secrets differ")
+	}
+	if sSess.Confirmed() {
+		t.Fatalf("Session confirmed before Confirm")
+	}
+	if _, err := Auth3(sSess, msg3); err == nil {
+		t.Fatalf("Auth3 succeeded for an implicit session")
+	}
+	if err := RevokeCredential(sSess, "x"); err == nil || err.Error() != "authentication not completed" {
+		t.Fatalf("RevokeCredential on unconfirmed session: got %v", err)
+	}
+	mac := cSess.ConfirmationMac()
+	bad := append([]byte(nil), mac...)
+	bad[0] ^= 1
+	if err := sSess.Confirm(bad); err == nil || sSess.Confirmed() {
+		t.Fatalf("Confirm accepted a bad MAC")
+	}
+	if err := sSess.Confirm(nil); err == nil || sSess.Confirmed() {
+		t.Fatalf("Confirm accepted a missing MAC")
+	}
+	if err := sSess.Confirm(mac); err != nil {
+		t.Fatal(err)
+	}
+	if !sSess.Confirmed() {
+		t.Fatalf("Session not confirmed after Confirm")
+	}
+
+	// A wrong password gives the client no secret.
+	cSess, msg1, err = AuthInit("user", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg2, _, err = Auth1Implicit(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Auth2(cSess, msg2); err == nil {
+		t.Fatalf("Auth2 succeeded with wrong password")
+	}
+
+	// The D-H secret alone doesn't give the implicit secret.
+	_, msg1, err = AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, _, sSecret, err = Auth1Implicit(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sSess.dhSharedSecret, sSecret) {
+		t.Fatalf("Implicit secret equals the D-H secret")
+	}
+
+	// Sessions created by Auth1 can't be confirmed.
+	cSess, msg1, err = AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, msg2, err = Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Auth2(cSess, msg2); err != nil {
+		t.Fatal(err)
+	}
+	if cSess.ConfirmationMac() != nil {
+		t.Fatalf("ConfirmationMac for a three-message session")
+	}
+	if err := sSess.Confirm(mac); err == nil || sSess.Confirmed() {
+		t.Fatalf("Confirm succeeded for a three-message session")
+	}
+}
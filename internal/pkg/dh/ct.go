@@ -0,0 +1,223 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package dh
+
+// This file contains constant-time modular exponentiation for secret
+// exponents. big.Int.Exp isn't constant time: it skips leading zero bits, its
+// running time depends on the length of the operands, and it looks up its
+// window table by index. Here all values are converted to a fixed number of
+// words (the number of words in the modulus) and Montgomery multiplication is
+// done word by word, so that the sequence of operations only depends on the
+// size of the modulus. Table entries are selected by reading all of them and
+// masking.
+//
+// The conversion from and to big.Int at the boundaries isn't constant time,
+// but it only depends on the length of the values, not on their bits.
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// ctWindow is the window size, in bits, used by modulus.exp.
+const ctWindow = 4
+
+// modulus holds an odd modulus m and the values needed for Montgomery
+// arithmetic mod m with R = 2^(W*n), where W is the word size and n is the
+// number of words in m. All slices have length n.
+type modulus struct {
+	m     []big.Word
+	m0inv big.Word // -m^-1 mod 2^W
+	rr    []big.Word
+	one   []big.Word // R mod m, i.e., 1 in Montgomery form
+	bits  int
+
+	// muls, if not nil, is incremented by each call to mul. It's only set by
+	// tests, which check that the number of multiplications doesn't depend
+	// on the exponent.
+	muls *int
+}
+
+func newModulus(m *big.Int) *modulus {
+	if m.Bit(0) == 0 {
+		panic("dh: even modulus")
+	}
+	n := len(m.Bits())
+	mod := &modulus{m: toWords(m, n), bits: m.BitLen()}
+	// Newton's iteration for m^-1 mod 2^W, doubling the number of correct
+	// bits in each step.
+	inv := mod.m[0]
+	for i := 0; i < 6; i++ {
+		inv *= 2 - mod.m[0]*inv
+	}
+	mod.m0inv = -inv
+	r := new(big.Int).Lsh(big.NewInt(1), uint(n*bits.UintSize))
+	mod.one = toWords(new(big.Int).Mod(r, m), n)
+	rr := new(big.Int).Mul(r, r)
+	mod.rr = toWords(rr.Mod(rr, m), n)
+	return mod
+}
+
+// toWords returns x as n little-endian words. x must be non-negative and fit
+// in n words.
+func toWords(x *big.Int, n int) []big.Word {
+	w := make([]big.Word, n)
+	copy(w, x.Bits())
+	return w
+}
+
+// toInt converts little-endian words to a big.Int.
+func toInt(w []big.Word) *big.Int {
+	return new(big.Int).SetBits(append([]big.Word(nil), w...))
+}
+
+// mul sets z = x*y*R^-1 mod m. z may alias x or y. t is scratch space of
+// length n+1.
+//
+// In round i, x*y[i] and u*m are added to t in the same pass, where u is chosen
+// so that the lowest word of the sum is zero, and the sum is shifted down one
+// word. After n rounds t = x*y*R^-1 mod m or t = x*y*R^-1 mod m + m.
+func (mod *modulus) mul(z, x, y, t []big.Word) {
+	if mod.muls != nil {
+		*mod.muls++
+	}
+	m := mod.m
+	n := len(m)
+	x, y, t = x[:n], y[:n], t[:n+1]
+	for i := range t {
+		t[i] = 0
+	}
+	for i := 0; i < n; i++ {
+		yi := uint(y[i])
+		hi1, lo1 := bits.Mul(uint(x[0]), yi)
+		lo1, c := bits.Add(lo1, uint(t[0]), 0)
+		c1 := hi1 + c
+		u := lo1 * uint(mod.m0inv)
+		hi2, lo2 := bits.Mul(u, uint(m[0]))
+		_, c = bits.Add(lo2, lo1, 0)
+		c2 := hi2 + c
+		for j := 1; j < n; j++ {
+			hi1, lo1 := bits.Mul(uint(x[j]), yi)
+			lo1, c := bits.Add(lo1, uint(t[j]), 0)
+			hi1 += c
+			lo1, c = bits.Add(lo1, c1, 0)
+			c1 = hi1 + c
+			hi2, lo2 := bits.Mul(u, uint(m[j]))
+			lo2, c = bits.Add(lo2, lo1, 0)
+			hi2 += c
+			lo2, c = bits.Add(lo2, c2, 0)
+			c2 = hi2 + c
+			t[j-1] = big.Word(lo2)
+		}
+		s, c := bits.Add(uint(t[n]), c1, 0)
+		top := c
+		s, c = bits.Add(s, c2, 0)
+		t[n-1] = big.Word(s)
+		t[n] = big.Word(top + c)
+	}
+	// Subtract m and keep the difference unless it borrowed.
+	var b uint
+	for j := 0; j < n; j++ {
+		var d uint
+		d, b = bits.Sub(uint(t[j]), uint(m[j]), b)
+		z[j] = big.Word(d)
+	}
+	_, b = bits.Sub(uint(t[n]), 0, b)
+	mask := big.Word(-b) // all ones if t < m
+	for j := 0; j < n; j++ {
+		z[j] = (z[j] &^ mask) | (t[j] & mask)
+	}
+}
+
+// toMont returns x*R mod m. x must be in [0, m).
+func (mod *modulus) toMont(x *big.Int, t []big.Word) []big.Word {
+	z := toWords(x, len(mod.m))
+	mod.mul(z, z, mod.rr, t)
+	return z
+}
+
+// fromMont returns x*R^-1 mod m as a big.Int.
+func (mod *modulus) fromMont(x, t []big.Word) *big.Int {
+	one := make([]big.Word, len(mod.m))
+	one[0] = 1
+	z := make([]big.Word, len(mod.m))
+	mod.mul(z, x, one, t)
+	return toInt(z)
+}
+
+// selectWords sets z to table[idx] without branching on idx or accessing memory
+// that depends on it.
+func selectWords(z []big.Word, table [][]big.Word, idx uint) {
+	for j := range z {
+		z[j] = 0
+	}
+	for i, entry := range table {
+		// mask is all ones if i == idx and zero otherwise.
+		d := uint(i) ^ idx
+		mask := big.Word((d|-d)>>(bits.UintSize-1)) - 1
+		for j := range z {
+			z[j] |= entry[j] & mask
+		}
+	}
+}
+
+// exp returns x^e mod m. The time taken only depends on the sizes of m and of
+// the exponent width, which is the size of m: e must be in [0, 2^bits(m)).
+// x must be in [0, m).
+func (mod *modulus) exp(x, e *big.Int) *big.Int {
+	n := len(mod.m)
+	t := make([]big.Word, n+1)
+	table := make([][]big.Word, 1<<ctWindow)
+	table[0] = append([]big.Word(nil), mod.one...)
+	table[1] = mod.toMont(x, t)
+	for i := 2; i < len(table); i++ {
+		table[i] = make([]big.Word, n)
+		mod.mul(table[i], table[i-1], table[1], t)
+	}
+	ew := toWords(e, n)
+	z := append([]big.Word(nil), mod.one...)
+	sel := make([]big.Word, n)
+	windows := (mod.bits + ctWindow - 1) / ctWindow
+	for w := windows - 1; w >= 0; w-- {
+		for k := 0; k < ctWindow; k++ {
+			mod.mul(z, z, z, t)
+		}
+		selectWords(sel, table, wordsWindow(ew, w*ctWindow, ctWindow))
+		mod.mul(z, z, sel, t)
+	}
+	return mod.fromMont(z, t)
+}
+
+// wordsWindow returns bits [start, start+width) of the little-endian words w.
+// Bits beyond the last word are zero.
+func wordsWindow(w []big.Word, start, width int) uint {
+	i, s := start/bits.UintSize, uint(start%bits.UintSize)
+	d := uint(w[i]) >> s
+	if s+uint(width) > bits.UintSize && i+1 < len(w) {
+		d |= uint(w[i+1]) << (bits.UintSize - s)
+	}
+	return d & (1<<uint(width) - 1)
+}
+
+// Exp returns x^e mod p in constant time with respect to the values of x and
+// e: the running time only depends on the size of p. It should be used
+// whenever e is secret. x must be in [0, p) and e in [0, 2^bits(p)), otherwise
+// Exp panics.
+func (g Group) Exp(x, e *big.Int) *big.Int {
+	if x.Sign() < 0 || x.Cmp(g.P) >= 0 || e.Sign() < 0 || e.BitLen() > g.P.BitLen() {
+		panic("dh: Exp argument out of range")
+	}
+	return newModulus(g.P).exp(x, e)
+}
+
+// InverseScalar returns x^-1 mod q in constant time with respect to x, where q
+// = (p-1)/2 is the order of the subgroup. It's computed as x^(q-2) mod q, which
+// requires that q is prime. x must be in [1, q).
+func (g Group) InverseScalar(x *big.Int) *big.Int {
+	q := g.Order()
+	e := new(big.Int).Sub(q, big.NewInt(2))
+	return newModulus(q).exp(x, e)
+}
@@ -5,12 +5,16 @@
 //
 
 // Package dh contains functions to perform a Diffie-Hellman key exchange over
-// the group Z^*_p for a prime p.
+// the group Z^*_p for a safe prime p = 2q+1. Keys, hashed values and validated
+// elements all live in the subgroup of order q, i.e., the quadratic residues
+// mod p. Exponentiations with secret exponents (GeneratePublicKey,
+// SharedSecret, Exp and ExpG) run in constant time.
 package dh
 
 import (
-	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"io"
 	"math"
 	"math/big"
 )
@@ -24,18 +28,6 @@ type Group struct {
 	P *big.Int
 }
 
-// Rfc3526_2048 is the 2048-bit MODP Group from RFC 3526.
-var Rfc3526_2048 Group
-
-func init() {
-	p, ok := new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
-	if !ok {
-		panic("big.Int SetString failed")
-	}
-	g := new(big.Int).SetInt64(2)
-	Rfc3526_2048 = Group{G: g, P: p}
-}
-
 // Bytes returns the absolute value of x as a big-endian byte slice. The length
 // of the slice is padded with zeros so that the length of the returned slice is
 // always the same for a given group.
@@ -69,6 +61,22 @@ func (g Group) IsInSmallSubgroup(x *big.Int) bool {
 	return false
 }
 
+// IsInSubgroup returns true if x is in the subgroup of order q of Z^*_p, i.e.,
+// if x is a quadratic residue mod p. It's checked with the Legendre symbol
+// (x|p), which is 1 exactly for the quadratic residues.
+//
+// Precondition: p is a safe prime and x is in Z^*_p.
+func (g Group) IsInSubgroup(x *big.Int) bool {
+	return big.Jacobi(x, g.P) == 1
+}
+
+// Order returns q = (p-1)/2, the order of the subgroup generated by G.
+//
+// Precondition: p is a safe prime and G is a quadratic residue mod p.
+func (g Group) Order() *big.Int {
+	return new(big.Int).Rsh(g.P, 1)
+}
+
 // IsInGroup returns true if x is in the group Z^*_p and false otherwise.
 func (g Group) IsInGroup(x *big.Int) bool {
 	if big.NewInt(0).Cmp(x) != -1 || x.Cmp(g.P) != -1 {
@@ -77,25 +85,94 @@ func (g Group) IsInGroup(x *big.Int) bool {
 	return true
 }
 
+// HashToGroup is an implementation of the H' hash function from the OPAQUE
+// I-D. It hashes msg to an element of the subgroup of order q: msg is expanded
+// with ExpandMessageXMD to 128 bits more than the size of p, reduced mod p and
+// squared. dst is a domain separation tag, which should be unique for each
+// use of HashToGroup.
+func (g Group) HashToGroup(msg, dst []byte) *big.Int {
+	x := g.hashToInt(msg, dst, g.P)
+	return x.Exp(x, big.NewInt(2), g.P)
+}
+
+// HashToScalar hashes msg to an integer in [0, q) in the same way as
+// HashToGroup.
+func (g Group) HashToScalar(msg, dst []byte) *big.Int {
+	return g.hashToInt(msg, dst, g.Order())
+}
+
+func (g Group) hashToInt(msg, dst []byte, mod *big.Int) *big.Int {
+	n := (mod.BitLen()+7)/8 + 16
+	buf, err := ExpandMessageXMD(msg, dst, n)
+	if err != nil {
+		panic(err)
+	}
+	x := new(big.Int).SetBytes(buf)
+	return x.Mod(x, mod)
+}
+
+// ExpandMessageXMD is expand_message_xmd from RFC 9380 with SHA-256. It
+// returns n pseudorandom bytes derived from msg and the domain separation tag
+// dst.
+func ExpandMessageXMD(msg, dst []byte, n int) ([]byte, error) {
+	const bInBytes = sha256.Size
+	const sInBytes = sha256.BlockSize
+	ell := (n + bInBytes - 1) / bInBytes
+	if ell > 255 || n > 65535 || len(dst) > 255 {
+		return nil, errors.New("expand_message_xmd: invalid length")
+	}
+	dstPrime := append(append([]byte{}, dst...), byte(len(dst)))
+	h := sha256.New()
+	h.Write(make([]byte, sInBytes))
+	h.Write(msg)
+	h.Write([]byte{byte(n >> 8), byte(n), 0})
+	h.Write(dstPrime)
+	b0 := h.Sum(nil)
+
+	out := make([]byte, 0, ell*bInBytes)
+	bi := make([]byte, bInBytes)
+	for i := 1; i <= ell; i++ {
+		// b_1 = H(b_0 || 1 || DST'), b_i = H((b_0 xor b_(i-1)) || i || DST')
+		for j := range bi {
+			bi[j] ^= b0[j]
+		}
+		h.Reset()
+		h.Write(bi)
+		h.Write([]byte{byte(i)})
+		h.Write(dstPrime)
+		bi = h.Sum(bi[:0])
+		out = append(out, bi...)
+	}
+	return out[:n], nil
+}
+
 // GeneratePrivateKey generates a private key to be used in a Diffie-Hellman key
-// exchange in the group g.
-func (g Group) GeneratePrivateKey() (*big.Int, error) {
+// exchange in the group g. The key is uniformly distributed in [1, q) and all
+// randomness is read from rand, so a deterministic rand gives a deterministic
+// key. (crypto/rand.Int isn't used since it ignores its reader as of Go
+// 1.26.)
+func (g Group) GeneratePrivateKey(rand io.Reader) (*big.Int, error) {
+	q := g.Order()
+	bitLen := q.BitLen()
+	buf := make([]byte, (bitLen+7)/8)
 	for {
-		key, err := rand.Int(rand.Reader, g.P)
-		if err != nil {
+		if _, err := io.ReadFull(rand, buf); err != nil {
 			return nil, err
 		}
-		if key.Sign() != 0 {
+		// Clear the bits above the size of q and retry if the key isn't
+		// in [1, q), which happens with probability at most 1/2.
+		buf[0] &= byte(0xff >> uint(len(buf)*8-bitLen))
+		key := new(big.Int).SetBytes(buf)
+		if key.Sign() != 0 && key.Cmp(q) < 0 {
 			return key, nil
 		}
 	}
 }
 
 // GeneratePublicKey creates a public key which corresponds to the private key
-// privKey.
+// privKey. It's computed with ExpG.
 func (g Group) GeneratePublicKey(privKey *big.Int) *big.Int {
-	ret := new(big.Int)
-	return ret.Exp(g.G, privKey, g.P)
+	return g.ExpG(privKey)
 }
 
 // SharedSecret returns a byte slice which is the secret shared between two
@@ -105,10 +182,12 @@ func (g Group) GeneratePublicKey(privKey *big.Int) *big.Int {
 // pub1 and pub2 are public keys created using GeneratePublicKey from priv1 and
 // priv2, respectively, then the byte slices returned by SharedSecret(priv1,
 // pub2) and SharedSecret(priv2, pub1) are identical.
+//
+// The exponentiation is done in constant time with Exp and the shared element
+// is hashed in its fixed-width encoding.
 func (g Group) SharedSecret(privKey *big.Int, otherPubKey *big.Int) []byte {
-	s := new(big.Int)
-	s.Exp(otherPubKey, privKey, g.P)
+	s := g.Exp(otherPubKey, privKey)
 	h := sha256.New()
-	h.Write(s.Bytes())
+	h.Write(g.Bytes(s))
 	return h.Sum(nil)
 }
@@ -7,6 +7,10 @@ package dh
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
 	"math/big"
 	"testing"
 
@@ -15,13 +19,13 @@ import (
 
 func TestDh(t *testing.T) {
 	g := Rfc3526_2048
-	privA, err := g.GeneratePrivateKey()
+	privA, err := g.GeneratePrivateKey(rand.Reader)
 	if err != nil {
 		panic(err)
 	}
 	pubA := g.GeneratePublicKey(privA)
 
-	privB, err := g.GeneratePrivateKey()
+	privB, err := g.GeneratePrivateKey(rand.Reader)
 	if err != nil {
 		panic(err)
 	}
@@ -118,3 +122,382 @@ func TestIsInGroup(t *testing.T) {
 		}
 	}
 }
+
+func TestIsInSubgroup(t *testing.T) {
+	g := Group{G: big.NewInt(4), P: big.NewInt(11)}
+	// The quadratic residues mod 11.
+	for _, x := range []int64{1, 3, 4, 5, 9} {
+		if !g.IsInSubgroup(big.NewInt(x)) {
+			t.Fatalf("%v unexpectedly not in subgroup", x)
+		}
+	}
+	for _, x := range []int64{2, 6, 7, 8, 10} {
+		if g.IsInSubgroup(big.NewInt(x)) {
+			t.Fatalf("%v unexpectedly in subgroup", x)
+		}
+	}
+	if !Rfc3526_2048.IsInSubgroup(Rfc3526_2048.G) {
+		t.Fatalf("Generator not in subgroup")
+	}
+}
+
+// Test vectors from RFC 9380, Appendix K.1.
+func TestExpandMessageXMD(t *testing.T) {
+	dst := []byte("QUUX-V01-CS02-with-expander-SHA256-128")
+	for _, tst := range []struct {
+		msg string
+		n   int
+		out string
+	}{
+		{"", 0x20, "68a985b87eb6b46952128911f2a4412bbc302a9d759667f87f7a21d803f07235"},
+		{"abc", 0x20, "d8ccab23b5985ccea865c6c97b6e5b8350e794e603b4b97902f53a8a0d605615"},
+	} {
+		out, err := ExpandMessageXMD([]byte(tst.msg), dst, tst.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(out) != tst.out {
+			t.Fatalf("msg %q: got %x", tst.msg, out)
+		}
+	}
+}
+
+func TestHashToGroup(t *testing.T) {
+	g := Rfc3526_2048
+	x := g.HashToGroup([]byte("msg"), []byte("dst"))
+	if !g.IsInSubgroup(x) || g.IsInSmallSubgroup(x) {
+		t.Fatalf("Hash not in subgroup")
+	}
+	if x.Cmp(g.HashToGroup([]byte("msg"), []byte("dst"))) != 0 {
+		t.Fatalf("HashToGroup isn't deterministic")
+	}
+	if x.Cmp(g.HashToGroup([]byte("msg"), []byte("other dst"))) == 0 {
+		t.Fatalf("Hash didn't change with dst")
+	}
+	if g.HashToScalar([]byte("msg"), []byte("dst")).Cmp(g.Order()) >= 0 {
+		t.Fatalf("Scalar not reduced mod q")
+	}
+	priv, err := g.GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priv.Cmp(g.Order()) >= 0 || !g.IsInSubgroup(g.GeneratePublicKey(priv)) {
+		t.Fatalf("Private key not in [1, q)")
+	}
+}
+
+func TestNamedGroups(t *testing.T) {
+	for name, g := range Groups {
+		if g.P.BitLen() <= 3072 {
+			if _, err := NewGroup(g.P, g.G); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			continue
+		}
+		// NewGroup is slow for the larger groups, so only the Baillie-PSW
+		// test is used for them.
+		q := g.Order()
+		if !g.P.ProbablyPrime(0) || !q.ProbablyPrime(0) || !g.IsInSubgroup(g.G) {
+			t.Fatalf("%v is not a safe prime group", name)
+		}
+	}
+	if Groups["modp2048"].P.Cmp(Rfc3526_2048.P) != 0 || Groups["ffdhe8192"].P.BitLen() != 8192 {
+		t.Fatalf("Groups doesn't match the named groups")
+	}
+}
+
+func TestNewGroup(t *testing.T) {
+	p := Rfc3526_3072.P
+	pm1 := new(big.Int).Sub(p, big.NewInt(1))
+	for _, tst := range []struct {
+		p, g *big.Int
+		err  string
+	}{
+		{p, big.NewInt(2), ""},
+		{p, big.NewInt(4), ""},
+		{p, big.NewInt(1), "g doesn't generate the subgroup of order q"},
+		{p, pm1, "g doesn't generate the subgroup of order q"},
+		{p, p, "g doesn't generate the subgroup of order q"},
+		// -1 is a non-residue as p = 3 mod 4, so -2 is one too.
+		{p, new(big.Int).Sub(p, big.NewInt(2)), "g doesn't generate the subgroup of order q"},
+		{pm1, big.NewInt(2), "p is not a safe prime"},
+		{new(big.Int).Add(p, big.NewInt(2)), big.NewInt(2), "p is not a safe prime"},
+		{big.NewInt(23), big.NewInt(2), "p is too small"},
+		{nil, big.NewInt(2), "missing group parameters"},
+	} {
+		_, err := NewGroup(tst.p, tst.g)
+		if tst.err == "" && err != nil {
+			t.Fatalf("g=%v: %v", tst.g, err)
+		}
+		if tst.err != "" && (err == nil || err.Error() != tst.err) {
+			t.Fatalf("g=%v: got %v, expected %v", tst.g, err, tst.err)
+		}
+	}
+}
+
+func TestParseGroup(t *testing.T) {
+	der, err := asn1.Marshal(dhParameter{P: Ffdhe2048.P, G: Ffdhe2048.G})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := ParseGroup(pem.EncodeToMemory(&pem.Block{Type: "DH PARAMETERS", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.P.Cmp(Ffdhe2048.P) != 0 || g.G.Cmp(Ffdhe2048.G) != 0 {
+		t.Fatalf("Wrong group")
+	}
+	if _, err := ParseGroup(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})); err == nil {
+		t.Fatalf("Wrong PEM type accepted")
+	}
+	der, err = asn1.Marshal(dhParameter{P: Ffdhe2048.P, G: big.NewInt(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseGroup(pem.EncodeToMemory(&pem.Block{Type: "DH PARAMETERS", Bytes: der})); err == nil {
+		t.Fatalf("Invalid generator accepted")
+	}
+}
+
+func TestExpG(t *testing.T) {
+	for _, g := range []Group{Rfc3526_2048, {G: big.NewInt(2), P: big.NewInt(23)}} {
+		if g.P.BitLen() < 100 {
+			registerFixedBase(g)
+		}
+		maxExp := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(g.P.BitLen())), big.NewInt(1))
+		for _, e := range []*big.Int{big.NewInt(0), big.NewInt(1), big.NewInt(31), big.NewInt(32), g.Order(), g.P, maxExp} {
+			if e.BitLen() > g.P.BitLen() {
+				if !panics(func() { g.ExpG(e) }) {
+					t.Fatalf("p=%v e=%v: ExpG didn't panic", g.P.BitLen(), e)
+				}
+				continue
+			}
+			expected := new(big.Int).Exp(g.G, e, g.P)
+			if g.ExpG(e).Cmp(expected) != 0 {
+				t.Fatalf("p=%v e=%v: wrong result", g.P.BitLen(), e)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			e, err := g.GeneratePrivateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g.ExpG(e).Cmp(new(big.Int).Exp(g.G, e, g.P)) != 0 {
+				t.Fatalf("Wrong result for %v", e)
+			}
+		}
+	}
+}
+
+func TestMultiExp(t *testing.T) {
+	g := Rfc3526_2048
+	for _, n := range []int{0, 1, 2, 3, 4, 7} {
+		var bases, exps []*big.Int
+		expected := big.NewInt(1)
+		for i := 0; i < n; i++ {
+			b := g.HashToGroup([]byte{byte(i)}, []byte("dst"))
+			e, err := g.GeneratePrivateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 1 {
+				e = big.NewInt(1)
+			}
+			bases = append(bases, b)
+			exps = append(exps, e)
+			expected.Mul(expected, new(big.Int).Exp(b, e, g.P))
+			expected.Mod(expected, g.P)
+		}
+		if g.MultiExp(bases, exps).Cmp(expected) != 0 {
+			t.Fatalf("n=%v: wrong result", n)
+		}
+	}
+}
+
+func BenchmarkExp(b *testing.B) {
+	g := Rfc3526_2048
+	e, err := g.GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		new(big.Int).Exp(g.G, e, g.P)
+	}
+}
+
+func BenchmarkExpG(b *testing.B) {
+	g := Rfc3526_2048
+	e, err := g.GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	g.ExpG(e)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.ExpG(e)
+	}
+}
+
+func benchmarkMultiExp(b *testing.B, n int, multi bool) {
+	g := Rfc3526_2048
+	var bases, exps []*big.Int
+	for i := 0; i < n; i++ {
+		e, err := g.GeneratePrivateKey(rand.Reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bases = append(bases, g.HashToGroup([]byte{byte(i)}, []byte("dst")))
+		exps = append(exps, e)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if multi {
+			g.MultiExp(bases, exps)
+			continue
+		}
+		z := big.NewInt(1)
+		for j := range bases {
+			z.Mul(z, new(big.Int).Exp(bases[j], exps[j], g.P))
+			z.Mod(z, g.P)
+		}
+	}
+}
+
+func BenchmarkSeparateExp10(b *testing.B) { benchmarkMultiExp(b, 10, false) }
+func BenchmarkMultiExp10(b *testing.B)    { benchmarkMultiExp(b, 10, true) }
+
+func TestFixedBaseTables(t *testing.T) {
+	if Rfc3526_2048.table() == nil {
+		t.Fatalf("No table for a named group")
+	}
+	// Groups with other generators, e.g., in CPace, don't get a table.
+	g := Group{G: Rfc3526_2048.HashToGroup([]byte("password"), []byte("dst")), P: Rfc3526_2048.P}
+	g.ExpG(big.NewInt(12345))
+	if g.table() != nil {
+		t.Fatalf("Table built for an unregistered group")
+	}
+}
+
+func TestExp(t *testing.T) {
+	// 2^127-1 is a prime whose top word isn't full.
+	m127 := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 127), big.NewInt(1))
+	for _, g := range []Group{Rfc3526_2048, {G: big.NewInt(3), P: m127}, {G: big.NewInt(2), P: big.NewInt(23)}} {
+		pm1 := new(big.Int).Sub(g.P, big.NewInt(1))
+		maxExp := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(g.P.BitLen())), big.NewInt(1))
+		values := []*big.Int{big.NewInt(0), big.NewInt(1), big.NewInt(2), pm1}
+		for i := 0; i < 5; i++ {
+			x, err := rand.Int(rand.Reader, g.P)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, x)
+		}
+		for _, x := range values {
+			for _, e := range []*big.Int{big.NewInt(0), big.NewInt(1), big.NewInt(16), g.Order(), pm1, maxExp, x} {
+				expected := new(big.Int).Exp(x, e, g.P)
+				if g.Exp(x, e).Cmp(expected) != 0 {
+					t.Fatalf("p=%v x=%v e=%v: wrong result", g.P.BitLen(), x, e)
+				}
+			}
+		}
+		if !g.Order().ProbablyPrime(20) {
+			continue
+		}
+		x, err := g.GeneratePrivateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		one := new(big.Int).Mul(x, g.InverseScalar(x))
+		if one.Mod(one, g.Order()).Cmp(big.NewInt(1)) != 0 {
+			t.Fatalf("p=%v: wrong inverse", g.P.BitLen())
+		}
+	}
+}
+
+// TestExpMuls checks that modulus.exp does the same number of multiplications
+// for all exponents, including exponents with leading zero bits, and that Exp
+// rejects out-of-range arguments instead of falling back to big.Int.Exp. Unlike
+// the timing test in package oprf it's deterministic.
+func TestExpMuls(t *testing.T) {
+	g := Rfc3526_2048
+	mod := newModulus(g.P)
+	mod.muls = new(int)
+	windows := (g.P.BitLen() + ctWindow - 1) / ctWindow
+	// toMont and the table, one squaring per bit and one multiplication per
+	// window, and fromMont.
+	expected := 1 + (1<<ctWindow - 2) + windows*(ctWindow+1) + 1
+	pm1 := new(big.Int).Sub(g.P, big.NewInt(1))
+	maxExp := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(g.P.BitLen())), big.NewInt(1))
+	x, err := g.GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []*big.Int{big.NewInt(0), big.NewInt(1), big.NewInt(16), g.Order(), pm1, maxExp, x} {
+		*mod.muls = 0
+		mod.exp(g.G, e)
+		if *mod.muls != expected {
+			t.Fatalf("e=%v: %d multiplications, expected %d", e, *mod.muls, expected)
+		}
+	}
+
+	for _, tc := range []struct {
+		x, e *big.Int
+	}{
+		{big.NewInt(-1), big.NewInt(1)},
+		{g.P, big.NewInt(1)},
+		{g.G, big.NewInt(-1)},
+		{g.G, new(big.Int).Lsh(big.NewInt(1), uint(g.P.BitLen()))},
+	} {
+		if !panics(func() { g.Exp(tc.x, tc.e) }) {
+			t.Errorf("x=%v e=%v: Exp didn't panic", tc.x, tc.e)
+		}
+	}
+}
+
+func panics(f func()) (panicked bool) {
+	defer func() {
+		panicked = recover() != nil
+	}()
+	f()
+	return false
+}
+
+func BenchmarkConstantTimeExp(b *testing.B) {
+	g := Rfc3526_2048
+	e, err := g.GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.Exp(g.G, e)
+	}
+}
+
+func TestGeneratePrivateKeyReader(t *testing.T) {
+	g := Rfc3526_2048
+	seed := bytes.Repeat([]byte{0x5a}, 512)
+	k1, err := g.GeneratePrivateKey(bytes.NewReader(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := g.GeneratePrivateKey(bytes.NewReader(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.Cmp(k2) != 0 {
+		t.Fatalf("Keys from the same reader differ")
+	}
+	// 0xff... is larger than q, so the first 256 bytes are rejected.
+	k3, err := g.GeneratePrivateKey(bytes.NewReader(append(bytes.Repeat([]byte{0xff}, 256), seed...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k3.Cmp(k1) != 0 {
+		t.Fatalf("Rejected value not skipped")
+	}
+	if _, err := g.GeneratePrivateKey(bytes.NewReader(seed[:10])); err == nil {
+		t.Fatalf("Short read not reported")
+	}
+}
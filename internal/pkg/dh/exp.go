@@ -0,0 +1,194 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package dh
+
+// This file contains faster exponentiation for the common cases in the
+// protocols: powers of the generator, which use a precomputed table, and
+// products of powers, which share the squarings between the bases.
+//
+// Powers of the generator are computed in constant time with the arithmetic in
+// ct.go, since the exponents are private keys. MultiExp is only used with
+// public exponents. It uses big.Int, and a multiplication there (Mul followed
+// by Mod) costs about twice as much as a step of big.Int.Exp, which uses
+// Montgomery multiplication internally. MultiExp is therefore only faster when
+// it saves more than half of the multiplications.
+
+import (
+	"math/big"
+	"sync"
+)
+
+const (
+	// fixedBaseWindow is the window size, in bits, of the fixed-base tables.
+	fixedBaseWindow = 5
+
+	// maxFixedBaseBits is the size of the largest p for which a fixed-base
+	// table is built. The table for a 3072-bit group is about 7.5 MB.
+	maxFixedBaseBits = 3072
+
+	// multiExpWindow is the window size, in bits, used by MultiExp.
+	multiExpWindow = 4
+
+	// minMultiExp is the smallest number of long exponents for which MultiExp
+	// uses Straus' algorithm. For fewer exponents separate Exps are faster.
+	minMultiExp = 4
+)
+
+// fixedBaseTable holds rows[i][j] = g^(j*2^(w*i)) mod p, in Montgomery form,
+// for w = fixedBaseWindow. An exponent e is then computed with one
+// multiplication per window of e and no squarings.
+type fixedBaseTable struct {
+	once sync.Once
+	mod  *modulus
+	rows [][][]big.Word
+}
+
+// fixedBaseTables maps a group's [2]*big.Int{G, P} to its *fixedBaseTable.
+// Only the named groups and groups returned by NewGroup have an entry, as other
+// groups, e.g., the one in CPace whose generator is derived from the password,
+// are often used for a single exponentiation. Tables are built on first use
+// and kept for the lifetime of the program.
+var fixedBaseTables sync.Map
+
+// registerFixedBase makes ExpG use a fixed-base table for g.
+func registerFixedBase(g Group) {
+	if g.P.BitLen() <= maxFixedBaseBits {
+		fixedBaseTables.LoadOrStore([2]*big.Int{g.G, g.P}, &fixedBaseTable{})
+	}
+}
+
+// table returns the fixed-base table for g, or nil if g has none.
+func (g Group) table() *fixedBaseTable {
+	v, ok := fixedBaseTables.Load([2]*big.Int{g.G, g.P})
+	if !ok {
+		return nil
+	}
+	t := v.(*fixedBaseTable)
+	t.once.Do(func() {
+		t.mod = newModulus(g.P)
+		scratch := make([]big.Word, len(t.mod.m)+1)
+		windows := (g.P.BitLen() + fixedBaseWindow - 1) / fixedBaseWindow
+		base := new(big.Int).Set(g.G)
+		t.rows = make([][][]big.Word, windows)
+		for i := range t.rows {
+			row := make([][]big.Word, 1<<fixedBaseWindow)
+			x := big.NewInt(1)
+			for j := range row {
+				row[j] = t.mod.toMont(x, scratch)
+				x = mulMod(x, base, g.P)
+			}
+			t.rows[i] = row
+			base = x
+		}
+	})
+	return t
+}
+
+// ExpG returns G^e mod p in constant time with respect to e. For the named
+// groups and groups returned by NewGroup a precomputed table is used, which is
+// built the first time ExpG is called for the group. For groups larger than
+// 3072 bits and other groups, ExpG is computed with Exp. e must be in [0,
+// 2^bits(p)), otherwise ExpG panics.
+func (g Group) ExpG(e *big.Int) *big.Int {
+	t := g.table()
+	if t == nil || e.Sign() < 0 || e.BitLen() > g.P.BitLen() {
+		return g.Exp(g.G, e)
+	}
+	n := len(t.mod.m)
+	scratch := make([]big.Word, n+1)
+	ew := toWords(e, n)
+	z := append([]big.Word(nil), t.mod.one...)
+	sel := make([]big.Word, n)
+	for i, row := range t.rows {
+		selectWords(sel, row, wordsWindow(ew, i*fixedBaseWindow, fixedBaseWindow))
+		t.mod.mul(z, z, sel, scratch)
+	}
+	return t.mod.fromMont(z, scratch)
+}
+
+// MultiExp returns the product of bases[i]^exps[i] mod p. The exponents must
+// be non-negative. MultiExp isn't constant time and must only be used with
+// public exponents.
+//
+// Bases with short exponents (e.g., 1) cost a few multiplications each. If at
+// least four exponents remain, they are computed with Straus' algorithm, where
+// all bases share the same squarings; otherwise each of them is computed with
+// big.Int.Exp.
+func (g Group) MultiExp(bases, exps []*big.Int) *big.Int {
+	if len(bases) != len(exps) {
+		panic("dh: MultiExp with different number of bases and exponents")
+	}
+	z := big.NewInt(1)
+	var longBases, longExps []*big.Int
+	for i := range bases {
+		if exps[i].BitLen() <= 2*multiExpWindow {
+			z.Mul(z, new(big.Int).Exp(bases[i], exps[i], g.P))
+			z.Mod(z, g.P)
+			continue
+		}
+		longBases = append(longBases, bases[i])
+		longExps = append(longExps, exps[i])
+	}
+	if len(longBases) < minMultiExp {
+		for i := range longBases {
+			z.Mul(z, new(big.Int).Exp(longBases[i], longExps[i], g.P))
+			z.Mod(z, g.P)
+		}
+		return z
+	}
+	return mulMod(z, g.straus(longBases, longExps), g.P)
+}
+
+// straus computes the product of bases[i]^exps[i] mod p with Straus'
+// algorithm: the exponents are processed one window at a time from the most
+// significant end and the accumulator is squared once per bit for all bases
+// together.
+func (g Group) straus(bases, exps []*big.Int) *big.Int {
+	tables := make([][]*big.Int, len(bases))
+	bits := 0
+	for i, b := range bases {
+		tables[i] = make([]*big.Int, 1<<multiExpWindow)
+		tables[i][0] = big.NewInt(1)
+		tables[i][1] = new(big.Int).Mod(b, g.P)
+		for j := 2; j < len(tables[i]); j++ {
+			tables[i][j] = mulMod(tables[i][j-1], tables[i][1], g.P)
+		}
+		if exps[i].BitLen() > bits {
+			bits = exps[i].BitLen()
+		}
+	}
+	windows := (bits + multiExpWindow - 1) / multiExpWindow
+	z := big.NewInt(1)
+	for w := windows - 1; w >= 0; w-- {
+		if w != windows-1 {
+			for k := 0; k < multiExpWindow; k++ {
+				z.Mul(z, z)
+				z.Mod(z, g.P)
+			}
+		}
+		for i := range bases {
+			if d := window(exps[i], w*multiExpWindow, multiExpWindow); d != 0 {
+				z.Mul(z, tables[i][d])
+				z.Mod(z, g.P)
+			}
+		}
+	}
+	return z
+}
+
+// window returns bits [start, start+width) of e as an integer.
+func window(e *big.Int, start, width int) uint {
+	var d uint
+	for k := width - 1; k >= 0; k-- {
+		d = d<<1 | e.Bit(start+k)
+	}
+	return d
+}
+
+func mulMod(x, y, p *big.Int) *big.Int {
+	z := new(big.Int).Mul(x, y)
+	return z.Mod(z, p)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// Package drbg implements a deterministic random bit generator, HMAC_DRBG with
+// SHA-256 from NIST SP 800-90A. Given the same seed it always produces the
+// same output, which makes runs of the protocols in package opaque
+// reproducible when it's passed to opaque.SetRandom.
+//
+// It's only meant for known-answer tests and for reproducing failures. It's
+// never reseeded and anyone who knows the seed can predict all its output.
+package drbg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"sync"
+)
+
+// maxRequest is the largest number of bytes produced by a single generate
+// call, the limit in SP 800-90A. Larger reads are split into several calls.
+const maxRequest = 1 << 16
+
+// Reader is an HMAC_DRBG. It is safe to use a Reader from multiple goroutines,
+// but the output is then only reproducible if the order of the reads is.
+type Reader struct {
+	mu   sync.Mutex
+	k, v []byte
+}
+
+// New returns a Reader instantiated with seed, which is used as the seed
+// material, i.e., entropy input, nonce and personalization string
+// concatenated.
+func New(seed []byte) *Reader {
+	r := &Reader{
+		k: make([]byte, sha256.Size),
+		v: make([]byte, sha256.Size),
+	}
+	for i := range r.v {
+		r.v[i] = 1
+	}
+	r.update(seed)
+	return r
+}
+
+// update is the HMAC_DRBG update function.
+func (r *Reader) update(data []byte) {
+	for _, b := range []byte{0, 1} {
+		m := hmac.New(sha256.New, r.k)
+		m.Write(r.v)
+		m.Write([]byte{b})
+		m.Write(data)
+		r.k = m.Sum(r.k[:0])
+		m = hmac.New(sha256.New, r.k)
+		m.Write(r.v)
+		r.v = m.Sum(r.v[:0])
+		if len(data) == 0 {
+			return
+		}
+	}
+}
+
+// generate fills out, which must be at most maxRequest bytes, with the next
+// output of the generator.
+func (r *Reader) generate(out []byte) {
+	m := hmac.New(sha256.New, r.k)
+	for len(out) > 0 {
+		m.Reset()
+		m.Write(r.v)
+		r.v = m.Sum(r.v[:0])
+		out = out[copy(out, r.v):]
+	}
+	r.update(nil)
+}
+
+// Read fills p with output from the generator. It never fails.
+//
+// The standard library's crypto packages read one byte, or not, at random from
+// readers other than crypto/rand (see randutil.MaybeReadByte), so their output
+// isn't reproducible with a Reader alone. Use IgnoreMaybeReadByte for each call
+// into them.
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for out := p; len(out) > 0; {
+		n := len(out)
+		if n > maxRequest {
+			n = maxRequest
+		}
+		r.generate(out[:n])
+		out = out[n:]
+	}
+	return len(p), nil
+}
+
+// IgnoreMaybeReadByte returns a reader for a single call into the standard
+// library's crypto packages, such as rsa.GenerateKey or rsa.SignPSS, which
+// makes the call read the same bytes from r whether or not it reads one byte
+// at random first (see randutil.MaybeReadByte). If the first read is of a
+// single byte, it's answered with a zero byte without reading from r; the
+// byte is discarded by randutil. All other reads are passed on to r.
+//
+// Together with GODEBUG=cryptocustomrand=1, without which crypto/rsa ignores
+// the reader it's given as of Go 1.26, this makes RSA keys and signatures
+// reproducible with a Reader.
+func IgnoreMaybeReadByte(r io.Reader) io.Reader {
+	return &maybeByteReader{r: r}
+}
+
+type maybeByteReader struct {
+	r       io.Reader
+	started bool
+}
+
+func (m *maybeByteReader) Read(p []byte) (int, error) {
+	if !m.started {
+		m.started = true
+		if len(p) == 1 {
+			p[0] = 0
+			return 1, nil
+		}
+	}
+	return m.r.Read(p)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package drbg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustDecode(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// TestVector checks the first HMAC_DRBG SHA-256 vector from NIST's CAVP
+// (no prediction resistance, no personalization string or additional input),
+// where the output of the second of two generate calls is returned.
+func TestVector(t *testing.T) {
+	entropy := mustDecode("ca851911349384bffe89de1cbdc46e6831e44d34a4fb935ee285dd14b71a7488")
+	nonce := mustDecode("659ba96c601dc69fc902940805ec0ca8")
+	expected := mustDecode("e528e9abf2dece54d47c7e75e5fe302149f817ea9fb4bee6f4199697d04d5b89" +
+		"d54fbb978a15b5c443c9ec21036d2460b6f73ebad0dc2aba6e624abf07745bc1" +
+		"07694bb7547bb0995f70de25d6b29e2d3011bb19d27676c07162c8b5ccde0668" +
+		"961df86803482cb37ed6d5c0bb8d50cf1f50d476aa0458bdaba806f48be9dcb8")
+	r := New(append(entropy, nonce...))
+	out := make([]byte, len(expected))
+	r.Read(out)
+	r.Read(out)
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("Got %x, expected %x", out, expected)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	a, b, c := New([]byte("seed")), New([]byte("seed")), New([]byte("other seed"))
+	for _, n := range []int{0, 7, 32, 100, maxRequest + 5} {
+		x, y, z := make([]byte, n), make([]byte, n), make([]byte, n)
+		a.Read(x)
+		b.Read(y)
+		c.Read(z)
+		if !bytes.Equal(x, y) {
+			t.Fatalf("n = %d: same seed gave different output", n)
+		}
+		if n > 0 && bytes.Equal(x, z) {
+			t.Fatalf("n = %d: different seeds gave the same output", n)
+		}
+	}
+}
+
+func TestSingleByte(t *testing.T) {
+	// Single-byte reads advance the generator.
+	a, b := New([]byte("seed")), New([]byte("seed"))
+	seen := map[byte]bool{}
+	one := make([]byte, 1)
+	for i := 0; i < 32; i++ {
+		a.Read(one)
+		seen[one[0]] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("Single-byte reads returned the same byte")
+	}
+	x, y := make([]byte, 64), make([]byte, 64)
+	a.Read(x)
+	b.Read(y)
+	if bytes.Equal(x, y) {
+		t.Fatal("Single-byte reads didn't change the output")
+	}
+}
+
+func TestIgnoreMaybeReadByte(t *testing.T) {
+	x, y, z := make([]byte, 64), make([]byte, 64), make([]byte, 64)
+	New([]byte("seed")).Read(x)
+
+	// A single-byte first read doesn't read from the generator.
+	r := IgnoreMaybeReadByte(New([]byte("seed")))
+	one := make([]byte, 1)
+	r.Read(one)
+	r.Read(y)
+	if !bytes.Equal(x, y) {
+		t.Fatal("Single-byte first read changed the output")
+	}
+
+	// Later single-byte reads are consumed.
+	r = IgnoreMaybeReadByte(New([]byte("seed")))
+	r.Read(z[:10])
+	r.Read(one)
+	r.Read(z[10:])
+	if !bytes.Equal(x[:10], z[:10]) || bytes.Equal(x[10:], z[10:]) {
+		t.Fatal("Later single-byte read wasn't consumed")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// Package legacy contains functions to verify passwords against password hashes
+// created by traditional password storage schemes. It's used to migrate users
+// from such a scheme to OPAQUE.
+//
+// Two hash formats are supported:
+//
+//	bcrypt:  $2a$10$... (also $2b$ and $2y$)
+//	PBKDF2:  pbkdf2-sha256$<iterations>$<base64 salt>$<base64 hash>
+//
+// "pbkdf2-sha1" and "pbkdf2-sha512" can be used instead of "pbkdf2-sha256" in
+// the PBKDF2 format. Base64 is the standard encoding without padding.
+package legacy
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Mismatch is returned by Verify if the password doesn't match the hash.
+var Mismatch = fmt.Errorf("Legacy password mismatch")
+
+// Verify checks password against the legacy password hash encoded. A nil error
+// is returned if the password matches. Mismatch is returned if the password
+// doesn't match and some other error is returned if encoded can't be parsed.
+func Verify(encoded, password string) error {
+	if strings.HasPrefix(encoded, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return Mismatch
+		}
+		return err
+	}
+	if strings.HasPrefix(encoded, "pbkdf2-") {
+		return verifyPbkdf2(encoded, password)
+	}
+	return fmt.Errorf("Unknown legacy hash format")
+}
+
+// Pbkdf2 encodes a PBKDF2-SHA256 hash of password in the format understood by
+// Verify.
+func Pbkdf2(password string, salt []byte, iter int) string {
+	dk := pbkdf2.Key([]byte(password), salt, iter, sha256.Size, sha256.New)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", iter,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(dk))
+}
+
+func verifyPbkdf2(encoded, password string) error {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 {
+		return fmt.Errorf("Malformed PBKDF2 hash")
+	}
+	var h func() hash.Hash
+	switch parts[0] {
+	case "pbkdf2-sha1":
+		h = sha1.New
+	case "pbkdf2-sha256":
+		h = sha256.New
+	case "pbkdf2-sha512":
+		h = sha512.New
+	default:
+		return fmt.Errorf("Unknown PBKDF2 hash function: %s", parts[0])
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return fmt.Errorf("Malformed PBKDF2 iteration count")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return err
+	}
+	if len(expected) == 0 {
+		return fmt.Errorf("Malformed PBKDF2 hash")
+	}
+	dk := pbkdf2.Key([]byte(password), salt, iter, len(expected), h)
+	if subtle.ConstantTimeCompare(dk, expected) != 1 {
+		return Mismatch
+	}
+	return nil
+}
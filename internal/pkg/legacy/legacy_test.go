@@ -0,0 +1,49 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package legacy
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerify(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, tst := range []struct {
+		encoded  string
+		password string
+		err      error
+	}{
+		{string(bcryptHash), "password", nil},
+		{string(bcryptHash), "wrong", Mismatch},
+		{Pbkdf2("password", []byte("salt"), 1000), "password", nil},
+		{Pbkdf2("password", []byte("salt"), 1000), "wrong", Mismatch},
+		// Test vector from RFC 6070.
+		{"pbkdf2-sha1$4096$c2FsdA$SwB5AbdlSJq+rUnZJvch0GWkKcE", "password", nil},
+		{"pbkdf2-sha1$4096$c2FsdA$SwB5AbdlSJq+rUnZJvch0GWkKcE", "wrong", Mismatch},
+	} {
+		if err := Verify(tst.encoded, tst.password); err != tst.err {
+			t.Fatalf("Test %d: got %v, expected %v", idx, err, tst.err)
+		}
+	}
+
+	for idx, encoded := range []string{
+		"",
+		"md5$abc",
+		"pbkdf2-sha256$1000$c2FsdA",
+		"pbkdf2-md5$1000$c2FsdA$c2FsdA",
+		"pbkdf2-sha256$zero$c2FsdA$c2FsdA",
+		"pbkdf2-sha256$1000$c2FsdA$",
+	} {
+		if err := Verify(encoded, "password"); err == nil || err == Mismatch {
+			t.Fatalf("Test %d: got %v, expected parse error", idx, err)
+		}
+	}
+}
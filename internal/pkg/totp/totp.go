@@ -0,0 +1,74 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// Package totp implements time-based one-time passwords as described in RFC
+// 6238 (TOTP), which builds on RFC 4226 (HOTP). The parameters are the ones
+// used by common authenticator apps: HMAC-SHA1, a time step of 30 seconds and
+// codes with six digits.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Step is the length of a time step.
+const Step = 30 * time.Second
+
+// Digits is the number of digits in a code.
+const Digits = 6
+
+// Skew is the number of time steps before and after the current one for which
+// Verify accepts codes, to allow for clock drift.
+const Skew = 1
+
+// Counter returns the time step which t belongs to.
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Step/time.Second)
+}
+
+// Code returns the code for secret at time t.
+func Code(secret []byte, t time.Time) string {
+	return hotp(secret, Counter(t), Digits)
+}
+
+// Verify checks code against secret at time t. Codes from time steps up to and
+// including lastStep are rejected, so that a code can't be used twice. On
+// success the time step of the code is returned together with true; it should
+// be passed as lastStep the next time Verify is called for the same secret.
+func Verify(secret []byte, code string, t time.Time, lastStep int64) (int64, bool) {
+	now := Counter(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, step, Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// hotp computes the HOTP value from RFC 4226 with the given number of digits.
+func hotp(secret []byte, counter int64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, see section 5.3 in RFC 4226.
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
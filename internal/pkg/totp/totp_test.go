@@ -0,0 +1,62 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHotp(t *testing.T) {
+	// Test vectors from appendix B in RFC 6238 (SHA-1).
+	secret := []byte("12345678901234567890")
+	for idx, tst := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		code := hotp(secret, Counter(time.Unix(tst.unix, 0)), 8)
+		if code != tst.code {
+			t.Errorf("%d: got %s, expected %s", idx, code, tst.code)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	code := Code(secret, now)
+	if code != "050471" {
+		t.Fatalf("Unexpected code %s", code)
+	}
+	step, ok := Verify(secret, code, now, 0)
+	if !ok || step != Counter(now) {
+		t.Fatalf("Verify failed")
+	}
+	// Codes can't be reused.
+	if _, ok := Verify(secret, code, now, step); ok {
+		t.Fatalf("Code accepted twice")
+	}
+	// Clock drift of one step is accepted, but not more.
+	if _, ok := Verify(secret, code, now.Add(Step), 0); !ok {
+		t.Fatalf("Code from previous step rejected")
+	}
+	if _, ok := Verify(secret, code, now.Add(2*Step), 0); ok {
+		t.Fatalf("Code from two steps ago accepted")
+	}
+	if _, ok := Verify(secret, "000000", now, 0); ok {
+		t.Fatalf("Wrong code accepted")
+	}
+	if _, ok := Verify([]byte("other secret"), code, now, 0); ok {
+		t.Fatalf("Code accepted for other secret")
+	}
+}
@@ -9,10 +9,13 @@ package util
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 
+	"github.com/frekui/opaque"
 	"github.com/frekui/opaque/internal/pkg/authenc"
 )
 
@@ -27,6 +30,8 @@ func Write(w *bufio.Writer, data []byte) error {
 	return nil
 }
 
+// Read reads a line from r. If the line contains an alert (see WriteAlert) the
+// error corresponding to the alert is returned.
 func Read(r *bufio.Reader) ([]byte, error) {
 	fmt.Print("< ")
 	data, err := r.ReadBytes('\n')
@@ -34,7 +39,60 @@ func Read(r *bufio.Reader) ([]byte, error) {
 		return nil, err
 	}
 	fmt.Print(string(data))
-	return data[:len(data)-1], nil
+	data = data[:len(data)-1]
+	if bytes.HasPrefix(data, []byte(`{"Alert":`)) {
+		var msg alertMsg
+		if err := json.Unmarshal(data, &msg); err == nil && msg.Alert != nil {
+			return nil, msg.Alert.Err()
+		}
+	}
+	return data, nil
+}
+
+// alertMsg is used to send an opaque.Alert. A line with an alertMsg can be
+// sent in place of any other line.
+type alertMsg struct {
+	Alert *opaque.Alert
+}
+
+// WriteAlert sends the alert corresponding to err (see opaque.NewAlert) to the
+// peer. Any error while writing is ignored as the connection is about to be
+// closed anyway.
+func WriteAlert(w *bufio.Writer, err error) {
+	alert := opaque.NewAlert(err)
+	data, err := json.Marshal(alertMsg{Alert: &alert})
+	if err != nil {
+		return
+	}
+	Write(w, data)
+}
+
+// WriteMsg serializes msg as JSON and writes it to w.
+func WriteMsg(w *bufio.Writer, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return Write(w, data)
+}
+
+// ReadMsg reads a line from r and deserializes it into msg. An error wrapping
+// opaque.ErrMalformedMessage is returned if the line can't be deserialized.
+func ReadMsg(r *bufio.Reader, msg interface{}) error {
+	data, err := Read(r)
+	if err != nil {
+		return err
+	}
+	return UnmarshalMsg(data, msg)
+}
+
+// UnmarshalMsg deserializes data into msg. An error wrapping
+// opaque.ErrMalformedMessage is returned if data can't be deserialized.
+func UnmarshalMsg(data []byte, msg interface{}) error {
+	if err := json.Unmarshal(data, msg); err != nil {
+		return fmt.Errorf("%w: %s", opaque.ErrMalformedMessage, err)
+	}
+	return nil
 }
 
 func EncryptAndWrite(w *bufio.Writer, key []byte, plaintext string) error {
@@ -67,3 +125,23 @@ func ReadAndDecrypt(r *bufio.Reader, key []byte) (string, error) {
 	}
 	return string(plaintext), nil
 }
+
+// EncryptAndWriteMsg serializes msg as JSON, encrypts it with key, and writes it
+// to w.
+func EncryptAndWriteMsg(w *bufio.Writer, key []byte, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return EncryptAndWrite(w, key, string(data))
+}
+
+// ReadAndDecryptMsg reads a message written by EncryptAndWriteMsg and
+// deserializes it into msg.
+func ReadAndDecryptMsg(r *bufio.Reader, key []byte, msg interface{}) error {
+	plaintext, err := ReadAndDecrypt(r, key)
+	if err != nil {
+		return err
+	}
+	return UnmarshalMsg([]byte(plaintext), msg)
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains a pool of precomputed ephemeral D-H key pairs for the
+// server. Generating y and g^y is one of the expensive steps of Auth1, and it
+// doesn't depend on the client's message, so it can be done ahead of time in
+// the background. Under a burst of logins the pool is drained and Auth1 falls
+// back to generating the key pair itself, so the pool lowers the latency of
+// logins in a burst without ever delaying one.
+//
+// If another random source has been set with SetRandom, the pool is instead
+// filled once when it's created and never refilled. The source is then only
+// read by the caller's goroutine, which keeps a DRBG deterministic and doesn't
+// require the source to be safe for concurrent use.
+//
+// The RSA-PSS signature in AuthMsg2 covers the client's D-H public key, so no
+// part of it can be precomputed.
+
+import (
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyPool precomputes ephemeral D-H key pairs for Auth1WithKeyPool and
+// Auth1ImplicitWithKeyPool in a background goroutine. Each key pair is used for
+// a single login. It is safe to use a KeyPool from multiple goroutines.
+type KeyPool struct {
+	keys     chan dhKeyPair
+	interval time.Duration
+	misses   uint64 // accessed atomically
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type dhKeyPair struct {
+	priv *big.Int
+	pub  *big.Int
+}
+
+// NewKeyPool starts a KeyPool which holds at most size key pairs and generates
+// at most rate key pairs per second when refilling. A rate of zero means that
+// the pool is refilled as fast as possible. Close must be called to stop the
+// background goroutine.
+//
+// If SetRandom has been called with a non-nil reader, NewKeyPool fills the pool
+// before it returns and no background goroutine is started.
+func NewKeyPool(size int, rate float64) *KeyPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &KeyPool{
+		keys: make(chan dhKeyPair, size),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+	if isCustomRandom() {
+		p.fillOnce()
+		return p
+	}
+	go p.fill()
+	return p
+}
+
+// fillOnce fills the pool in the caller's goroutine. If the random source
+// fails the pool is left partly filled.
+func (p *KeyPool) fillOnce() {
+	defer close(p.done)
+	for len(p.keys) < cap(p.keys) {
+		pair, err := newDhKeyPair()
+		if err != nil {
+			return
+		}
+		p.keys <- pair
+	}
+}
+
+// fill generates key pairs until the pool is closed. It blocks while the pool
+// is full.
+func (p *KeyPool) fill() {
+	defer close(p.done)
+	var limit <-chan time.Time
+	if p.interval > 0 {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+	for {
+		pair, err := newDhKeyPair()
+		if err != nil {
+			// The random source failed. Try again later; Auth1 reports
+			// the error if it persists.
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-p.stop:
+				return
+			}
+		}
+		select {
+		case p.keys <- pair:
+		case <-p.stop:
+			return
+		}
+		if limit != nil {
+			select {
+			case <-limit:
+			case <-p.stop:
+				return
+			}
+		}
+	}
+}
+
+// Close stops the background goroutine and discards the precomputed key pairs.
+// Auth1WithKeyPool can still be used with a closed pool, in which case it
+// generates the key pairs itself.
+func (p *KeyPool) Close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+	for {
+		select {
+		case <-p.keys:
+		default:
+			return
+		}
+	}
+}
+
+// Len returns the number of precomputed key pairs in the pool.
+func (p *KeyPool) Len() int {
+	return len(p.keys)
+}
+
+// Misses returns the number of times a key pair was needed when the pool was
+// empty. If it grows during normal load the pool is too small or its rate too
+// low.
+func (p *KeyPool) Misses() uint64 {
+	return atomic.LoadUint64(&p.misses)
+}
+
+// ephemeralKey returns a key pair from pool, or a newly generated key pair if
+// pool is nil or empty.
+func ephemeralKey(pool *KeyPool) (dhKeyPair, error) {
+	if pool != nil {
+		select {
+		case pair := <-pool.keys:
+			return pair, nil
+		default:
+			atomic.AddUint64(&pool.misses, 1)
+		}
+	}
+	return newDhKeyPair()
+}
+
+func newDhKeyPair() (dhKeyPair, error) {
+	priv, err := dhGroup.GeneratePrivateKey(randr)
+	if err != nil {
+		return dhKeyPair{}, err
+	}
+	return dhKeyPair{priv: priv, pub: dhGroup.GeneratePublicKey(priv)}, nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/frekui/opaque/internal/pkg/drbg"
+)
+
+// waitForKeys waits until pool holds n key pairs.
+func waitForKeys(t *testing.T, pool *KeyPool, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for pool.Len() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pool has %d key pairs, expected %d", pool.Len(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeyPool(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewKeyPool(2, 0)
+	defer pool.Close()
+	waitForKeys(t, pool, 2)
+
+	// The pool is never filled beyond its size.
+	time.Sleep(50 * time.Millisecond)
+	if pool.Len() != 2 {
+		t.Fatalf("Pool has %d key pairs, expected 2", pool.Len())
+	}
+
+	var pubs [][]byte
+	for i := 0; i < 3; i++ {
+		cSess, msg1, err := AuthInit("user", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sSess *AuthServerSession
+		var msg2 AuthMsg2
+		var sSecret []byte
+		if i == 2 {
+			sSess, msg2, sSecret, err = Auth1ImplicitWithKeyPool(privS, pool, user, msg1)
+		} else {
+			sSess, msg2, err = Auth1WithKeyPool(privS, pool, user, msg1, false)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cSecret, msg3, err := Auth2(cSess, msg2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 2 {
+			if sSecret, err = Auth3(sSess, msg3); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(cSecret, sSecret) {
+			t.Fatalf("Shared secrets differ")
+		}
+		for _, pub := range pubs {
+			if bytes.Equal(pub, msg2.DhPubServer.Bytes()) {
+				t.Fatalf("Key pair used twice")
+			}
+		}
+		pubs = append(pubs, msg2.DhPubServer.Bytes())
+	}
+
+	// After a burst the pool is refilled.
+	waitForKeys(t, pool, 2)
+
+	// Key pairs are generated on the fly after the pool is closed.
+	pool.Close()
+	if pool.Len() != 0 {
+		t.Fatalf("Closed pool has %d key pairs", pool.Len())
+	}
+	misses := pool.Misses()
+	_, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Auth1WithKeyPool(privS, pool, user, msg1, false); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Misses() != misses+1 {
+		t.Fatalf("Miss not counted")
+	}
+}
+
+func TestKeyPoolRate(t *testing.T) {
+	pool := NewKeyPool(100, 10)
+	defer pool.Close()
+	time.Sleep(300 * time.Millisecond)
+	// One key pair right away and then at most one each 100 ms.
+	if n := pool.Len(); n > 5 {
+		t.Fatalf("Pool refilled too fast: %d key pairs", n)
+	}
+}
+
+// poolKeys creates a pool with randomness from a DRBG seeded with seed and
+// returns the public keys of its key pairs.
+func poolKeys(t *testing.T, seed string) [][]byte {
+	SetRandom(drbg.New([]byte(seed)))
+	defer SetRandom(nil)
+	pool := NewKeyPool(3, 0)
+	defer pool.Close()
+	// The pool is filled before NewKeyPool returns.
+	if pool.Len() != 3 {
+		t.Fatalf("Pool has %d key pairs, expected 3", pool.Len())
+	}
+	var pubs [][]byte
+	for i := 0; i < 3; i++ {
+		pair, err := ephemeralKey(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs = append(pubs, pair.pub.Bytes())
+	}
+	if pool.Misses() != 0 {
+		t.Fatalf("Pool missed %d times", pool.Misses())
+	}
+	return pubs
+}
+
+func TestKeyPoolCustomRandom(t *testing.T) {
+	a := poolKeys(t, "seed")
+	b := poolKeys(t, "seed")
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			t.Fatalf("Key pair %d differs between runs with the same seed", i)
+		}
+	}
+}
+
+func BenchmarkAuth1WithKeyPool(b *testing.B) {
+	privS, user := benchmarkUser(b)
+	_, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		b.Fatal(err)
+	}
+	pool := NewKeyPool(b.N, 0)
+	defer pool.Close()
+	for pool.Len() < b.N {
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := Auth1WithKeyPool(privS, pool, user, msg1, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains the lifecycle of user records. The User struct records
+// when it was created, when the password was last changed and when the user
+// last logged in, together with a counter of failed attempts and fields which
+// disable, lock or force a password change. Auth1 rejects logins for disabled
+// and locked users and tells the client when the password has to be changed
+// (see ChangePasswordInit). The fields are optional in serialized Users, so
+// records created before they were added are still valid.
+//
+// A failed Auth3 (or Confirm) counts as a failed attempt and a successful one
+// resets the counter. A wrong password is usually detected by the client, which
+// never sends AuthMsg3, so such attempts aren't counted: counting every Auth1
+// would let anybody lock a user out without knowing anything about the
+// password. Online guessing has to be limited by other means, e.g., puzzles
+// (see PuzzleIssuer). The server decides what to do when the counter grows,
+// e.g., lock the user by setting LockedUntil.
+//
+// Functions which change a user from an authenticated session, such as
+// AddDevice, don't modify the User given to Auth1. The change is recorded in
+// the session and UpdateUser applies it to the server's current record, so the
+// server can replace records under its own lock while other sessions read the
+// old ones.
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrUserDisabled is returned by Auth1 if the user is disabled.
+var ErrUserDisabled = errors.New("user is disabled")
+
+// ErrUserLocked is returned by Auth1 if the user is locked.
+var ErrUserLocked = errors.New("user is locked")
+
+// checkLogin is called by Auth1. It rejects logins for disabled and locked
+// users and returns true if the password must be changed.
+func (user *User) checkLogin(now time.Time) (passwordChange bool, err error) {
+	if user.Disabled {
+		return false, ErrUserDisabled
+	}
+	if now.Before(user.LockedUntil) {
+		return false, ErrUserLocked
+	}
+	expired := !user.PasswordExpires.IsZero() && !now.Before(user.PasswordExpires)
+	return user.MustChangePassword || expired, nil
+}
+
+// loginSucceeded is called when the client has been authenticated.
+func (sess *AuthServerSession) loginSucceeded() {
+	sess.authenticated = true
+	now := time.Now()
+	sess.updates = append(sess.updates, func(user *User) {
+		user.LastLogin = now
+		user.FailedAttempts = 0
+	})
+}
+
+// loginFailed is called when the client has failed to authenticate in Auth3 or
+// Confirm.
+func (sess *AuthServerSession) loginFailed() {
+	sess.updates = append(sess.updates, func(user *User) {
+		user.FailedAttempts++
+	})
+}
+
+// UpdateUser returns a copy of user with the changes made in sess applied. user
+// should be the server's current record for the user of sess, which may have
+// changed since Auth1 was called, and the server should store the result. Call
+// UpdateUser with the lock that protects the server's records held, so that
+// concurrent sessions don't overwrite each other's changes. Each change is only
+// applied by one call to UpdateUser, and the session continues with the
+// returned record.
+func (sess *AuthServerSession) UpdateUser(user *User) *User {
+	user = user.clone()
+	for _, update := range sess.updates {
+		update(user)
+	}
+	sess.updates = nil
+	sess.user = user
+	return user
+}
+
+// Username returns the name of the user of sess.
+func (sess *AuthServerSession) Username() string {
+	return sess.user.Username
+}
+
+// clone returns a copy of user which can be modified without affecting user.
+// Keys and byte slices are never modified in place, so they are shared.
+func (user *User) clone() *User {
+	c := *user
+	if user.DeviceEnvU != nil {
+		c.DeviceEnvU = make(map[string][]byte, len(user.DeviceEnvU))
+		for id, env := range user.DeviceEnvU {
+			c.DeviceEnvU[id] = env
+		}
+	}
+	if user.Credentials != nil {
+		c.Credentials = make(map[string]*Credential, len(user.Credentials))
+		for id, cred := range user.Credentials {
+			c.Credentials[id] = cred
+		}
+	}
+	c.HoneyEnvU = append([]*HoneyEnvelope(nil), user.HoneyEnvU...)
+	return &c
+}
+
+// PasswordChangeRequired returns true if the server asked the client to change
+// the password because it has expired or a change has been forced. It only
+// returns true after Auth2 has returned successfully, in which case the client
+// should call ChangePasswordInit.
+func (sess *AuthClientSession) PasswordChangeRequired() bool {
+	return sess.passwordChange
+}
+
+// PasswordChangeRequired returns true if Auth1 asked the client to change the
+// password. The server should not allow anything else than a password change
+// in such a session.
+func (sess *AuthServerSession) PasswordChangeRequired() bool {
+	return sess.passwordChange
+}
+
+// ChangePasswordInit is like UpgradeInit but the new record is created for
+// newPassword. The server handles it with Upgrade1 and Upgrade3 as an upgrade.
+func ChangePasswordInit(sess *AuthClientSession, newPassword string, bits int) (*PwRegClientSession, PwRegMsg1, error) {
+	if sess.env == nil {
+		return nil, PwRegMsg1{}, errors.New("authentication not completed")
+	}
+	regSess, msg1, err := PwRegInit(sess.username, newPassword, bits)
+	if err != nil {
+		return nil, PwRegMsg1{}, err
+	}
+	regSess.data = sess.env.data
+	return regSess, msg1, nil
+}
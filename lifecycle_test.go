@@ -0,0 +1,186 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Created.IsZero() || !user.PasswordChanged.Equal(user.Created) {
+		t.Fatalf("Created and PasswordChanged not set by PwReg3")
+	}
+
+	// A wrong password is detected by the client and isn't counted.
+	if _, _, err := authenticateDevice(privS, user, "wrong", "", nil); err == nil {
+		t.Fatalf("Auth with wrong password succeeded")
+	}
+	if user.FailedAttempts != 0 {
+		t.Fatalf("FailedAttempts %d after Auth1", user.FailedAttempts)
+	}
+
+	// Failed Auth3 calls are counted until the next successful login.
+	for i := 0; i < 2; i++ {
+		cSess, msg1, err := AuthInit("user", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sSess, msg2, err := Auth1(privS, user, msg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, msg3, err := Auth2(cSess, msg2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg3.DhMac[0] ^= 1
+		if _, err := Auth3(sSess, msg3); err == nil {
+			t.Fatalf("Auth3 succeeded with a bad MAC")
+		}
+		user = sSess.UpdateUser(user)
+	}
+	if user.FailedAttempts != 2 || !user.LastLogin.IsZero() {
+		t.Fatalf("FailedAttempts %d, LastLogin %v", user.FailedAttempts, user.LastLogin)
+	}
+	_, sSess, err := authenticateDevice(privS, user, "password", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FailedAttempts != 2 {
+		t.Fatalf("Auth3 modified the user of the session")
+	}
+	user = sSess.UpdateUser(user)
+	if user.FailedAttempts != 0 || user.LastLogin.IsZero() {
+		t.Fatalf("FailedAttempts %d, LastLogin %v", user.FailedAttempts, user.LastLogin)
+	}
+
+	// Disabled and locked users are rejected by Auth1.
+	user.Disabled = true
+	if _, _, err := authenticateDevice(privS, user, "password", "", nil); err == nil || err.Error() != "server: "+ErrUserDisabled.Error() {
+		t.Fatalf("Disabled user: got %v", err)
+	}
+	user.Disabled = false
+	user.LockedUntil = time.Now().Add(time.Hour)
+	if _, _, err := authenticateDevice(privS, user, "password", "", nil); err == nil || err.Error() != "server: "+ErrUserLocked.Error() {
+		t.Fatalf("Locked user: got %v", err)
+	}
+	user.LockedUntil = time.Now().Add(-time.Hour)
+	cSess, sSess, err := authenticateDevice(privS, user, "password", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cSess.PasswordChangeRequired() || sSess.PasswordChangeRequired() {
+		t.Fatalf("Password change required")
+	}
+
+	// An expired password must be changed.
+	totpSecret, err := EnableTOTP(sSess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user = sSess.UpdateUser(user)
+	user.PasswordExpires = time.Now().Add(-time.Minute)
+	cSess, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := msg2
+	tampered.PasswordChange = false
+	if _, _, err := Auth2(cSess, tampered); err == nil || err.Error() != "MAC mismatch" {
+		t.Fatalf("Tampered password change flag: got %v", err)
+	}
+	_, msg3, err := Auth2(cSess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AnswerSecondFactor(cSess, &msg3, TOTPCode(totpSecret)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Auth3(sSess, msg3); err != nil {
+		t.Fatal(err)
+	}
+	if !cSess.PasswordChangeRequired() || !sSess.PasswordChangeRequired() {
+		t.Fatalf("Password change not required")
+	}
+	regClient, pmsg1, err := ChangePasswordInit(cSess, "new password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regServer, pmsg2, err := Upgrade1(privS, sSess, pmsg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pmsg3, err := PwReg2(regClient, pmsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newUser := Upgrade3(sSess, regServer, pmsg3)
+	if newUser.MustChangePassword || !newUser.PasswordExpires.IsZero() || !newUser.PasswordChanged.After(user.PasswordChanged) {
+		t.Fatalf("Password change not recorded")
+	}
+	if !newUser.Created.Equal(user.Created) || string(newUser.TOTPSecret) != string(totpSecret) {
+		t.Fatalf("Metadata not carried over")
+	}
+	if _, _, err := authenticateDevice(privS, newUser, "password", "", nil); err == nil {
+		t.Fatalf("Old password still works")
+	}
+}
+
+func TestLifecycleCompat(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unset fields aren't serialized.
+	data, err := json.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"LastLogin", "FailedAttempts", "PasswordExpires", "MustChangePassword", "Disabled", "LockedUntil"} {
+		if strings.Contains(string(data), `"`+field+`"`) {
+			t.Errorf("%s serialized: %s", field, data)
+		}
+	}
+
+	// A User serialized before the metadata was added.
+	var old map[string]json.RawMessage
+	if err := json.Unmarshal(data, &old); err != nil {
+		t.Fatal(err)
+	}
+	delete(old, "Created")
+	delete(old, "PasswordChanged")
+	data, err = json.Marshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded User
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := authenticateDevice(privS, &decoded, "password", "", nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/rsa"
+	"sync/atomic"
+)
+
+// MigrateUser creates a User for username and password by running all steps of
+// the password registration protocol (PwRegInit, PwReg1, PwReg2, and PwReg3)
+// locally. It's intended for servers which migrate users from a traditional
+// password database: when a user logs in and the server has verified the
+// password against the legacy password hash, the server can call MigrateUser
+// and replace the legacy record with the returned User. The server must forget
+// the password afterwards.
+//
+// As the server learns the password this must only be done over a connection
+// which is authenticated and encrypted by other means (e.g., TLS).
+func MigrateUser(privS *rsa.PrivateKey, username, password string, bits int) (*User, error) {
+	clientSession, msg1, err := PwRegInit(username, password, bits)
+	if err != nil {
+		return nil, err
+	}
+	serverSession, msg2, err := PwReg1(privS, msg1)
+	if err != nil {
+		return nil, err
+	}
+	msg3, err := PwReg2(clientSession, msg2)
+	if err != nil {
+		return nil, err
+	}
+	return PwReg3(serverSession, msg3), nil
+}
+
+// Migrator migrates users with MigrateUser and counts the migrations. It is
+// safe to use a Migrator from multiple goroutines. The zero value is ready to
+// use.
+type Migrator struct {
+	migrated uint64 // accessed atomically
+}
+
+// Migrate creates a User with MigrateUser and passes it to replace, which must
+// atomically replace the user's legacy record with it, e.g., by checking with a
+// lock held that the legacy record is unchanged and that no other record for
+// username has been added since the legacy password was verified. The
+// migration is counted if replace returns nil; otherwise its error is
+// returned.
+func (m *Migrator) Migrate(privS *rsa.PrivateKey, username, password string, bits int, replace func(user *User) error) (*User, error) {
+	user, err := MigrateUser(privS, username, password, bits)
+	if err != nil {
+		return nil, err
+	}
+	if err := replace(user); err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&m.migrated, 1)
+	return user, nil
+}
+
+// Migrated returns the number of users migrated with Migrate.
+func (m *Migrator) Migrated() uint64 {
+	return atomic.LoadUint64(&m.migrated)
+}
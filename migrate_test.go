@@ -0,0 +1,61 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/rsa"
+	"errors"
+	"testing"
+)
+
+func TestMigrateUser(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "user" {
+		t.Fatalf("Unexpected username '%s'", user.Username)
+	}
+	if err := authenticate(privS, user, "password", nil, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate(privS, user, "wrong", nil, nil, nil, false); err == nil {
+		t.Fatal("Authentication with wrong password succeeded")
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Migrator
+	users := map[string]*User{}
+	replace := func(user *User) error {
+		if _, ok := users[user.Username]; ok {
+			return errors.New("user exists")
+		}
+		users[user.Username] = user
+		return nil
+	}
+	if _, err := m.Migrate(privS, "user", "password", 512, replace); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate(privS, users["user"], "password", nil, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	// A failed replacement isn't counted.
+	if _, err := m.Migrate(privS, "user", "password", 512, replace); err == nil || err.Error() != "user exists" {
+		t.Fatalf("Expected error 'user exists', got %v", err)
+	}
+	if m.Migrated() != 1 {
+		t.Fatalf("Migrated() = %d, expected 1", m.Migrated())
+	}
+}
@@ -0,0 +1,685 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// Package oprf implements DH-OPRF (Diffie-Hellman Oblivious Pseudorandom
+// Function) from the I-D
+// https://tools.ietf.org/html/draft-krawczyk-cfrg-opaque-00. It's the OPRF used
+// by package opaque, but it's useful on its own, e.g., for private set
+// membership tests or rate-limited token issuance.
+//
+// A client with input x and a server with key k compute F(k, x) such that the
+// server learns nothing about x and the client learns nothing about k besides
+// the output:
+//
+//	Client                           Server
+//	Blind(x)      BlindedElement ->  Key.Evaluate
+//	Finalize  <-  Evaluation
+//
+// A server that receives many blinded inputs for the same key can evaluate
+// them with Key.EvaluateBatch, which computes g^k only once and spreads the
+// work over all CPUs. All types which are sent between the peers or stored by
+// the server can be serialized with encoding/json.
+//
+// The package also implements a partially-oblivious PRF (POPRF) in the style
+// of RFC 9497. Here the server evaluates F(k, info, x) where info is public
+// metadata known to both peers, e.g., a tenant id or a key epoch. The server
+// derives the key (k + H(info))^-1 mod q from its key k, so outputs for
+// different infos are unrelated and a single key can serve many infos. The
+// POPRF uses the same Blind as the OPRF, but the server calls
+// Key.EvaluateWithInfo and the client calls FinalizeWithInfo.
+//
+// In the verifiable mode (VOPRF) the server also proves that it used the key
+// with a known public key, see Key.EvaluateBatchWithProof and VerifyBatch.
+//
+// The package level functions use the 2048-bit MODP group from RFC 3526. Other
+// groups are available as suites: the larger RFC 3526 groups, the ffdhe groups
+// from RFC 7919, and custom parameters loaded with NewSuite or ParseSuite, which
+// check that they form a safe prime group of sufficient size. As RFC 9497 only
+// defines elliptic curve suites, the outputs don't match that RFC or its test
+// vectors.
+package oprf
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"math/big"
+	"runtime"
+	"sync"
+
+	"github.com/frekui/opaque/internal/pkg/dh"
+)
+
+// This hash function is used as H from the I-D.
+func hasher() hash.Hash {
+	return sha256.New()
+}
+
+// randr is the source of randomness for keys, blinding and proofs. It reads
+// from randSrc.
+var randr io.Reader = sourceReader{}
+
+// randMu guards randSrc, which is set by SetRandom.
+var (
+	randMu  sync.RWMutex
+	randSrc = rand.Reader
+)
+
+type sourceReader struct{}
+
+func (sourceReader) Read(p []byte) (int, error) {
+	randMu.RLock()
+	r := randSrc
+	randMu.RUnlock()
+	return r.Read(p)
+}
+
+// lockedReader serializes the reads from r, which might not be safe for
+// concurrent use.
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (r *lockedReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Read(p)
+}
+
+// SetRandom sets the source of randomness used by the package. A nil r
+// restores the default, crypto/rand.Reader. A deterministic r, such as a DRBG
+// with a fixed seed, makes keys, blinded elements and proofs reproducible,
+// which is useful for known-answer tests; it must never be used otherwise.
+//
+// SetRandom may be called concurrently with other functions of the package,
+// and reads from r are serialized. The outputs are only reproducible if no
+// other goroutine reads from r at the same time, though.
+func SetRandom(r io.Reader) {
+	if r == nil {
+		r = rand.Reader
+	} else {
+		r = &lockedReader{r: r}
+	}
+	randMu.Lock()
+	randSrc = r
+	randMu.Unlock()
+}
+
+// maxInfoLen is the maximum length of the public metadata of the POPRF.
+const maxInfoLen = 1<<16 - 1
+
+// Suite is a group together with the domain separation tags used to hash to
+// it. Keys and client states belong to the suite they were created with, and
+// their JSON encoding records the suite's name.
+type Suite struct {
+	name  string
+	group dh.Group
+
+	// order is q = (p-1)/2, the order of the subgroup generated by g.
+	order *big.Int
+
+	// Domain separation tags for hashing to the group and to scalars.
+	hashToGroupDST  []byte
+	hashToScalarDST []byte
+	compositeDST    []byte
+}
+
+// The predefined suites. MODP2048 is the default suite, used by the package
+// level functions. It's named "MODP" as it was the only suite before the
+// others were added. Its outputs changed when HashToGroup was replaced, see
+// ProtocolVersion in package opaque.
+var (
+	MODP2048  = newSuite("MODP", dh.Rfc3526_2048)
+	MODP3072  = newSuite("MODP3072", dh.Rfc3526_3072)
+	MODP4096  = newSuite("MODP4096", dh.Rfc3526_4096)
+	FFDHE2048 = newSuite("FFDHE2048", dh.Ffdhe2048)
+	FFDHE3072 = newSuite("FFDHE3072", dh.Ffdhe3072)
+	FFDHE4096 = newSuite("FFDHE4096", dh.Ffdhe4096)
+	FFDHE6144 = newSuite("FFDHE6144", dh.Ffdhe6144)
+	FFDHE8192 = newSuite("FFDHE8192", dh.Ffdhe8192)
+)
+
+var defaultSuite = MODP2048
+
+// suites maps the names of all suites to the suites, so that keys and states
+// can be decoded from JSON. Custom suites are added by NewSuite and ParseSuite.
+var (
+	suitesMu sync.Mutex
+	suites   = map[string]*Suite{}
+)
+
+func init() {
+	for _, s := range []*Suite{MODP2048, MODP3072, MODP4096, FFDHE2048, FFDHE3072, FFDHE4096, FFDHE6144, FFDHE8192} {
+		suites[s.name] = s
+	}
+}
+
+// registerSuite adds s to suites. If a suite with the same name and group is
+// already registered, that suite is returned instead. Two different groups
+// can't share a name, as the name is used for domain separation.
+func registerSuite(s *Suite) (*Suite, error) {
+	suitesMu.Lock()
+	defer suitesMu.Unlock()
+	if old, ok := suites[s.name]; ok {
+		if old.group.P.Cmp(s.group.P) != 0 || old.group.G.Cmp(s.group.G) != 0 {
+			return nil, errors.New("suite name already in use")
+		}
+		return old, nil
+	}
+	suites[s.name] = s
+	return s, nil
+}
+
+// lookupSuite returns the suite with the given name. The empty name is the
+// default suite.
+func lookupSuite(name string) (*Suite, error) {
+	if name == "" {
+		return defaultSuite, nil
+	}
+	suitesMu.Lock()
+	defer suitesMu.Unlock()
+	s, ok := suites[name]
+	if !ok {
+		return nil, errors.New("unknown suite")
+	}
+	return s, nil
+}
+
+func newSuite(name string, group dh.Group) *Suite {
+	return &Suite{
+		name:            name,
+		group:           group,
+		order:           group.Order(),
+		hashToGroupDST:  []byte("HashToGroup-OPAQUE-" + name),
+		hashToScalarDST: []byte("HashToScalar-OPAQUE-" + name),
+		compositeDST:    []byte("Composite-OPAQUE-" + name),
+	}
+}
+
+// NewSuite returns a suite for custom group parameters: p must be a safe prime
+// of at least 2048 bits and g must generate the subgroup of order (p-1)/2. name
+// is used for domain separation and to identify the suite in JSON encoded keys
+// and states, so it must be unique for each group; NewSuite returns an error if
+// the name is already used by another group. A program which decodes keys or
+// states of a custom suite must create the suite first.
+func NewSuite(name string, p, g *big.Int) (*Suite, error) {
+	group, err := dh.NewGroup(p, g)
+	if err != nil {
+		return nil, err
+	}
+	return registerSuite(newSuite(name, group))
+}
+
+// ParseSuite is like NewSuite but it reads the group from PEM encoded "DH
+// PARAMETERS", e.g., created by openssl dhparam.
+func ParseSuite(name string, pemData []byte) (*Suite, error) {
+	group, err := dh.ParseGroup(pemData)
+	if err != nil {
+		return nil, err
+	}
+	return registerSuite(newSuite(name, group))
+}
+
+// Name returns the name of the suite.
+func (s *Suite) Name() string {
+	return s.name
+}
+
+// P returns the prime p of the suite's group.
+func (s *Suite) P() *big.Int {
+	return new(big.Int).Set(s.group.P)
+}
+
+// Key is the server's OPRF key.
+type Key struct {
+	// The secret key k.
+	K *big.Int
+
+	// V = g^k. It's sent to the client along with each evaluation.
+	V *big.Int
+
+	// suite is nil for keys of the default suite.
+	suite *Suite
+}
+
+// BlindedElement is the blinded input a = H'(x)*g^r. It's sent from the client
+// to the server.
+type BlindedElement struct {
+	A *big.Int
+}
+
+// Evaluation is the server's response to a BlindedElement: v = g^k and b =
+// a^k.
+type Evaluation struct {
+	V *big.Int
+	B *big.Int
+}
+
+// BatchEvaluation is the server's response to a batch of BlindedElements. B[i]
+// is the evaluation of the i'th element. V = g^k is shared by all of them.
+type BatchEvaluation struct {
+	V *big.Int
+	B []*big.Int
+}
+
+// State is the client's state between Blind and Finalize. It must be kept
+// secret; anyone who knows R can unblind the server's response.
+type State struct {
+	Input []byte
+	R     *big.Int
+
+	// suite is nil for states of the default suite.
+	suite *Suite
+}
+
+// GenerateKey generates a new random OPRF key in the default suite.
+func GenerateKey() (*Key, error) {
+	return defaultSuite.GenerateKey()
+}
+
+// GenerateKey generates a new random OPRF key in the suite s.
+func (s *Suite) GenerateKey() (*Key, error) {
+	k, err := s.group.GeneratePrivateKey(randr)
+	if err != nil {
+		return nil, err
+	}
+	return s.NewKey(k), nil
+}
+
+// NewKey returns the Key with secret k in the default suite, e.g., a key which
+// has been stored as a big.Int.
+func NewKey(k *big.Int) *Key {
+	return defaultSuite.NewKey(k)
+}
+
+// NewKey is like the package level NewKey but for the suite s.
+func (s *Suite) NewKey(k *big.Int) *Key {
+	key := &Key{K: k, V: s.group.GeneratePublicKey(k)}
+	if s != defaultSuite {
+		key.suite = s
+	}
+	return key
+}
+
+// Blind is the first step of the OPRF and is executed on the client. It
+// returns the client's state, to be passed to Finalize, and the blinded input
+// to send to the server.
+//
+// From the I-D:
+//
+//	Protocol for computing DH-OPRF, U with input x and S with input k:
+//	U: choose random r in [0..q-1], send a=H'(x)*g^r to S
+//
+// Blind uses the default suite. The server must use a key from the same suite
+// as the client.
+func Blind(input []byte) (*State, BlindedElement, error) {
+	return defaultSuite.Blind(input)
+}
+
+// Blind is like the package level Blind but for the suite s.
+func (s *Suite) Blind(input []byte) (*State, BlindedElement, error) {
+	var suite *Suite
+	if s != defaultSuite {
+		suite = s
+	}
+	hPrime := s.group.HashToGroup(input, s.hashToGroupDST)
+	for {
+		r, err := s.group.GeneratePrivateKey(randr)
+		if err != nil {
+			return nil, BlindedElement{}, err
+		}
+		a := s.group.GeneratePublicKey(r)
+		a.Mul(hPrime, a)
+		a.Mod(a, s.group.P)
+
+		// The probability that a is in a two element subgroup is
+		// extremely small, but in case it is we try again with a new r.
+		if !s.group.IsInSmallSubgroup(a) {
+			return &State{Input: input, R: r, suite: suite}, BlindedElement{A: a}, nil
+		}
+	}
+}
+
+// Evaluate is the second step of the OPRF and is executed on the server.
+//
+// From the I-D:
+//
+//	S: upon receiving a value a, respond with v=g^k and b=a^k
+func (key *Key) Evaluate(blinded BlindedElement) (Evaluation, error) {
+	b, err := key.params().evaluate(blinded.A, key.K)
+	if err != nil {
+		return Evaluation{}, err
+	}
+	return Evaluation{V: key.v(), B: b}, nil
+}
+
+// EvaluateWithInfo is like Evaluate but it evaluates the POPRF with the public
+// metadata info. The client must call FinalizeWithInfo with the same info.
+func (key *Key) EvaluateWithInfo(blinded BlindedElement, info []byte) (Evaluation, error) {
+	u, err := key.tweak(info)
+	if err != nil {
+		return Evaluation{}, err
+	}
+	s := key.params()
+	b, err := s.evaluate(blinded.A, u)
+	if err != nil {
+		return Evaluation{}, err
+	}
+	return Evaluation{V: s.group.GeneratePublicKey(u), B: b}, nil
+}
+
+// EvaluateBatch is like Evaluate but it evaluates all elements of blinded with
+// the same key. The elements are evaluated in parallel. If any element is
+// invalid an error is returned and no evaluation is done.
+func (key *Key) EvaluateBatch(blinded []BlindedElement) (BatchEvaluation, error) {
+	b, err := key.params().evaluateBatch(blinded, key.K)
+	if err != nil {
+		return BatchEvaluation{}, err
+	}
+	return BatchEvaluation{V: key.v(), B: b}, nil
+}
+
+// EvaluateBatchWithInfo is like EvaluateBatch but it evaluates the POPRF with
+// the public metadata info, which is the same for all elements.
+func (key *Key) EvaluateBatchWithInfo(blinded []BlindedElement, info []byte) (BatchEvaluation, error) {
+	u, err := key.tweak(info)
+	if err != nil {
+		return BatchEvaluation{}, err
+	}
+	s := key.params()
+	b, err := s.evaluateBatch(blinded, u)
+	if err != nil {
+		return BatchEvaluation{}, err
+	}
+	return BatchEvaluation{V: s.group.GeneratePublicKey(u), B: b}, nil
+}
+
+// Finalize is the third and final step of the OPRF and is executed on the
+// client. It returns the output of the OPRF for the input given to Blind.
+//
+// From the I-D:
+//
+//	U: upon receiving values b and v, set the PRF output to H(x, v, b*v^{-r})
+func Finalize(state *State, eval Evaluation) ([]byte, error) {
+	s := state.params()
+	if err := s.checkElement("v", eval.V); err != nil {
+		return nil, err
+	}
+	if err := s.checkElement("b", eval.B); err != nil {
+		return nil, err
+	}
+	return s.finalize(state, eval.V, eval.B, nil), nil
+}
+
+// FinalizeWithInfo is like Finalize but for an Evaluation created by
+// Key.EvaluateWithInfo. info must be the same as the server used.
+func FinalizeWithInfo(state *State, eval Evaluation, info []byte) ([]byte, error) {
+	out, err := FinalizeBatchWithInfo([]*State{state}, BatchEvaluation{V: eval.V, B: []*big.Int{eval.B}}, info)
+	if err != nil {
+		return nil, err
+	}
+	return out[0], nil
+}
+
+// FinalizeBatch is like Finalize but for a BatchEvaluation. states must be in
+// the same order as the BlindedElements given to EvaluateBatch.
+func FinalizeBatch(states []*State, eval BatchEvaluation) ([][]byte, error) {
+	return finalizeBatch(states, eval, nil)
+}
+
+// FinalizeBatchWithInfo is like FinalizeBatch but for a BatchEvaluation created
+// by Key.EvaluateBatchWithInfo.
+func FinalizeBatchWithInfo(states []*State, eval BatchEvaluation, info []byte) ([][]byte, error) {
+	if len(info) > maxInfoLen {
+		return nil, errors.New("info too long")
+	}
+	return finalizeBatch(states, eval, frame("Info", info))
+}
+
+// finalizeBatch unblinds and hashes the evaluations in eval. framedInfo is nil
+// for the OPRF. All states must belong to the same suite.
+func finalizeBatch(states []*State, eval BatchEvaluation, framedInfo []byte) ([][]byte, error) {
+	if len(states) != len(eval.B) {
+		return nil, errors.New("wrong number of evaluations")
+	}
+	s := defaultSuite
+	if len(states) > 0 {
+		s = states[0].params()
+	}
+	for _, state := range states {
+		if state.params() != s {
+			return nil, errors.New("states from different suites")
+		}
+	}
+	if err := s.checkElement("v", eval.V); err != nil {
+		return nil, err
+	}
+	for _, b := range eval.B {
+		if err := s.checkElement("b", b); err != nil {
+			return nil, err
+		}
+	}
+	out := make([][]byte, len(states))
+	parallel(len(states), func(i int) {
+		out[i] = s.finalize(states[i], eval.V, eval.B[i], framedInfo)
+	})
+	return out, nil
+}
+
+// keyJSON is the JSON encoding of a Key. Suite is the name of the key's suite
+// and is empty for the default suite, so keys of the default suite are encoded
+// as before suites were added.
+type keyJSON struct {
+	K     *big.Int
+	V     *big.Int
+	Suite string `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (key Key) MarshalJSON() ([]byte, error) {
+	var name string
+	if key.suite != nil {
+		name = key.suite.name
+	}
+	return json.Marshal(keyJSON{K: key.K, V: key.V, Suite: name})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It returns an error for unknown
+// suites.
+func (key *Key) UnmarshalJSON(data []byte) error {
+	var kj keyJSON
+	if err := json.Unmarshal(data, &kj); err != nil {
+		return err
+	}
+	s, err := lookupSuite(kj.Suite)
+	if err != nil {
+		return err
+	}
+	*key = Key{K: kj.K, V: kj.V}
+	if s != defaultSuite {
+		key.suite = s
+	}
+	return nil
+}
+
+// stateJSON is the JSON encoding of a State, see keyJSON.
+type stateJSON struct {
+	Input []byte
+	R     *big.Int
+	Suite string `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (state State) MarshalJSON() ([]byte, error) {
+	var name string
+	if state.suite != nil {
+		name = state.suite.name
+	}
+	return json.Marshal(stateJSON{Input: state.Input, R: state.R, Suite: name})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It returns an error for unknown
+// suites.
+func (state *State) UnmarshalJSON(data []byte) error {
+	var sj stateJSON
+	if err := json.Unmarshal(data, &sj); err != nil {
+		return err
+	}
+	s, err := lookupSuite(sj.Suite)
+	if err != nil {
+		return err
+	}
+	*state = State{Input: sj.Input, R: sj.R}
+	if s != defaultSuite {
+		state.suite = s
+	}
+	return nil
+}
+
+// params returns the suite of key.
+func (key *Key) params() *Suite {
+	if key.suite == nil {
+		return defaultSuite
+	}
+	return key.suite
+}
+
+// params returns the suite of state.
+func (state *State) params() *Suite {
+	if state.suite == nil {
+		return defaultSuite
+	}
+	return state.suite
+}
+
+// v returns a copy of g^k, computing it if the key was created without NewKey.
+// It's a copy so that callers which modify an evaluation don't change the key.
+func (key *Key) v() *big.Int {
+	s := key.params()
+	if key.V == nil {
+		return s.group.GeneratePublicKey(key.K)
+	}
+	return new(big.Int).Set(key.V)
+}
+
+// tweak returns the POPRF key for info, (k + H(info))^-1 mod q. As in RFC 9497
+// an error is returned if k + H(info) is zero, which happens with negligible
+// probability.
+func (key *Key) tweak(info []byte) (*big.Int, error) {
+	s := key.params()
+	if len(info) > maxInfoLen {
+		return nil, errors.New("info too long")
+	}
+	m := s.group.HashToScalar(frame("Info", info), s.hashToScalarDST)
+	t := m.Add(m, key.K)
+	t.Mod(t, s.order)
+	if t.Sign() == 0 {
+		return nil, errors.New("info can't be used with this key")
+	}
+	return s.group.InverseScalar(t), nil
+}
+
+func (s *Suite) evaluate(a, k *big.Int) (*big.Int, error) {
+	if err := s.checkElement("a", a); err != nil {
+		return nil, err
+	}
+	return s.group.Exp(a, k), nil
+}
+
+func (s *Suite) evaluateBatch(blinded []BlindedElement, k *big.Int) ([]*big.Int, error) {
+	for i := range blinded {
+		if err := s.checkElement("a", blinded[i].A); err != nil {
+			return nil, err
+		}
+	}
+	b := make([]*big.Int, len(blinded))
+	parallel(len(blinded), func(i int) {
+		b[i] = s.group.Exp(blinded[i].A, k)
+	})
+	return b, nil
+}
+
+// finalize computes H(x, v, b*v^{-r}). For the POPRF framedInfo is non-nil and
+// the input and info are hashed with a length prefix, to keep the two apart.
+func (s *Suite) finalize(state *State, v, b *big.Int, framedInfo []byte) []byte {
+	// v has order q, so v^{-r} = v^{q-r} and no inverse is needed. r is
+	// secret, so the exponentiation is done in constant time.
+	negR := new(big.Int).Sub(s.order, state.R)
+	negR.Mod(negR, s.order)
+	z := s.group.Exp(v, negR)
+	z.Mul(z, b)
+	z.Mod(z, s.group.P)
+	return s.outputHash(state.Input, framedInfo, v, z)
+}
+
+// outputHash computes the output H(x, v, z) where z = H'(x)^k.
+func (s *Suite) outputHash(input, framedInfo []byte, v, z *big.Int) []byte {
+	h := hasher()
+	if framedInfo == nil {
+		// FIXME: User iteration, see Section 3.4.
+		h.Write(input)
+	} else {
+		h.Write(frame("Input", input))
+		h.Write(framedInfo)
+	}
+	h.Write(s.group.Bytes(v))
+	h.Write(s.group.Bytes(z))
+	return h.Sum(nil)
+}
+
+// frame returns label || len(data) || data, with the length as two bytes
+// as in RFC 9497.
+func frame(label string, data []byte) []byte {
+	buf := make([]byte, len(label)+2, len(label)+2+len(data))
+	copy(buf, label)
+	binary.BigEndian.PutUint16(buf[len(label):], uint16(len(data)))
+	return append(buf, data...)
+}
+
+// checkElement checks that x, a received value, is a non-unit element in the
+// group. name is used in the error message.
+//
+// From the I-D: All received values (a, b, v) are checked to be non-unit
+// elements in G.
+func (s *Suite) checkElement(name string, x *big.Int) error {
+	// First check that x is in Z^*_p.
+	if x == nil || !s.group.IsInGroup(x) {
+		return errors.New(name + " is not in D-H group")
+	}
+	// Also check that x is not in a two element subgroup.
+	if s.group.IsInSmallSubgroup(x) {
+		return errors.New(name + " is in a small subgroup")
+	}
+	// Finally check that x is in the subgroup of order q. Together with
+	// the check above this means that x has order q.
+	if !s.group.IsInSubgroup(x) {
+		return errors.New(name + " is not in the prime-order subgroup")
+	}
+	return nil
+}
+
+// parallel calls f(i) for i in [0, n) using one goroutine per CPU.
+func parallel(n int, f func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				f(i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,436 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package oprf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	mathrand "math/rand"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// run runs the OPRF protocol on input x and key k.
+func run(x string, k int64) (a, r *big.Int, h []byte) {
+	// Blind is computed by the client.
+	state, blinded, err := Blind([]byte(x))
+	if err != nil {
+		panic(err)
+	}
+
+	// Evaluate is computed by the server.
+	eval, err := NewKey(big.NewInt(k)).Evaluate(blinded)
+	if err != nil {
+		panic(err)
+	}
+
+	// Finalize is computed by the client.
+	h, err = Finalize(state, eval)
+	if err != nil {
+		panic(err)
+	}
+	return blinded.A, state.R, h
+}
+
+func TestOprf(t *testing.T) {
+	rs := map[string]bool{}
+	as := map[string]bool{}
+	var hPrev []byte
+	iterations := 10
+	for i := 0; i < iterations; i++ {
+		a, r, h := run("password", 123)
+		aStr := a.String()
+		if as[aStr] {
+			t.Fatalf("Already seen a %v", aStr)
+		}
+		as[aStr] = true
+
+		rStr := r.String()
+		if rs[rStr] {
+			t.Fatalf("Already seen r %v", rStr)
+		}
+		rs[rStr] = true
+
+		if hPrev == nil {
+			hPrev = h
+		}
+		if diff := deep.Equal(h, hPrev); diff != nil {
+			t.Fatalf("diff: %v", diff)
+		}
+	}
+	if len(rs) < iterations {
+		t.Fatalf("rs too small")
+	}
+
+	_, _, hNewKey := run("password", 789)
+	if bytes.Equal(hPrev, hNewKey) {
+		t.Fatalf("hash didn't change with new key")
+	}
+	_, _, hNewInput := run("new", 123)
+	if bytes.Equal(hPrev, hNewInput) {
+		t.Fatalf("hash didn't change with new input")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []*State
+	var blinded []BlindedElement
+	for i := 0; i < 5; i++ {
+		state, b, err := Blind([]byte(fmt.Sprintf("input %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, state)
+		blinded = append(blinded, b)
+	}
+	eval, err := key.EvaluateBatch(blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Evaluations and keys survive a round trip through JSON.
+	var eval2 BatchEvaluation
+	if err := roundTrip(eval, &eval2); err != nil {
+		t.Fatal(err)
+	}
+	var key2 Key
+	if err := roundTrip(key, &key2); err != nil {
+		t.Fatal(err)
+	}
+	out, err := FinalizeBatch(states, eval2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, state := range states {
+		eval, err := key2.Evaluate(blinded[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := Finalize(state, eval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(h, out[i]) {
+			t.Fatalf("Batch output %d differs", i)
+		}
+	}
+
+	if _, err := FinalizeBatch(states[1:], eval); err == nil {
+		t.Fatalf("FinalizeBatch succeeded with too few states")
+	}
+	blinded[2].A = big.NewInt(1)
+	if _, err := key.EvaluateBatch(blinded); err == nil || err.Error() != "a is in a small subgroup" {
+		t.Fatalf("Invalid element: got %v", err)
+	}
+	// -4 is a quadratic non-residue as p = 3 mod 4.
+	blinded[2].A = new(big.Int).Sub(defaultSuite.group.P, big.NewInt(4))
+	if _, err := key.EvaluateBatch(blinded); err == nil || err.Error() != "a is not in the prime-order subgroup" {
+		t.Fatalf("Element outside subgroup: got %v", err)
+	}
+	blinded[2].A = nil
+	if _, err := key.EvaluateBatch(blinded); err == nil || err.Error() != "a is not in D-H group" {
+		t.Fatalf("Missing element: got %v", err)
+	}
+}
+
+func roundTrip(v, out interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// runWithInfo runs the POPRF protocol on input x and info with key.
+func runWithInfo(key *Key, x, info, clientInfo string) []byte {
+	state, blinded, err := Blind([]byte(x))
+	if err != nil {
+		panic(err)
+	}
+	eval, err := key.EvaluateWithInfo(blinded, []byte(info))
+	if err != nil {
+		panic(err)
+	}
+	h, err := FinalizeWithInfo(state, eval, []byte(clientInfo))
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+func TestPoprf(t *testing.T) {
+	key := NewKey(big.NewInt(123))
+	h := runWithInfo(key, "password", "epoch 1", "epoch 1")
+	if !bytes.Equal(h, runWithInfo(key, "password", "epoch 1", "epoch 1")) {
+		t.Fatalf("POPRF isn't deterministic")
+	}
+	if bytes.Equal(h, runWithInfo(key, "password", "epoch 2", "epoch 2")) {
+		t.Fatalf("hash didn't change with new info")
+	}
+	if bytes.Equal(h, runWithInfo(key, "password", "epoch 1", "epoch 2")) {
+		t.Fatalf("hash didn't change when the client used another info")
+	}
+	if bytes.Equal(h, runWithInfo(NewKey(big.NewInt(789)), "password", "epoch 1", "epoch 1")) {
+		t.Fatalf("hash didn't change with new key")
+	}
+	_, _, hOprf := run("password", 123)
+	if bytes.Equal(h, hOprf) || bytes.Equal(runWithInfo(key, "password", "", ""), hOprf) {
+		t.Fatalf("POPRF output equals OPRF output")
+	}
+
+	// Batches give the same output as single evaluations.
+	state, blinded, err := Blind([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eval, err := key.EvaluateBatchWithInfo([]BlindedElement{blinded}, []byte("epoch 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := FinalizeBatchWithInfo([]*State{state}, eval, []byte("epoch 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[0], h) {
+		t.Fatalf("Batch output differs")
+	}
+}
+
+func TestSuites(t *testing.T) {
+	if string(MODP2048.hashToGroupDST) != "HashToGroup-OPAQUE-MODP" {
+		t.Fatalf("The default suite changed")
+	}
+	for _, s := range []*Suite{MODP3072, FFDHE2048} {
+		// The secret is from the default suite, so that it's also a valid
+		// secret there.
+		defaultKey, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := s.NewKey(defaultKey.K)
+		state, blinded, err := s.Blind([]byte("input"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		eval, proof, err := key.EvaluateBatchWithProof([]BlindedElement{blinded})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.VerifyBatch(key.V, []BlindedElement{blinded}, eval, proof); err != nil {
+			t.Fatalf("%v: %v", s.Name(), err)
+		}
+		out, err := FinalizeBatch([]*State{state}, eval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out[0], key.Output([]byte("input"))) {
+			t.Fatalf("%v: Finalize and Output differ", s.Name())
+		}
+
+		// A key from the default suite with the same secret gives another
+		// output.
+		if bytes.Equal(out[0], defaultKey.Output([]byte("input"))) {
+			t.Fatalf("%v: same output as the default suite", s.Name())
+		}
+	}
+
+	// Elements of one suite are rejected by keys of another.
+	_, blinded, err := MODP4096.Blind([]byte("input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FFDHE2048.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.Evaluate(blinded); err == nil {
+		t.Fatalf("Element from another suite accepted")
+	}
+	state, _, err := FFDHE2048.Blind([]byte("input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := Blind([]byte("input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := key.V
+	if _, err := FinalizeBatch([]*State{state, other}, BatchEvaluation{V: v, B: []*big.Int{v, v}}); err == nil || err.Error() != "states from different suites" {
+		t.Fatalf("Mixed suites: got %v", err)
+	}
+
+	// Keys and states keep their suite through JSON.
+	var key2 Key
+	if err := roundTrip(key, &key2); err != nil {
+		t.Fatal(err)
+	}
+	if key2.params() != FFDHE2048 {
+		t.Fatalf("Key suite %v after round trip", key2.params().Name())
+	}
+	var state2, other2 State
+	if err := roundTrip(state, &state2); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(other, &other2); err != nil {
+		t.Fatal(err)
+	}
+	if state2.params() != FFDHE2048 || other2.params() != MODP2048 {
+		t.Fatalf("State suites %v, %v after round trip", state2.params().Name(), other2.params().Name())
+	}
+	if err := json.Unmarshal([]byte(`{"K":1,"Suite":"unknown"}`), &key2); err == nil || err.Error() != "unknown suite" {
+		t.Fatalf("Unknown key suite: got %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{"R":1,"Suite":"unknown"}`), &state2); err == nil || err.Error() != "unknown suite" {
+		t.Fatalf("Unknown state suite: got %v", err)
+	}
+}
+
+func TestNewSuite(t *testing.T) {
+	s, err := NewSuite("custom", FFDHE2048.P(), big.NewInt(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name() != "custom" || string(s.hashToGroupDST) != "HashToGroup-OPAQUE-custom" {
+		t.Fatalf("Wrong suite %v", s.Name())
+	}
+	if _, err := NewSuite("custom", FFDHE2048.P(), big.NewInt(1)); err == nil {
+		t.Fatalf("Invalid generator accepted")
+	}
+	if s2, err := NewSuite("custom", FFDHE2048.P(), big.NewInt(4)); err != nil || s2 != s {
+		t.Fatalf("Same suite created twice: got %v", err)
+	}
+	if _, err := NewSuite("custom", MODP2048.P(), big.NewInt(4)); err == nil || err.Error() != "suite name already in use" {
+		t.Fatalf("Name reused for another group: got %v", err)
+	}
+	var key Key
+	if err := roundTrip(s.NewKey(big.NewInt(5)), &key); err != nil || key.params() != s {
+		t.Fatalf("Custom suite round trip: got %v", err)
+	}
+	if _, err := ParseSuite("custom", []byte("not pem")); err == nil {
+		t.Fatalf("Invalid PEM accepted")
+	}
+}
+
+// timingThreshold is the largest |t| accepted by TestEvaluateTiming. dudect
+// uses 4.5 with millions of measurements; a higher threshold is used here as
+// the test only takes a few hundred measurements on a machine which may be
+// busy with other tests.
+const timingThreshold = 10
+
+// welch returns Welch's t statistic for the two samples after dropping the
+// measurements above the 90th percentile of both samples together, which are
+// mostly caused by the scheduler and the garbage collector.
+func welch(a, b []float64) float64 {
+	all := append(append([]float64{}, a...), b...)
+	sort.Float64s(all)
+	limit := all[len(all)*9/10]
+	stats := func(xs []float64) (mean, variance, n float64) {
+		for _, x := range xs {
+			if x <= limit {
+				mean += x
+				n++
+			}
+		}
+		mean /= n
+		for _, x := range xs {
+			if x <= limit {
+				variance += (x - mean) * (x - mean)
+			}
+		}
+		return mean, variance / (n - 1), n
+	}
+	ma, va, na := stats(a)
+	mb, vb, nb := stats(b)
+	return (ma - mb) / math.Sqrt(va/na+vb/nb)
+}
+
+// measureTiming calls f(false) and f(true) n times each in random order and
+// returns Welch's t statistic for the time taken by the two classes.
+func measureTiming(n int, f func(random bool)) float64 {
+	var fixed, random []float64
+	for len(fixed) < n || len(random) < n {
+		class := mathrand.Intn(2) == 1
+		if (class && len(random) == n) || (!class && len(fixed) == n) {
+			continue
+		}
+		start := time.Now()
+		f(class)
+		d := float64(time.Since(start))
+		if class {
+			random = append(random, d)
+		} else {
+			fixed = append(fixed, d)
+		}
+	}
+	return welch(fixed, random)
+}
+
+// TestEvaluateTiming checks that the time taken by Key.Evaluate doesn't depend
+// on the key. Evaluations with a short key, for which big.Int.Exp is much
+// faster, are compared with evaluations with random keys.
+//
+// Timing measurements are unreliable on shared machines, such as CI runners, so
+// the test only runs if the environment variable OPRF_TIMING_TEST is set to 1.
+// The exponentiation itself is checked deterministically by TestExpMuls in
+// package dh.
+func TestEvaluateTiming(t *testing.T) {
+	if os.Getenv("OPRF_TIMING_TEST") != "1" {
+		t.Skip("set OPRF_TIMING_TEST=1 to run the timing test")
+	}
+	_, blinded, err := Blind([]byte("input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortKey := NewKey(big.NewInt(3))
+	keys := make([]*Key, 0, 100)
+	for i := 0; i < cap(keys); i++ {
+		key, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	// Check that the test detects the difference for big.Int.Exp.
+	i := 0
+	tLeak := measureTiming(len(keys), func(random bool) {
+		k := shortKey.K
+		if random {
+			k = keys[i%len(keys)].K
+			i++
+		}
+		new(big.Int).Exp(blinded.A, k, defaultSuite.group.P)
+	})
+	if math.Abs(tLeak) < timingThreshold {
+		t.Fatalf("Timing difference of big.Int.Exp not detected: t = %.1f", tLeak)
+	}
+
+	i = 0
+	tEval := measureTiming(len(keys), func(random bool) {
+		key := shortKey
+		if random {
+			key = keys[i%len(keys)]
+			i++
+		}
+		if _, err := key.Evaluate(blinded); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if math.Abs(tEval) > timingThreshold {
+		t.Fatalf("Evaluate depends on the key: t = %.1f", tEval)
+	}
+	t.Logf("t = %.1f for big.Int.Exp, t = %.1f for Evaluate", tLeak, tEval)
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package oprf
+
+// This file contains the verifiable mode of the OPRF (VOPRF). The server
+// proves that it evaluated a batch with the key whose public key V = g^k the
+// client already knows, so it can't use a different key for each client to
+// tag them. The proof is a discrete log equality (DLEQ) proof that
+// log_g(V) = log_a(b), batched over all elements as in RFC 9497: the elements
+// are combined into C = prod a_i^d_i and D = prod b_i^d_i with weights d_i
+// derived from the transcript, and a single Schnorr-style proof shows that
+// log_g(V) = log_C(D).
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// Proof is a proof that a BatchEvaluation was computed with the key whose
+// public key is BatchEvaluation.V. See Key.EvaluateBatchWithProof.
+type Proof struct {
+	C *big.Int
+	S *big.Int
+}
+
+// ErrProof is returned by VerifyBatch if the proof doesn't verify.
+var ErrProof = errors.New("invalid proof")
+
+// EvaluateBatchWithProof is like EvaluateBatch but it also returns a proof that
+// the elements were evaluated with key, which the client checks with
+// VerifyBatch.
+func (key *Key) EvaluateBatchWithProof(blinded []BlindedElement) (BatchEvaluation, Proof, error) {
+	eval, err := key.EvaluateBatch(blinded)
+	if err != nil {
+		return BatchEvaluation{}, Proof{}, err
+	}
+	s := key.params()
+	c, d := s.composites(eval.V, blinded, eval.B)
+	r, err := s.group.GeneratePrivateKey(randr)
+	if err != nil {
+		return BatchEvaluation{}, Proof{}, err
+	}
+	t2 := s.group.GeneratePublicKey(r)
+	t3 := s.group.Exp(c, r)
+	ch := s.challenge(eval.V, c, d, t2, t3)
+	// All elements are in the subgroup of order q, so z = r - ch*k can be
+	// reduced mod q.
+	z := new(big.Int).Mul(ch, key.K)
+	z.Sub(r, z)
+	z.Mod(z, s.order)
+	return eval, Proof{C: ch, S: z}, nil
+}
+
+// VerifyBatch verifies that eval, the server's response to blinded, was
+// computed with the key whose public key is pub. pub must be obtained in a
+// trusted way, e.g., published by the server. ErrProof is returned if the
+// proof doesn't verify. VerifyBatch uses the default suite.
+func VerifyBatch(pub *big.Int, blinded []BlindedElement, eval BatchEvaluation, proof Proof) error {
+	return defaultSuite.VerifyBatch(pub, blinded, eval, proof)
+}
+
+// VerifyBatch is like the package level VerifyBatch but for the suite s.
+func (s *Suite) VerifyBatch(pub *big.Int, blinded []BlindedElement, eval BatchEvaluation, proof Proof) error {
+	if len(blinded) != len(eval.B) {
+		return errors.New("wrong number of evaluations")
+	}
+	if eval.V == nil || pub == nil || eval.V.Cmp(pub) != 0 {
+		return ErrProof
+	}
+	for i := range blinded {
+		if err := s.checkElement("a", blinded[i].A); err != nil {
+			return err
+		}
+		if err := s.checkElement("b", eval.B[i]); err != nil {
+			return err
+		}
+	}
+	if proof.C == nil || proof.S == nil || proof.C.Sign() < 0 || proof.S.Sign() < 0 {
+		return ErrProof
+	}
+	c, d := s.composites(pub, blinded, eval.B)
+	// t2 = g^s * V^c and t3 = C^s * D^c.
+	t2 := s.group.GeneratePublicKey(proof.S)
+	t2.Mul(t2, new(big.Int).Exp(pub, proof.C, s.group.P))
+	t2.Mod(t2, s.group.P)
+	t3 := s.group.MultiExp([]*big.Int{c, d}, []*big.Int{proof.S, proof.C})
+	if s.challenge(pub, c, d, t2, t3).Cmp(proof.C) != 0 {
+		return ErrProof
+	}
+	return nil
+}
+
+// Output computes the output of the OPRF for input directly, without blinding.
+// It's equal to the output of Finalize for the same input and key. The server
+// can use it to check outputs presented by clients, e.g., when redeeming
+// tokens.
+func (key *Key) Output(input []byte) []byte {
+	s := key.params()
+	z := s.group.HashToGroup(input, s.hashToGroupDST)
+	z = s.group.Exp(z, key.K)
+	return s.outputHash(input, nil, key.v(), z)
+}
+
+// composites computes the composite elements C and D of a batch. The weights
+// are derived from all values in the batch so that the server can't choose
+// them.
+func (s *Suite) composites(v *big.Int, blinded []BlindedElement, b []*big.Int) (c, d *big.Int) {
+	h := hasher()
+	h.Write([]byte("Seed"))
+	h.Write(s.group.Bytes(v))
+	for i := range blinded {
+		h.Write(s.group.Bytes(blinded[i].A))
+		h.Write(s.group.Bytes(b[i]))
+	}
+	seed := h.Sum(nil)
+	as := make([]*big.Int, len(blinded))
+	ds := make([]*big.Int, len(blinded))
+	for i := range blinded {
+		var idx [4]byte
+		binary.BigEndian.PutUint32(idx[:], uint32(i))
+		ds[i] = s.group.HashToScalar(append(seed, idx[:]...), s.compositeDST)
+		as[i] = blinded[i].A
+	}
+	return s.group.MultiExp(as, ds), s.group.MultiExp(b, ds)
+}
+
+// challenge computes the challenge of the DLEQ proof.
+func (s *Suite) challenge(v, c, d, t2, t3 *big.Int) *big.Int {
+	h := hasher()
+	h.Write([]byte("Challenge"))
+	for _, x := range []*big.Int{s.group.G, v, c, d, t2, t3} {
+		h.Write(s.group.Bytes(x))
+	}
+	return new(big.Int).SetBytes(h.Sum(nil))
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package oprf
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+func TestVerifiable(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []*State
+	var blinded []BlindedElement
+	for i := 0; i < 4; i++ {
+		state, b, err := Blind([]byte(fmt.Sprintf("token %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, state)
+		blinded = append(blinded, b)
+	}
+	eval, proof, err := key.EvaluateBatchWithProof(blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBatch(key.V, blinded, eval, proof); err != nil {
+		t.Fatal(err)
+	}
+	out, err := FinalizeBatch(states, eval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, state := range states {
+		if !bytes.Equal(out[i], key.Output(state.Input)) {
+			t.Fatalf("Output %d differs from Key.Output", i)
+		}
+	}
+
+	other, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBatch(other.V, blinded, eval, proof); err != ErrProof {
+		t.Fatalf("Wrong public key: got %v", err)
+	}
+	// An element evaluated with another key is detected even if V is
+	// correct.
+	tampered := eval
+	tampered.B = append([]*big.Int(nil), eval.B...)
+	tampered.B[1] = new(big.Int).Exp(blinded[1].A, other.K, defaultSuite.group.P)
+	if err := VerifyBatch(key.V, blinded, tampered, proof); err != ErrProof {
+		t.Fatalf("Tampered evaluation: got %v", err)
+	}
+	bad := Proof{C: proof.C, S: new(big.Int).Add(proof.S, big.NewInt(1))}
+	if err := VerifyBatch(key.V, blinded, eval, bad); err != ErrProof {
+		t.Fatalf("Tampered proof: got %v", err)
+	}
+	if err := VerifyBatch(key.V, blinded[1:], eval, proof); err == nil {
+		t.Fatalf("VerifyBatch succeeded with too few elements")
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains support for registering users under a server-wide master
+// OPRF key instead of a per-user key. The OPRF is then the POPRF from package
+// oprf, evaluated with public metadata (info) which the client sends together
+// with a, e.g., a tenant id or a key epoch. The username is always part of the
+// metadata, so each user still gets an independent PRF:
+//
+//     F(master key, (username, info), password)
+//
+// One master key can serve many tenants or epochs, and the outputs for
+// different infos are unrelated. An epoch is retired with MasterKey.Retire,
+// after which users registered under it can't authenticate and need to
+// register again.
+//
+// Additional credentials (see NewCredentialInit) and records created by
+// UpgradeInit always get a per-user OPRF key.
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"github.com/frekui/opaque/oprf"
+)
+
+// ErrInfoRetired is returned by PwReg1WithMasterKey and Auth1WithMasterKey if
+// the info has been retired.
+var ErrInfoRetired = errors.New("info has been retired")
+
+// MasterKey is a server-wide OPRF key. It should be stored as securely as
+// privS. Retire must not be called concurrently with the other functions
+// which use the MasterKey.
+type MasterKey struct {
+	Key *oprf.Key
+
+	// Infos which are no longer accepted, see Retire.
+	Retired map[string]bool `json:",omitempty"`
+}
+
+// NewMasterKey generates a new random MasterKey.
+func NewMasterKey() (*MasterKey, error) {
+	key, err := oprf.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return &MasterKey{Key: key}, nil
+}
+
+// Retire stops mk from being used with info. Users registered with info can no
+// longer authenticate.
+func (mk *MasterKey) Retire(info []byte) {
+	if mk.Retired == nil {
+		mk.Retired = map[string]bool{}
+	}
+	mk.Retired[string(info)] = true
+}
+
+// evaluate evaluates the POPRF for username and info.
+func (mk *MasterKey) evaluate(username string, info []byte, a *big.Int) (oprf.Evaluation, error) {
+	if mk.Retired[string(info)] {
+		return oprf.Evaluation{}, ErrInfoRetired
+	}
+	return mk.Key.EvaluateWithInfo(oprf.BlindedElement{A: a}, poprfInfo(username, info))
+}
+
+// poprfInfo returns the public metadata of the POPRF for username and info.
+func poprfInfo(username string, info []byte) []byte {
+	var buf []byte
+	for _, p := range [][]byte{[]byte(username), info} {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(p)))
+		buf = append(buf, l[:]...)
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+// PwRegInitWithInfo is like PwRegInit but the user is registered under the
+// server's master key with the public metadata info, which the server must
+// accept with PwReg1WithMasterKey. The rest of the registration is done with
+// PwReg2 and PwReg3 as usual.
+func PwRegInitWithInfo(username, password string, bits int, info []byte) (*PwRegClientSession, PwRegMsg1, error) {
+	sess, msg1, err := PwRegInit(username, password, bits)
+	if err != nil {
+		return nil, PwRegMsg1{}, err
+	}
+	sess.info = poprfInfo(username, info)
+	msg1.Info = info
+	return sess, msg1, nil
+}
+
+// PwReg1WithMasterKey is like PwReg1 but it is invoked for a PwRegMsg1 created
+// by PwRegInitWithInfo. The User returned by PwReg3 has no OPRF key of its own,
+// so Auth1WithMasterKey must be used when the user authenticates. The server
+// decides whether msg1.Info is acceptable (e.g., whether it's the current
+// epoch) before calling PwReg1WithMasterKey.
+func PwReg1WithMasterKey(privS *rsa.PrivateKey, mk *MasterKey, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMsg2, error) {
+	if err := checkVersion(msg1.Version); err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	eval, err := mk.evaluate(msg1.Username, msg1.Info, msg1.A)
+	if err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	session := &PwRegServerSession{
+		username: msg1.Username,
+		v:        eval.V,
+		info:     msg1.Info,
+	}
+	msg2 := PwRegMsg2{V: eval.V, B: eval.B, PubS: &privS.PublicKey}
+	return session, msg2, nil
+}
+
+// AuthInitWithInfo is like AuthInit but it is used for users registered with
+// PwRegInitWithInfo. info must be the same as during registration.
+func AuthInitWithInfo(username, password string, info []byte) (*AuthClientSession, AuthMsg1, error) {
+	sess, msg1, err := AuthInit(username, password)
+	if err != nil {
+		return nil, AuthMsg1{}, err
+	}
+	sess.info = poprfInfo(username, info)
+	msg1.Info = info
+	return sess, msg1, nil
+}
+
+// Auth1WithMasterKey is like Auth1 but it also accepts users registered with
+// PwReg1WithMasterKey, for which the OPRF is evaluated with mk. ErrInfoRetired
+// is returned if the user's info has been retired. Other users are handled as
+// by Auth1.
+func Auth1WithMasterKey(privS *rsa.PrivateKey, mk *MasterKey, user *User, msg1 AuthMsg1) (*AuthServerSession, AuthMsg2, error) {
+	return auth1(privS, mk, nil, user, msg1, false, nil)
+}
+
+// finalizeOprf computes RwdU from v and b. info is the public metadata of the
+// POPRF, nil if the user has a per-user OPRF key.
+func finalizeOprf(blind *oprf.State, info []byte, v, b *big.Int) ([]byte, error) {
+	eval := oprf.Evaluation{V: v, B: b}
+	if info == nil {
+		return oprf.Finalize(blind, eval)
+	}
+	return oprf.FinalizeWithInfo(blind, eval, info)
+}
+
+// evaluateOprf evaluates the OPRF for msg1 with the OPRF key of the
+// credential selected by msg1. If key is nil the user was registered under the
+// master key mk.
+func evaluateOprf(mk *MasterKey, user *User, key *oprf.Key, msg1 AuthMsg1) (oprf.Evaluation, error) {
+	if key != nil {
+		return key.Evaluate(oprf.BlindedElement{A: msg1.A})
+	}
+	if mk == nil {
+		return oprf.Evaluation{}, errors.New("user requires the master key")
+	}
+	if !bytes.Equal(msg1.Info, user.Info) {
+		return oprf.Evaluation{}, errors.New("info mismatch")
+	}
+	return mk.evaluate(user.Username, user.Info, msg1.A)
+}
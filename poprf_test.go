@@ -0,0 +1,123 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"testing"
+)
+
+// registerWithInfo runs the password registration protocol under the master
+// key mk.
+func registerWithInfo(privS *rsa.PrivateKey, mk *MasterKey, username, password string, info []byte) (*User, error) {
+	cSess, msg1, err := PwRegInitWithInfo(username, password, 512, info)
+	if err != nil {
+		return nil, err
+	}
+	sSess, msg2, err := PwReg1WithMasterKey(privS, mk, msg1)
+	if err != nil {
+		return nil, err
+	}
+	msg3, err := PwReg2(cSess, msg2)
+	if err != nil {
+		return nil, err
+	}
+	return PwReg3(sSess, msg3), nil
+}
+
+// authenticateWithInfo runs the authentication protocol with Auth1WithMasterKey.
+// If info is nil the client uses AuthInit.
+func authenticateWithInfo(privS *rsa.PrivateKey, mk *MasterKey, user *User, password string, info []byte) error {
+	cSess, msg1, err := AuthInit(user.Username, password)
+	if info != nil {
+		cSess, msg1, err = AuthInitWithInfo(user.Username, password, info)
+	}
+	if err != nil {
+		return err
+	}
+	sSess, msg2, err := Auth1WithMasterKey(privS, mk, user, msg1)
+	if err != nil {
+		return fmt.Errorf("server: %s", err)
+	}
+	cSecret, msg3, err := Auth2(cSess, msg2)
+	if err != nil {
+		return fmt.Errorf("client: %s", err)
+	}
+	sSecret, err := Auth3(sSess, msg3)
+	if err != nil {
+		return fmt.Errorf("server: %s", err)
+	}
+	if !bytes.Equal(cSecret, sSecret) {
+		return fmt.Errorf("Shared secrets differ")
+	}
+	return nil
+}
+
+func TestMasterKey(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch1 := []byte("epoch 1")
+	alice, err := registerWithInfo(privS, mk, "alice", "password", epoch1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := registerWithInfo(privS, mk, "bob", "password", epoch1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.K != nil || !bytes.Equal(alice.Info, epoch1) {
+		t.Fatalf("Unexpected record for a user registered under a master key")
+	}
+	// The username separates users with the same info.
+	if alice.V.Cmp(bob.V) == 0 {
+		t.Fatalf("Users share the same OPRF key")
+	}
+
+	if err := authenticateWithInfo(privS, mk, alice, "password", epoch1); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticateWithInfo(privS, mk, alice, "wrong", epoch1); err == nil || err.Error() != "client: Authtag mismatch" {
+		t.Fatalf("Wrong password: got %v", err)
+	}
+	if err := authenticateWithInfo(privS, mk, alice, "password", []byte("epoch 2")); err == nil || err.Error() != "server: info mismatch" {
+		t.Fatalf("Wrong info: got %v", err)
+	}
+	if err := authenticate(privS, alice, "password", nil, nil, nil, false); err == nil || err.Error() != "server: user requires the master key" {
+		t.Fatalf("Auth1 for a user registered under a master key: got %v", err)
+	}
+	// Users with a per-user key are also accepted by Auth1WithMasterKey.
+	carol, err := MigrateUser(privS, "carol", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticateWithInfo(privS, mk, carol, "password", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users in a retired epoch can neither authenticate nor register.
+	mk.Retire(epoch1)
+	if err := authenticateWithInfo(privS, mk, alice, "password", epoch1); err == nil || err.Error() != "server: "+ErrInfoRetired.Error() {
+		t.Fatalf("Retired info: got %v", err)
+	}
+	if _, err := registerWithInfo(privS, mk, "dave", "password", epoch1); err != ErrInfoRetired {
+		t.Fatalf("Registration with retired info: got %v", err)
+	}
+	alice, err = registerWithInfo(privS, mk, "alice", "password", []byte("epoch 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticateWithInfo(privS, mk, alice, "password", []byte("epoch 2")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains client puzzles and admission control for the server.
+//
+// Auth1 performs several expensive operations (modular exponentiations and an
+// RSA signature) for any AuthMsg1 it receives, also for unknown users. This
+// makes it cheap for an attacker to exhaust the CPU of the server. When the
+// server is under load it can ask the client to solve a hash puzzle before
+// Auth1 runs. The server authenticates the puzzle with a MAC and the client
+// returns the puzzle together with the solution, so the server only needs to
+// remember the puzzles which have been solved until they expire.
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// Puzzle is a client puzzle issued by the server. The client solves it using
+// SolvePuzzle.
+//
+// Users of package opaque does not need to read nor write to any fields in this
+// struct except to serialize and deserialize the struct when it's sent between
+// the peers.
+type Puzzle struct {
+	Nonce []byte
+
+	// Unix time after which the server no longer accepts solutions.
+	Expires int64
+
+	// Number of leading zero bits required in the solution hash.
+	Difficulty int
+
+	// Mac(server puzzle key; Nonce, Expires, Difficulty)
+	Mac []byte
+}
+
+// PuzzleSolution is sent from the client to the server. It is created by
+// SolvePuzzle and checked by PuzzleIssuer.Verify.
+type PuzzleSolution struct {
+	Puzzle   Puzzle
+	Solution uint64
+}
+
+// ErrPuzzle is returned by PuzzleIssuer.Verify if a solution isn't accepted.
+var ErrPuzzle = errors.New("invalid puzzle solution")
+
+// MaxPuzzleDifficulty is the largest difficulty of a puzzle. Solving a puzzle
+// of this difficulty takes about 2^32 hash computations, i.e., minutes of CPU
+// time.
+const MaxPuzzleDifficulty = 32
+
+// ErrPuzzleTooHard is returned by SolvePuzzle and PuzzleIssuer.Issue for
+// puzzles with a difficulty above MaxPuzzleDifficulty. A client which solved
+// whatever puzzle it was sent could be kept busy forever by a hostile server.
+var ErrPuzzleTooHard = errors.New("puzzle too hard")
+
+// ErrOverloaded is returned by Admission.Do if the server has too many pending
+// requests.
+var ErrOverloaded = errors.New("server overloaded")
+
+// PuzzleIssuer creates and verifies client puzzles. No state is kept between
+// issuing a puzzle and verifying its solution, but the nonces of solved puzzles
+// are kept until the puzzles expire so that each solution is only accepted
+// once. It is safe to use a PuzzleIssuer from multiple goroutines.
+type PuzzleIssuer struct {
+	key []byte
+
+	// Time a puzzle is valid after it has been issued.
+	TTL time.Duration
+
+	mu sync.Mutex
+	// spent maps the nonces of solved puzzles to their expiry time.
+	spent     map[string]int64
+	nextPrune int64
+}
+
+// NewPuzzleIssuer creates a PuzzleIssuer with a newly generated key. Puzzles
+// issued by it are valid for ttl.
+func NewPuzzleIssuer(ttl time.Duration) (*PuzzleIssuer, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(randr, key); err != nil {
+		return nil, err
+	}
+	return &PuzzleIssuer{key: key, TTL: ttl}, nil
+}
+
+// Issue creates a new puzzle with the given difficulty. The expected amount
+// of work needed to solve it is 2^difficulty hash computations.
+// ErrPuzzleTooHard is returned if difficulty is above MaxPuzzleDifficulty.
+func (pi *PuzzleIssuer) Issue(difficulty int) (Puzzle, error) {
+	if difficulty > MaxPuzzleDifficulty {
+		return Puzzle{}, ErrPuzzleTooHard
+	}
+	p := Puzzle{
+		Nonce:      make([]byte, 16),
+		Expires:    time.Now().Add(pi.TTL).Unix(),
+		Difficulty: difficulty,
+	}
+	if _, err := io.ReadFull(randr, p.Nonce); err != nil {
+		return Puzzle{}, err
+	}
+	p.Mac = pi.mac(&p)
+	return p, nil
+}
+
+// Verify checks that sol is a solution, bound to msg1, of a puzzle issued by
+// pi, that the puzzle hasn't expired and that it hasn't been solved before.
+// ErrPuzzle is returned if this isn't the case.
+func (pi *PuzzleIssuer) Verify(sol PuzzleSolution, msg1 AuthMsg1) error {
+	p := &sol.Puzzle
+	if !hmac.Equal(pi.mac(p), p.Mac) {
+		return ErrPuzzle
+	}
+	now := time.Now().Unix()
+	if now > p.Expires {
+		return ErrPuzzle
+	}
+	if msg1.A == nil || msg1.DhPubClient == nil {
+		return ErrPuzzle
+	}
+	if leadingZeros(puzzleHash(p, msg1, sol.Solution)) < p.Difficulty {
+		return ErrPuzzle
+	}
+	return pi.spend(p, now)
+}
+
+// spend records that p has been solved. ErrPuzzle is returned if it already
+// has been. Expired nonces are removed at most once per TTL.
+func (pi *PuzzleIssuer) spend(p *Puzzle, now int64) error {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	if pi.spent == nil {
+		pi.spent = map[string]int64{}
+	}
+	if now >= pi.nextPrune {
+		for nonce, expires := range pi.spent {
+			if now > expires {
+				delete(pi.spent, nonce)
+			}
+		}
+		pi.nextPrune = now + int64(pi.TTL/time.Second) + 1
+	}
+	if _, ok := pi.spent[string(p.Nonce)]; ok {
+		return ErrPuzzle
+	}
+	pi.spent[string(p.Nonce)] = p.Expires
+	return nil
+}
+
+func (pi *PuzzleIssuer) mac(p *Puzzle) []byte {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(p.Expires))
+	binary.BigEndian.PutUint64(buf[8:], uint64(p.Difficulty))
+	mac := hmac.New(hasher, pi.key)
+	mac.Write(p.Nonce)
+	mac.Write(buf[:])
+	return mac.Sum(nil)
+}
+
+// SolvePuzzle is run by the client. It solves p and binds the solution to msg1,
+// which is the message the client sends to the server together with the
+// solution. ErrPuzzleTooHard is returned, without trying to solve p, if its
+// difficulty is above MaxPuzzleDifficulty.
+func SolvePuzzle(p Puzzle, msg1 AuthMsg1) (PuzzleSolution, error) {
+	if p.Difficulty > MaxPuzzleDifficulty {
+		return PuzzleSolution{}, ErrPuzzleTooHard
+	}
+	for i := uint64(0); ; i++ {
+		if leadingZeros(puzzleHash(&p, msg1, i)) >= p.Difficulty {
+			return PuzzleSolution{Puzzle: p, Solution: i}, nil
+		}
+	}
+}
+
+// puzzleHash computes H(Nonce, A, DhPubClient, Version, len(Username),
+// Username, len(EncUsername), EncUsername, len(CredentialID), CredentialID,
+// len(DeviceID), DeviceID, len(Info), Info, solution), so a solution can only
+// be used with the msg1 it was computed for.
+func puzzleHash(p *Puzzle, msg1 AuthMsg1, solution uint64) []byte {
+	var buf [8]byte
+	h := hasher()
+	writeBytes := func(b []byte) {
+		binary.BigEndian.PutUint64(buf[:], uint64(len(b)))
+		h.Write(buf[:])
+		h.Write(b)
+	}
+	h.Write(p.Nonce)
+	h.Write(dhGroup.Bytes(msg1.A))
+	h.Write(dhGroup.Bytes(msg1.DhPubClient))
+	binary.BigEndian.PutUint64(buf[:], uint64(msg1.Version))
+	h.Write(buf[:])
+	writeBytes([]byte(msg1.Username))
+	writeBytes(msg1.EncUsername)
+	writeBytes([]byte(msg1.CredentialID))
+	writeBytes([]byte(msg1.DeviceID))
+	writeBytes(msg1.Info)
+	binary.BigEndian.PutUint64(buf[:], solution)
+	h.Write(buf[:])
+	return h.Sum(nil)
+}
+
+// leadingZeros returns the number of leading zero bits in b.
+func leadingZeros(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+// Admission bounds the number of expensive handshake steps that run
+// concurrently on the server and decides when clients have to solve puzzles.
+// It is safe to use an Admission from multiple goroutines.
+type Admission struct {
+	// Difficulty of puzzles when all workers are busy. The difficulty
+	// is increased by one for each time the number of pending requests
+	// doubles beyond that.
+	Difficulty int
+
+	workers    chan struct{}
+	maxPending int
+
+	mu      sync.Mutex
+	pending int
+}
+
+// NewAdmission creates an Admission which runs at most workers functions
+// concurrently and lets at most maxPending functions wait or run at the same
+// time. At least one worker is always used.
+func NewAdmission(workers, maxPending, difficulty int) *Admission {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Admission{
+		Difficulty: difficulty,
+		workers:    make(chan struct{}, workers),
+		maxPending: maxPending,
+	}
+}
+
+// PuzzleDifficulty returns the difficulty of the puzzle a client should solve
+// before the server does any expensive work. Zero is returned if the server
+// isn't under load, in which case no puzzle is needed. The difficulty is at
+// most MaxPuzzleDifficulty.
+func (a *Admission) PuzzleDifficulty() int {
+	a.mu.Lock()
+	pending := a.pending
+	a.mu.Unlock()
+	if pending < cap(a.workers) {
+		return 0
+	}
+	d := a.Difficulty + bits.Len(uint(pending/cap(a.workers))) - 1
+	if d > MaxPuzzleDifficulty {
+		d = MaxPuzzleDifficulty
+	}
+	return d
+}
+
+// Do runs f once a worker is available and returns the error returned by f.
+// If too many functions are already waiting ErrOverloaded is returned without
+// running f.
+func (a *Admission) Do(f func() error) error {
+	a.mu.Lock()
+	if a.pending >= a.maxPending {
+		a.mu.Unlock()
+		return ErrOverloaded
+	}
+	a.pending++
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.pending--
+		a.mu.Unlock()
+	}()
+
+	a.workers <- struct{}{}
+	defer func() { <-a.workers }()
+	return f()
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestPuzzle(t *testing.T) {
+	pi, err := NewPuzzleIssuer(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := pi.Issue(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sol, err := SolvePuzzle(p, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.Verify(sol, msg1); err != nil {
+		t.Fatal(err)
+	}
+	// Each solution is only accepted once.
+	if err := pi.Verify(sol, msg1); err != ErrPuzzle {
+		t.Fatalf("Replayed solution: got %v, expected %v", err, ErrPuzzle)
+	}
+
+	for idx, tst := range []struct {
+		solMod  func(*PuzzleSolution)
+		msg1Mod func(*AuthMsg1)
+	}{
+		{func(sol *PuzzleSolution) { sol.Puzzle.Difficulty = 0 }, nil},
+		{func(sol *PuzzleSolution) { sol.Puzzle.Expires++ }, nil},
+		{func(sol *PuzzleSolution) { sol.Puzzle.Nonce[0] ^= 42 }, nil},
+		{nil, func(msg1 *AuthMsg1) { msg1.Username = "other" }},
+		{nil, func(msg1 *AuthMsg1) { msg1.DhPubClient = big.NewInt(123) }},
+		{nil, func(msg1 *AuthMsg1) { msg1.A = nil }},
+		{nil, func(msg1 *AuthMsg1) { msg1.Version = 0 }},
+		{nil, func(msg1 *AuthMsg1) { msg1.CredentialID = "recovery" }},
+		{nil, func(msg1 *AuthMsg1) { msg1.DeviceID = "laptop" }},
+		{nil, func(msg1 *AuthMsg1) { msg1.Info = []byte("epoch 2") }},
+	} {
+		p, err := pi.Issue(16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sol, err := SolvePuzzle(p, msg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modMsg1 := msg1
+		if tst.solMod != nil {
+			tst.solMod(&sol)
+		}
+		if tst.msg1Mod != nil {
+			tst.msg1Mod(&modMsg1)
+		}
+		if err := pi.Verify(sol, modMsg1); err != ErrPuzzle {
+			t.Fatalf("Test %d: got %v, expected %v", idx, err, ErrPuzzle)
+		}
+	}
+
+	expiredIssuer := &PuzzleIssuer{key: pi.key, TTL: -time.Hour}
+	p, err = expiredIssuer.Issue(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sol, err = SolvePuzzle(p, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pi.Verify(sol, msg1); err != ErrPuzzle {
+		t.Fatalf("Expired puzzle: got %v", err)
+	}
+
+	// Puzzles which are too hard are neither issued nor solved.
+	if _, err := pi.Issue(MaxPuzzleDifficulty + 1); err != ErrPuzzleTooHard {
+		t.Fatalf("Issue of a too hard puzzle: got %v", err)
+	}
+	p.Difficulty = 257
+	if _, err := SolvePuzzle(p, msg1); err != ErrPuzzleTooHard {
+		t.Fatalf("SolvePuzzle of a too hard puzzle: got %v", err)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	a := NewAdmission(1, 2, 10)
+	if d := a.PuzzleDifficulty(); d != 0 {
+		t.Fatalf("Idle difficulty %d, expected 0", d)
+	}
+
+	started := make(chan bool)
+	release := make(chan bool)
+	done := make(chan error)
+	go func() {
+		done <- a.Do(func() error {
+			started <- true
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	if d := a.PuzzleDifficulty(); d != 10 {
+		t.Fatalf("Busy difficulty %d, expected 10", d)
+	}
+
+	go func() { done <- a.Do(func() error { return nil }) }()
+	for a.PuzzleDifficulty() != 11 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := a.Do(func() error { return nil }); err != ErrOverloaded {
+		t.Fatalf("Got %v, expected %v", err, ErrOverloaded)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := a.PuzzleDifficulty(); d != 0 {
+		t.Fatalf("Idle difficulty %d, expected 0", d)
+	}
+}
@@ -11,10 +11,16 @@ package opaque
 // http://webee.technion.ac.il/~hugo/sigma-pdf.pdf
 
 import (
+	"crypto/hmac"
 	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/frekui/opaque/internal/pkg/authenc"
+	"github.com/frekui/opaque/oprf"
 )
 
 // The User struct is the state that the server needs to store for each
@@ -23,15 +29,54 @@ type User struct {
 	// Name of this user.
 	Username string
 
-	// OPRF key for this user. This is the salt.
-	K *big.Int
-
-	V *big.Int
+	// OPRF key for this user. This is the salt. K is nil if the user was
+	// registered under a master key, see PwReg1WithMasterKey. Info is
+	// then the public metadata used with the master key.
+	K    *big.Int
+	V    *big.Int
+	Info []byte `json:",omitempty"`
 
 	// EnvU and PubU are generated by the client during password
 	// registration and stored at the server.
 	EnvU []byte
 	PubU *rsa.PublicKey
+
+	// Envelopes for additional devices, indexed by device id. See
+	// AddDevice.
+	DeviceEnvU map[string][]byte `json:",omitempty"`
+
+	// Additional credentials, indexed by credential id. See
+	// AddCredential3.
+	Credentials map[string]*Credential `json:",omitempty"`
+
+	// The real envelope mixed with decoys, and a MAC which tells a
+	// HoneyChecker which of them is the real one. If set, EnvU and PubU
+	// are nil. See AddHoneyEnvelopes.
+	HoneyEnvU []*HoneyEnvelope `json:",omitempty"`
+	HoneyTag  []byte           `json:",omitempty"`
+
+	// Secret of the user's TOTP second factor, nil if the user doesn't
+	// have a second factor. TOTPLastStep is the time step of the last
+	// accepted code and TOTPFailures counts wrong codes since then. See
+	// EnableTOTP.
+	TOTPSecret   []byte `json:",omitempty"`
+	TOTPLastStep int64  `json:",omitempty"`
+	TOTPFailures int    `json:",omitempty"`
+
+	// Lifecycle metadata, see Auth1. Created and PasswordChanged are set
+	// by PwReg3 and LastLogin by a successful Auth3. FailedAttempts counts
+	// failed Auth3 calls since the last successful one. The server may set the
+	// remaining fields: Auth1 tells the client to change the password if
+	// PasswordExpires has passed or MustChangePassword is set, and it
+	// rejects logins if Disabled is set or LockedUntil hasn't passed.
+	Created            time.Time `json:",omitzero"`
+	PasswordChanged    time.Time `json:",omitzero"`
+	LastLogin          time.Time `json:",omitzero"`
+	FailedAttempts     int       `json:",omitempty"`
+	PasswordExpires    time.Time `json:",omitzero"`
+	MustChangePassword bool      `json:",omitempty"`
+	Disabled           bool      `json:",omitempty"`
+	LockedUntil        time.Time `json:",omitzero"`
 }
 
 // PwRegServerSession keeps track of state needed on the server-side during a
@@ -40,6 +85,18 @@ type PwRegServerSession struct {
 	username string
 	k        *big.Int
 	v        *big.Int
+
+	// Registration code redeemed by PwReg1WithCode and the blinded
+	// password from PwRegMsg1. Both are nil if no code is used.
+	code *RegCode
+	a    *big.Int
+
+	// Id of the credential added by AddCredential1, empty otherwise.
+	credentialID string
+
+	// Public metadata of the POPRF. Only set by PwReg1WithMasterKey, in
+	// which case k is nil.
+	info []byte
 }
 
 // PwRegClientSession keeps track of state needed on the client-side during a
@@ -47,13 +104,28 @@ type PwRegServerSession struct {
 type PwRegClientSession struct {
 	a *big.Int
 
-	// Random integer in [0..q-1]. Used when computing DF-OPRF.
-	r *big.Int
+	// Client state of the OPRF, holds the password.
+	blind *oprf.State
 
-	password string
+	// Public metadata of the POPRF, nil unless PwRegInitWithInfo is
+	// used.
+	info []byte
 
 	// Number of bits in RSA private key.
 	bits int
+
+	// Registration code given to PwRegInitWithCode, nil if no code is
+	// used.
+	code *RegCode
+
+	// Application data stored in the envelope by PwReg2 and
+	// PwReg2WithDevice. Set by UpgradeInit to carry the data over to the
+	// new envelope.
+	data *EnvelopeData
+
+	// Private key of the account when a credential is added by
+	// NewCredentialInit. If nil, PwReg2 generates a new key.
+	privU *rsa.PrivateKey
 }
 
 // PwRegMsg1 is the first message during password registration. It is sent from
@@ -63,9 +135,29 @@ type PwRegClientSession struct {
 // struct except to serialize and deserialize the struct when it's sent between
 // the peers in the authentication protocol.
 type PwRegMsg1 struct {
+	// Version is ProtocolVersion.
+	Version int `json:",omitempty"`
+
 	Username string
-	R        *big.Int
 	A        *big.Int
+
+	// CodeID and CodeMac are only set when a registration code is used.
+	// CodeMac is Mac(code key; Username, A).
+	CodeID  string `json:",omitempty"`
+	CodeMac []byte `json:",omitempty"`
+
+	// UsernameDhPub and EncUsername are only set if EncryptPwRegUsername
+	// is used, in which case Username is empty.
+	UsernameDhPub *big.Int `json:",omitempty"`
+	EncUsername   []byte   `json:",omitempty"`
+
+	// CredentialID is only set when a credential is added with
+	// NewCredentialInit.
+	CredentialID string `json:",omitempty"`
+
+	// Public metadata of the POPRF. Only set if PwRegInitWithInfo is
+	// used.
+	Info []byte `json:",omitempty"`
 }
 
 // PwRegMsg2 is the second message in password registration. Sent from server to
@@ -78,6 +170,10 @@ type PwRegMsg2 struct {
 	V    *big.Int
 	B    *big.Int
 	PubS *rsa.PublicKey
+
+	// CodeMac is only set when a registration code is used. It is
+	// Mac(code key; A, V, B, PubS).
+	CodeMac []byte `json:",omitempty"`
 }
 
 // PwRegMsg3 is the third and final message in password registration. Sent from
@@ -89,6 +185,10 @@ type PwRegMsg2 struct {
 type PwRegMsg3 struct {
 	EnvU []byte
 	PubU *rsa.PublicKey
+
+	// CodeMac is only set when a registration code is used. It is
+	// Mac(code key; A, EnvU, PubU).
+	CodeMac []byte `json:",omitempty"`
 }
 
 // PwRegInit initiates the password registration protocol. It's invoked by the
@@ -112,25 +212,42 @@ func PwRegInit(username, password string, bits int) (*PwRegClientSession, PwRegM
 	//     Protocol for computing DH-OPRF, U with input x and S with input k:
 	//     U: choose random r in [0..q-1], send a=H'(x)*g^r to S
 
-	a, r, err := dhOprf1(password)
+	blind, blinded, err := oprf.Blind([]byte(password))
 	if err != nil {
 		return nil, PwRegMsg1{}, err
 	}
 	session := &PwRegClientSession{
-		a:        a,
-		r:        r,
-		password: password,
-		bits:     bits,
+		a:     blinded.A,
+		blind: blind,
+		bits:  bits,
 	}
 	msg1 := PwRegMsg1{
+		Version:  ProtocolVersion,
 		Username: username,
-		R:        r,
-		A:        a,
+		A:        blinded.A,
 	}
 
 	return session, msg1, nil
 }
 
+// PwRegInitWithCode is like PwRegInit but the registration is bound to the
+// one-time registration code code, which the server has issued earlier. This
+// makes it possible to run the password registration protocol over a connection
+// which isn't authenticated. The server must use PwReg1WithCode and
+// PwReg3WithCode instead of PwReg1 and PwReg3.
+//
+// See also ParseRegCode.
+func PwRegInitWithCode(username, password string, bits int, code *RegCode) (*PwRegClientSession, PwRegMsg1, error) {
+	session, msg1, err := PwRegInit(username, password, bits)
+	if err != nil {
+		return nil, PwRegMsg1{}, err
+	}
+	session.code = code
+	msg1.CodeID = code.ID
+	msg1.CodeMac = regCodeMac(code.Key, "PwRegMsg1", []byte(username), dhGroup.Bytes(msg1.A))
+	return session, msg1, nil
+}
+
 // PwReg1 is the processing done by the server when it has received a PwRegMsg1
 // struct from a client.
 //
@@ -148,24 +265,68 @@ func PwReg1(privS *rsa.PrivateKey, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMs
 	//    multiple users), and sends PubS to U.
 	//
 	//    S: upon receiving a value a, respond with v=g^k and b=a^k
-	k, err := generateSalt()
+	if err := checkVersion(msg1.Version); err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	key, err := oprf.GenerateKey()
 	if err != nil {
 		return nil, PwRegMsg2{}, err
 	}
-	// func dhOprf2(a, k *big.Int) (v *big.Int, b *big.Int)
-	v, b, err := dhOprf2(msg1.A, k)
+	eval, err := key.Evaluate(oprf.BlindedElement{A: msg1.A})
 	if err != nil {
 		return nil, PwRegMsg2{}, err
 	}
 	session := &PwRegServerSession{
 		username: msg1.Username,
-		k:        k,
-		v:        v,
+		k:        key.K,
+		v:        key.V,
+	}
+	msg2 := PwRegMsg2{V: eval.V, B: eval.B, PubS: &privS.PublicKey}
+	return session, msg2, nil
+}
+
+// PwReg1WithCode is like PwReg1 but it also verifies that the client holds the
+// registration code identified by msg1.CodeID, and it authenticates msg2 with
+// the code. The code is looked up in codes and, once msg1 has been validated
+// and the MAC in msg1 has verified, removed from it, so each code can be used
+// at most once even if the registration fails later on. A malformed msg1, a
+// msg1 for another protocol version or a msg1 with a bad MAC leaves the code in
+// the store, as the code's id is sent in clear and anyone who sees it could
+// otherwise burn it. ErrInvalidRegCode is returned if the code is unknown, has
+// expired or if the MAC in msg1 doesn't verify.
+//
+// A code isn't bound to a username, so the server must refuse registrations
+// for usernames which already exist.
+//
+// See also PwRegInitWithCode and PwReg3WithCode.
+func PwReg1WithCode(privS *rsa.PrivateKey, codes *RegCodeStore, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMsg2, error) {
+	session, msg2, err := PwReg1(privS, msg1)
+	if err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	code, err := codes.redeem(msg1.CodeID, func(code *RegCode) bool {
+		mac := regCodeMac(code.Key, "PwRegMsg1", []byte(msg1.Username), dhGroup.Bytes(msg1.A))
+		return hmac.Equal(mac, msg1.CodeMac)
+	})
+	if err != nil {
+		return nil, PwRegMsg2{}, err
 	}
-	msg2 := PwRegMsg2{V: v, B: b, PubS: &privS.PublicKey}
+	session.code = code
+	session.a = msg1.A
+	msg2.CodeMac = regCodeMac2(code.Key, msg1.A, msg2)
 	return session, msg2, nil
 }
 
+// regCodeMac2 computes the CodeMac of msg2, which answers a PwRegMsg1 with
+// blinded password a.
+func regCodeMac2(key []byte, a *big.Int, msg2 PwRegMsg2) []byte {
+	var pubS []byte
+	if msg2.PubS != nil {
+		pubS = x509.MarshalPKCS1PublicKey(msg2.PubS)
+	}
+	return regCodeMac(key, "PwRegMsg2", dhGroup.Bytes(a), dhGroup.Bytes(msg2.V), dhGroup.Bytes(msg2.B), pubS)
+}
+
 // PwReg2 is invoked on the client when it has received a PwRegMsg2 struct from
 // the server.
 //
@@ -173,31 +334,83 @@ func PwReg1(privS *rsa.PrivateKey, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMs
 //
 // See also PwRegInit, PwReg1, and PwReg3.
 func PwReg2(sess *PwRegClientSession, msg2 PwRegMsg2) (PwRegMsg3, error) {
+	return PwReg2WithDevice(sess, msg2, nil)
+}
+
+// PwReg2WithDevice is like PwReg2 but the envelope is bound to deviceSecret,
+// which is combined with RwdU when the envelope key is derived. The same device
+// secret must be passed to Auth2WithDevice when the user authenticates. If
+// deviceSecret is nil PwReg2WithDevice is equivalent to PwReg2.
+//
+// See also NewDeviceSecret.
+func PwReg2WithDevice(sess *PwRegClientSession, msg2 PwRegMsg2, deviceSecret []byte) (PwRegMsg3, error) {
+	return PwReg2WithData(sess, msg2, deviceSecret, sess.data)
+}
+
+// PwReg2WithData is like PwReg2WithDevice but data is stored in the envelope
+// together with the user's keys. The data is returned by
+// AuthClientSession.EnvelopeData after each successful run of the
+// authentication protocol, which lets the server act as a store for roaming
+// credentials without learning them. If data.Key is an *rsa.PrivateKey it
+// becomes the user's key pair instead of a newly generated key. It must then
+// have at least the number of bits given to PwRegInit.
+func PwReg2WithData(sess *PwRegClientSession, msg2 PwRegMsg2, deviceSecret []byte, data *EnvelopeData) (PwRegMsg3, error) {
 	// From the I-D:
 	//   U: upon receiving values b and v, set the PRF output to H(x, v, b*v^{-r})
 	//
 	//   U generates an "envelope" EnvU defined as EnvU = AuthEnc(RwdU; PrivU, PubU,
 	//   PubS, vU)
 
-	rwdU, err := dhOprf3(sess.password, msg2.V, msg2.B, sess.r)
-	if err != nil {
-		return PwRegMsg3{}, err
+	if sess.code != nil {
+		if msg2.V == nil || msg2.B == nil || !hmac.Equal(regCodeMac2(sess.code.Key, sess.a, msg2), msg2.CodeMac) {
+			return PwRegMsg3{}, ErrInvalidRegCode
+		}
 	}
-	privU, err := rsa.GenerateKey(randr, sess.bits)
+	rwdU, err := finalizeOprf(sess.blind, sess.info, msg2.V, msg2.B)
 	if err != nil {
 		return PwRegMsg3{}, err
 	}
+	privU := sess.privU
+	if data != nil {
+		if key, ok := data.Key.(*rsa.PrivateKey); ok {
+			if privU != nil && !privU.Equal(key) {
+				return PwRegMsg3{}, errors.New("key differs from the account's key")
+			}
+			if key.N.BitLen() < sess.bits {
+				return PwRegMsg3{}, fmt.Errorf("key has %d bits, expected at least %d", key.N.BitLen(), sess.bits)
+			}
+			privU = key
+		}
+	}
+	if privU == nil {
+		privU, err = rsa.GenerateKey(rsaRandom(), sess.bits)
+		if err != nil {
+			return PwRegMsg3{}, err
+		}
+	}
 	env := envU{
 		privU: privU,
 		pubS:  msg2.PubS,
+		data:  data,
 	}
 
-	encodedEnvU := encodeEnvU(&env)
-	encryptedEnvU, err := authenc.AuthEnc(randr, rwdU[:16], encodedEnvU)
+	encodedEnvU, err := encodeEnvU(&env)
+	if err != nil {
+		return PwRegMsg3{}, err
+	}
+	key, err := envelopeKey(rwdU, deviceSecret)
+	if err != nil {
+		return PwRegMsg3{}, err
+	}
+	encryptedEnvU, err := authenc.AuthEnc(randr, key, encodedEnvU)
 	if err != nil {
 		return PwRegMsg3{}, err
 	}
-	return PwRegMsg3{EnvU: encryptedEnvU, PubU: &privU.PublicKey}, nil
+	msg3 := PwRegMsg3{EnvU: encryptedEnvU, PubU: &privU.PublicKey}
+	if sess.code != nil {
+		msg3.CodeMac = regCodeMac(sess.code.Key, "PwRegMsg3", dhGroup.Bytes(sess.a), msg3.EnvU, x509.MarshalPKCS1PublicKey(msg3.PubU))
+	}
+	return msg3, nil
 }
 
 // PwReg3 is invoked on the server after it has received a PwRegMsg3 struct from
@@ -214,11 +427,31 @@ func PwReg3(sess *PwRegServerSession, msg3 PwRegMsg3) *User {
 	//       S stores (EnvU, PubS, PrivS, PubU, kU, vU) in a user-specific
 	//       record.  If PrivS and PubS are used for different users, they can
 	//       be stored separately and omitted from the record.
+	now := time.Now()
 	return &User{
-		Username: sess.username,
-		K:        sess.k,
-		V:        sess.v,
-		EnvU:     msg3.EnvU,
-		PubU:     msg3.PubU,
+		Username:        sess.username,
+		K:               sess.k,
+		V:               sess.v,
+		Info:            sess.info,
+		EnvU:            msg3.EnvU,
+		PubU:            msg3.PubU,
+		Created:         now,
+		PasswordChanged: now,
+	}
+}
+
+// PwReg3WithCode is like PwReg3 but it is used when the session was created by
+// PwReg1WithCode. ErrInvalidRegCode is returned if msg3 wasn't created by the
+// holder of the registration code.
+//
+// See also PwRegInitWithCode and PwReg1WithCode.
+func PwReg3WithCode(sess *PwRegServerSession, msg3 PwRegMsg3) (*User, error) {
+	if sess.code == nil || msg3.PubU == nil {
+		return nil, ErrInvalidRegCode
+	}
+	mac := regCodeMac(sess.code.Key, "PwRegMsg3", dhGroup.Bytes(sess.a), msg3.EnvU, x509.MarshalPKCS1PublicKey(msg3.PubU))
+	if !hmac.Equal(mac, msg3.CodeMac) {
+		return nil, ErrInvalidRegCode
 	}
+	return PwReg3(sess, msg3), nil
 }
@@ -0,0 +1,111 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// crypto/rsa only uses the reader it's given with this setting, see SetRandom.
+// It applies to the whole test binary, including TestVectors.
+//go:debug cryptocustomrand=1
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/frekui/opaque/internal/pkg/drbg"
+)
+
+// transcript runs password registration and authentication with randomness
+// from a DRBG seeded with seed and returns all messages and the shared secret.
+func transcript(t *testing.T, seed string) []byte {
+	SetRandom(drbg.New([]byte(seed)))
+	defer SetRandom(nil)
+
+	privS, err := rsa.GenerateKey(rsaRandom(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []interface{}
+	cs, rmsg1, err := PwRegInit("user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, rmsg2, err := PwReg1(privS, rmsg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmsg3, err := PwReg2(cs, rmsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := PwReg3(ss, rmsg3)
+	msgs = append(msgs, rmsg1, rmsg2, rmsg3)
+
+	ca, amsg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, amsg2, err := Auth1(privS, user, amsg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, amsg3, err := Auth2(ca, amsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Auth3(sa, amsg3); err != nil {
+		t.Fatal(err)
+	}
+	msgs = append(msgs, amsg1, amsg2, amsg3, secret)
+
+	out, err := json.Marshal(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestSetRandom(t *testing.T) {
+	a := transcript(t, "seed")
+	b := transcript(t, "seed")
+	if !bytes.Equal(a, b) {
+		t.Fatal("Runs with the same seed differ")
+	}
+	if c := transcript(t, "other seed"); bytes.Equal(a, c) {
+		t.Fatal("Runs with different seeds are equal")
+	}
+	randMu.RLock()
+	defer randMu.RUnlock()
+	if randSrc != (internalReader{rand.Reader}) || customRandom {
+		t.Fatal("SetRandom(nil) didn't restore crypto/rand.Reader")
+	}
+}
+
+// TestSetRandomConcurrent calls SetRandom while other goroutines read from the
+// source. It's meant to be run with -race.
+func TestSetRandomConcurrent(t *testing.T) {
+	defer SetRandom(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := GenerateUsernameKey(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		SetRandom(drbg.New([]byte("seed")))
+		SetRandom(nil)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains one-time registration codes. They make it possible to run
+// the password registration protocol over an unauthenticated connection: the
+// server only accepts a registration if the client proves that it holds a code
+// previously issued by the server.
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RegCode is a one-time registration code. Codes are issued by the server (see
+// RegCodeStore.Issue) and handed to the user out-of-band, typically as the
+// string returned by String.
+type RegCode struct {
+	// ID identifies the code in the server's store. It is sent in clear
+	// in PwRegMsg1.
+	ID string
+
+	// Key is the secret part of the code. It is never sent over the
+	// network, it is only used as a MAC key.
+	Key []byte
+
+	// Expires is the point in time after which the server no longer
+	// accepts the code. It is only used on the server.
+	Expires time.Time
+}
+
+// ErrInvalidRegCode is returned by the server if a registration code is
+// unknown, has expired, has already been used, or if the client failed to
+// prove that it holds the code. It is returned by the client if the server
+// failed to prove that it holds the code.
+var ErrInvalidRegCode = errors.New("invalid registration code")
+
+// String returns the code in a form suitable for handing to a user. The string
+// can be turned back into a RegCode using ParseRegCode.
+func (c *RegCode) String() string {
+	return c.ID + "." + base64.RawURLEncoding.EncodeToString(c.Key)
+}
+
+// ParseRegCode parses a string created by RegCode.String. The returned code
+// has a zero Expires field.
+func ParseRegCode(s string) (*RegCode, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, errors.New("malformed registration code")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 16 {
+		return nil, errors.New("malformed registration code")
+	}
+	return &RegCode{ID: parts[0], Key: key}, nil
+}
+
+// RegCodeStore keeps track of registration codes issued by the server. Each
+// code can be redeemed at most once. It is safe to use a RegCodeStore from
+// multiple goroutines.
+type RegCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]*RegCode
+}
+
+// NewRegCodeStore returns an empty RegCodeStore.
+func NewRegCodeStore() *RegCodeStore {
+	return &RegCodeStore{codes: map[string]*RegCode{}}
+}
+
+// Issue generates a new registration code which is valid for ttl and adds it
+// to the store.
+func (s *RegCodeStore) Issue(ttl time.Duration) (*RegCode, error) {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(randr, id); err != nil {
+		return nil, err
+	}
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(randr, key); err != nil {
+		return nil, err
+	}
+	code := &RegCode{
+		ID:      hex.EncodeToString(id),
+		Key:     key,
+		Expires: time.Now().Add(ttl),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code.ID] = code
+	return code, nil
+}
+
+// Len returns the number of codes in the store which haven't been redeemed
+// yet. Expired codes are included in the count.
+func (s *RegCodeStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.codes)
+}
+
+// redeem removes the code with the given id from the store and returns it if
+// verify returns true for it. verify is called with the store locked, so that
+// two concurrent registrations can't both redeem a code. Expired codes are
+// removed without calling verify. A code for which verify returns false stays
+// in the store.
+func (s *RegCodeStore) redeem(id string, verify func(code *RegCode) bool) (*RegCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.codes[id]
+	if !ok {
+		return nil, ErrInvalidRegCode
+	}
+	if time.Now().After(code.Expires) {
+		delete(s.codes, id)
+		return nil, ErrInvalidRegCode
+	}
+	if !verify(code) {
+		return nil, ErrInvalidRegCode
+	}
+	delete(s.codes, id)
+	return code, nil
+}
+
+// regCodeMac computes a MAC over label and parts using the secret part of a
+// registration code as key. Each part is prefixed by its length so that the
+// encoding is unambiguous.
+func regCodeMac(key []byte, label string, parts ...[]byte) []byte {
+	mac := hmac.New(hasher, key)
+	mac.Write([]byte(label))
+	for _, p := range parts {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(p)))
+		mac.Write(l[:])
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
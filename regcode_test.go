@@ -0,0 +1,150 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// pwregWithCode runs the password registration protocol using the registration
+// code clientCode on the client. The server looks up codes in store.
+func pwregWithCode(privS *rsa.PrivateKey, store *RegCodeStore, clientCode *RegCode, msg1Mod func(*PwRegMsg1), msg3Mod func(*PwRegMsg3), msg2Mod func(*PwRegMsg2)) (*User, error) {
+	clientSession, msg1, err := PwRegInitWithCode("user", "password", 512, clientCode)
+	if err != nil {
+		return nil, err
+	}
+	if msg1Mod != nil {
+		msg1Mod(&msg1)
+	}
+	serverSession, msg2, err := PwReg1WithCode(privS, store, msg1)
+	if err != nil {
+		return nil, fmt.Errorf("server: %s", err)
+	}
+	if msg2Mod != nil {
+		msg2Mod(&msg2)
+	}
+	msg3, err := PwReg2(clientSession, msg2)
+	if err != nil {
+		return nil, fmt.Errorf("client: %s", err)
+	}
+	if msg3Mod != nil {
+		msg3Mod(&msg3)
+	}
+	user, err := PwReg3WithCode(serverSession, msg3)
+	if err != nil {
+		return nil, fmt.Errorf("server: %s", err)
+	}
+	return user, nil
+}
+
+func TestRegCode(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewRegCodeStore()
+
+	code, err := store.Issue(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCode, err := ParseRegCode(code.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := pwregWithCode(privS, store, clientCode, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate(privS, user, "password", nil, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The code has been used and must not be accepted again.
+	if _, err := pwregWithCode(privS, store, clientCode, nil, nil, nil); err == nil || err.Error() != "server: invalid registration code" {
+		t.Fatalf("Reused code: got error %v", err)
+	}
+
+	expired, err := store.Issue(-time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pwregWithCode(privS, store, expired, nil, nil, nil); err == nil || err.Error() != "server: invalid registration code" {
+		t.Fatalf("Expired code: got error %v", err)
+	}
+
+	// A msg1 with a bad MAC is rejected but doesn't burn the code, since its
+	// id is sent in clear. Failures after that do.
+	for idx, tst := range []struct {
+		keyMod  func(key []byte)
+		msg1Mod func(*PwRegMsg1)
+		msg3Mod func(*PwRegMsg3)
+		burnt   bool
+	}{
+		{func(key []byte) { key[0] ^= 42 }, nil, nil, false},
+		{nil, func(msg1 *PwRegMsg1) { msg1.Username = "other" }, nil, false},
+		{nil, func(msg1 *PwRegMsg1) { msg1.CodeMac = nil }, nil, false},
+		{nil, nil, func(msg3 *PwRegMsg3) { msg3.EnvU[0] ^= 42 }, true},
+		{nil, nil, func(msg3 *PwRegMsg3) { msg3.CodeMac = nil }, true},
+	} {
+		code, err := store.Issue(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientCode := &RegCode{ID: code.ID, Key: append([]byte(nil), code.Key...)}
+		if tst.keyMod != nil {
+			tst.keyMod(clientCode.Key)
+		}
+		_, err = pwregWithCode(privS, store, clientCode, tst.msg1Mod, tst.msg3Mod, nil)
+		if err == nil || err.Error() != "server: invalid registration code" {
+			t.Fatalf("Test %d: got error %v", idx, err)
+		}
+		if tst.burnt {
+			continue
+		}
+		// The holder of the code can still use it.
+		if _, err := pwregWithCode(privS, store, code, nil, nil, nil); err != nil {
+			t.Fatalf("Test %d: %s", idx, err)
+		}
+	}
+
+	// A msg1 for another protocol version doesn't burn the code either.
+	code, err = store.Issue(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pwregWithCode(privS, store, code, func(msg1 *PwRegMsg1) { msg1.Version = ProtocolVersion + 1 }, nil, nil)
+	if err == nil || err.Error() != "server: "+ErrVersionMismatch.Error() {
+		t.Fatalf("Version mismatch: got error %v", err)
+	}
+	if _, err := pwregWithCode(privS, store, code, nil, nil, nil); err != nil {
+		t.Fatalf("Code burnt by version mismatch: %s", err)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("store.Len() = %d, expected 0", store.Len())
+	}
+
+	// The client rejects a msg2 which isn't authenticated with the code.
+	for idx, msg2Mod := range []func(*PwRegMsg2){
+		func(msg2 *PwRegMsg2) { msg2.B.Add(msg2.B, big.NewInt(1)) },
+		func(msg2 *PwRegMsg2) { msg2.V = big.NewInt(4) },
+		func(msg2 *PwRegMsg2) { pub := *msg2.PubS; pub.E = 3; msg2.PubS = &pub },
+		func(msg2 *PwRegMsg2) { msg2.CodeMac = nil },
+	} {
+		code, err := store.Issue(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pwregWithCode(privS, store, code, nil, nil, msg2Mod)
+		if err == nil || err.Error() != "client: invalid registration code" {
+			t.Fatalf("Msg2 test %d: got error %v", idx, err)
+		}
+	}
+}
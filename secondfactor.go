@@ -0,0 +1,190 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains the in-band second factor. If a user has a TOTP secret
+// (see EnableTOTP), Auth1 adds an encrypted challenge to AuthMsg2. The client
+// answers it with a TOTP code in an encrypted field of AuthMsg3 (see
+// AnswerSecondFactor), and Auth3 fails unless both the password proof and the
+// code verify. The challenge and the answer are encrypted with a key derived
+// from the MAC key of the session, so they are bound to the session and hidden
+// from eavesdroppers.
+//
+// TOTP codes are verified as described in RFC 6238 with HMAC-SHA1, a time step
+// of 30 seconds and six digits, as used by common authenticator apps. After
+// maxTOTPFailures wrong codes in a row the user is locked for totpLockout, so
+// that someone who knows the password can't try all codes.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/frekui/opaque/internal/pkg/authenc"
+	"github.com/frekui/opaque/internal/pkg/totp"
+	"golang.org/x/crypto/hkdf"
+)
+
+// secondFactorTOTP is the type of the challenge. It is the prefix of the
+// plaintext of the encrypted challenge in AuthMsg2.
+const secondFactorTOTP = "totp"
+
+// ErrSecondFactor is returned by Auth3 if the answer to the second factor
+// challenge is missing or doesn't verify.
+var ErrSecondFactor = errors.New("second factor failed")
+
+// After maxTOTPFailures wrong codes in a row the user is locked for
+// totpLockout.
+const (
+	maxTOTPFailures = 5
+	totpLockout     = 15 * time.Minute
+)
+
+// NewTOTPSecret generates a new random TOTP secret.
+func NewTOTPSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := io.ReadFull(randr, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EnableTOTP generates a new TOTP secret and stores it in the user of sess,
+// replacing any previous secret. EnableTOTP must only be called after Auth3
+// has returned successfully for sess. The returned secret should be sent to
+// the client, protected by the secret from the authentication protocol, and
+// entered into the user's authenticator app. The server needs to store the
+// updated User, see UpdateUser.
+func EnableTOTP(sess *AuthServerSession) ([]byte, error) {
+	if !sess.authenticated {
+		return nil, errors.New("authentication not completed")
+	}
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	sess.updates = append(sess.updates, func(user *User) {
+		user.TOTPSecret = secret
+		user.TOTPLastStep = 0
+		user.TOTPFailures = 0
+	})
+	return secret, nil
+}
+
+// TOTPCode returns the current TOTP code for secret. It's what an
+// authenticator app would show.
+func TOTPCode(secret []byte) string {
+	return totp.Code(secret, time.Now())
+}
+
+// SecondFactorRequired returns true if the server asked for a second factor
+// during the authentication protocol. It only returns true after Auth2 has
+// returned successfully, in which case AnswerSecondFactor must be called before
+// AuthMsg3 is sent.
+func (sess *AuthClientSession) SecondFactorRequired() bool {
+	return sess.challenge != nil
+}
+
+// AnswerSecondFactor is invoked on the client after Auth2 has returned
+// successfully if sess.SecondFactorRequired returns true. It adds the answer,
+// a TOTP code entered by the user, to msg3.
+func AnswerSecondFactor(sess *AuthClientSession, msg3 *AuthMsg3, code string) error {
+	if sess.challenge == nil {
+		return errors.New("no second factor challenge")
+	}
+	key, err := secondFactorKey(sess.dhMacKey)
+	if err != nil {
+		return err
+	}
+	answer := append(append([]byte{}, sess.challenge...), code...)
+	msg3.SecondFactor, err = authenc.AuthEnc(randr, key, answer)
+	return err
+}
+
+// secondFactorKey derives the key which protects the challenge and the answer.
+func secondFactorKey(dhMacKey []byte) ([]byte, error) {
+	kdf := hkdf.New(hasher, dhMacKey, nil, []byte("opaque second factor"))
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newSecondFactorChallenge creates a random challenge and encrypts it.
+func newSecondFactorChallenge(dhMacKey []byte) (challenge, encrypted []byte, err error) {
+	challenge = make([]byte, 16)
+	if _, err := io.ReadFull(randr, challenge); err != nil {
+		return nil, nil, err
+	}
+	key, err := secondFactorKey(dhMacKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypted, err = authenc.AuthEnc(randr, key, append([]byte(secondFactorTOTP), challenge...))
+	if err != nil {
+		return nil, nil, err
+	}
+	return challenge, encrypted, nil
+}
+
+// openSecondFactorChallenge decrypts an encrypted challenge.
+func openSecondFactorChallenge(dhMacKey, encrypted []byte) ([]byte, error) {
+	key, err := secondFactorKey(dhMacKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := authenc.AuthDec(key, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(plaintext, []byte(secondFactorTOTP)) || len(plaintext) != len(secondFactorTOTP)+16 {
+		return nil, errors.New("unsupported second factor")
+	}
+	return plaintext[len(secondFactorTOTP):], nil
+}
+
+// verifySecondFactor verifies the answer in msg3 if sess has a challenge. On
+// success the time step of the code is recorded in the user so that the code
+// can't be used again. Wrong codes are counted, see maxTOTPFailures. Both are
+// recorded as changes to the user, see UpdateUser.
+func verifySecondFactor(sess *AuthServerSession, msg3 AuthMsg3) error {
+	if sess.challenge == nil {
+		return nil
+	}
+	key, err := secondFactorKey(sess.dhMacKey)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	step, ok := int64(0), false
+	answer, err := authenc.AuthDec(key, msg3.SecondFactor)
+	if err == nil && len(answer) >= len(sess.challenge) && hmac.Equal(answer[:len(sess.challenge)], sess.challenge) {
+		code := string(answer[len(sess.challenge):])
+		step, ok = totp.Verify(sess.user.TOTPSecret, code, now, sess.user.TOTPLastStep)
+	}
+	if !ok {
+		sess.updates = append(sess.updates, func(user *User) {
+			user.TOTPFailures++
+			if user.TOTPFailures >= maxTOTPFailures {
+				user.TOTPFailures = 0
+				if until := now.Add(totpLockout); until.After(user.LockedUntil) {
+					user.LockedUntil = until
+				}
+			}
+		})
+		return ErrSecondFactor
+	}
+	sess.updates = append(sess.updates, func(user *User) {
+		if step > user.TOTPLastStep {
+			user.TOTPLastStep = step
+		}
+		user.TOTPFailures = 0
+	})
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/frekui/opaque/internal/pkg/totp"
+)
+
+// authenticateTOTP runs the authentication protocol and answers the second
+// factor challenge with code. The user with the changes made by Auth3 and the
+// error from Auth3 are returned.
+func authenticateTOTP(t *testing.T, privS *rsa.PrivateKey, user *User, code string) (*User, error) {
+	cSess, msg1, err := AuthInit(user.Username, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cSecret, msg3, err := Auth2(cSess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cSess.SecondFactorRequired() {
+		t.Fatalf("Second factor not required")
+	}
+	if code != "" {
+		if err := AnswerSecondFactor(cSess, &msg3, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sSecret, err := Auth3(sSess, msg3)
+	user = sSess.UpdateUser(user)
+	if err != nil {
+		return user, err
+	}
+	if !bytes.Equal(cSecret, sSecret) {
+		t.Fatalf("Shared secrets differ")
+	}
+	return user, nil
+}
+
+func TestSecondFactor(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cSess, sSess, err := authenticateDevice(privS, user, "password", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cSess.SecondFactorRequired() {
+		t.Fatalf("Second factor required before EnableTOTP")
+	}
+	secret, err := EnableTOTP(sSess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.TOTPSecret != nil {
+		t.Fatalf("EnableTOTP modified the user of the session")
+	}
+	user = sSess.UpdateUser(user)
+
+	// Codes from the previous time step are accepted, but only once.
+	prev := totp.Code(secret, time.Now().Add(-totp.Step))
+	if user, err = authenticateTOTP(t, privS, user, prev); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = authenticateTOTP(t, privS, user, prev); err != ErrSecondFactor {
+		t.Fatalf("Reused code: got %v", err)
+	}
+	if user, err = authenticateTOTP(t, privS, user, TOTPCode(secret)); err != nil {
+		t.Fatal(err)
+	}
+	if user.TOTPFailures != 0 {
+		t.Fatalf("TOTPFailures is %d after a correct code", user.TOTPFailures)
+	}
+	if user, err = authenticateTOTP(t, privS, user, ""); err != ErrSecondFactor {
+		t.Fatalf("Missing code: got %v", err)
+	}
+	wrong := totp.Code(secret, time.Now().Add(-10*totp.Step))
+	for i := 1; i < maxTOTPFailures; i++ {
+		if user, err = authenticateTOTP(t, privS, user, wrong); err != ErrSecondFactor {
+			t.Fatalf("Wrong code: got %v", err)
+		}
+	}
+	// The user is locked after too many wrong codes.
+	_, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Auth1(privS, user, msg1); err != ErrUserLocked {
+		t.Fatalf("Auth1 after %d wrong codes: got %v", maxTOTPFailures, err)
+	}
+	user.LockedUntil = time.Time{}
+
+	// The challenge can't be stripped from AuthMsg2.
+	cSess, msg1, err = AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg2.SecondFactor = nil
+	if _, _, err := Auth2(cSess, msg2); err == nil || err.Error() != "MAC mismatch" {
+		t.Fatalf("Stripped challenge: got %v", err)
+	}
+
+	// The second factor can only be enabled from authenticated sessions.
+	_, msg1, err = AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, _, err = Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EnableTOTP(sSess); err == nil {
+		t.Fatalf("EnableTOTP succeeded before authentication")
+	}
+}
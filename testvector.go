@@ -0,0 +1,143 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains the generation of known-answer test vectors: a run of
+// password registration followed by a run of authentication where all
+// randomness comes from a DRBG with a fixed seed, recorded together with the
+// intermediate values of both parties. cmd/katgen writes them to a file and
+// TestVectors checks that the implementation still produces the committed
+// vectors, so that changes to the protocol don't go unnoticed.
+//
+// The RSA keys are inputs rather than being generated from the seed, since
+// crypto/rsa's key generation may change between Go releases.
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"math/big"
+
+	"github.com/frekui/opaque/internal/pkg/drbg"
+)
+
+// TestVector is a known-answer test vector for a run of PwRegInit, PwReg1,
+// PwReg2 and PwReg3 followed by a run of AuthInit, Auth1, Auth2 and Auth3.
+type TestVector struct {
+	// Inputs. All randomness is read from drbg.New(Seed). PrivS and PrivU
+	// are the server's and the user's private RSA keys in PKCS #1 form.
+	Seed     []byte
+	Username string
+	Password string
+	PrivS    []byte
+	PrivU    []byte
+
+	Registration RegistrationVector
+	Login        LoginVector
+}
+
+// RegistrationVector holds the intermediate values and messages of password
+// registration.
+type RegistrationVector struct {
+	R    *big.Int // Client's OPRF blinding factor
+	K    *big.Int // OPRF key
+	RwdU []byte
+	Msg1 PwRegMsg1
+	Msg2 PwRegMsg2
+	Msg3 PwRegMsg3
+}
+
+// LoginVector holds the intermediate values and messages of authentication.
+type LoginVector struct {
+	R              *big.Int // Client's OPRF blinding factor
+	X              *big.Int // Client's ephemeral private D-H key
+	Y              *big.Int // Server's ephemeral private D-H key
+	RwdU           []byte
+	DhSharedSecret []byte
+	DhMacKey       []byte
+	Msg1           AuthMsg1
+	Msg2           AuthMsg2
+	Msg3           AuthMsg3
+	Secret         []byte
+	ExportKey      []byte
+}
+
+// NewTestVector runs password registration and authentication for username
+// and password with the given RSA keys and returns the resulting test vector.
+//
+// The randomness is set with SetRandom for the duration of the call and the
+// default is restored afterwards, so NewTestVector must not be called
+// concurrently with other functions of the package. The signatures are only
+// reproducible if the program is run with GODEBUG=cryptocustomrand=1, see
+// SetRandom.
+func NewTestVector(seed []byte, username, password string, privS, privU *rsa.PrivateKey) (*TestVector, error) {
+	SetRandom(drbg.New(seed))
+	defer SetRandom(nil)
+
+	tv := &TestVector{
+		Seed:     seed,
+		Username: username,
+		Password: password,
+		PrivS:    x509.MarshalPKCS1PrivateKey(privS),
+		PrivU:    x509.MarshalPKCS1PrivateKey(privU),
+	}
+
+	reg := &tv.Registration
+	cs, rmsg1, err := PwRegInit(username, password, privU.N.BitLen())
+	if err != nil {
+		return nil, err
+	}
+	cs.privU = privU
+	ss, rmsg2, err := PwReg1(privS, rmsg1)
+	if err != nil {
+		return nil, err
+	}
+	rmsg3, err := PwReg2(cs, rmsg2)
+	if err != nil {
+		return nil, err
+	}
+	user := PwReg3(ss, rmsg3)
+	reg.R = cs.blind.R
+	reg.K = ss.k
+	// PwReg2 doesn't keep RwdU, so compute it again.
+	reg.RwdU, err = finalizeOprf(cs.blind, nil, rmsg2.V, rmsg2.B)
+	if err != nil {
+		return nil, err
+	}
+	reg.Msg1, reg.Msg2, reg.Msg3 = rmsg1, rmsg2, rmsg3
+
+	login := &tv.Login
+	ca, amsg1, err := AuthInit(username, password)
+	if err != nil {
+		return nil, err
+	}
+	sa, amsg2, err := Auth1(privS, user, amsg1)
+	if err != nil {
+		return nil, err
+	}
+	secret, amsg3, err := Auth2(ca, amsg2)
+	if err != nil {
+		return nil, err
+	}
+	serverSecret, err := Auth3(sa, amsg3)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(secret, serverSecret) {
+		return nil, errors.New("shared secrets differ")
+	}
+	login.R = ca.blind.R
+	login.X = ca.x
+	login.Y = sa.y
+	login.RwdU = ca.rwdU
+	login.DhSharedSecret = sa.dhSharedSecret
+	login.DhMacKey = sa.dhMacKey
+	login.Msg1, login.Msg2, login.Msg3 = amsg1, amsg2, amsg3
+	login.Secret = secret
+	login.ExportKey = ca.ExportKey()
+	return tv, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+// diffFields returns the names of the top-level JSON fields which differ
+// between a and b.
+func diffFields(t *testing.T, a, b interface{}) []string {
+	var ma, mb map[string]json.RawMessage
+	for _, x := range []struct {
+		v interface{}
+		m *map[string]json.RawMessage
+	}{{a, &ma}, {b, &mb}} {
+		data, err := json.Marshal(x.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, x.m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var diff []string
+	for k, va := range ma {
+		if vb, ok := mb[k]; !ok || !bytes.Equal(va, vb) {
+			diff = append(diff, k)
+		}
+	}
+	for k := range mb {
+		if _, ok := ma[k]; !ok {
+			diff = append(diff, k)
+		}
+	}
+	return diff
+}
+
+// TestVectors checks that the implementation produces the vectors in
+// testdata/vectors.json, which are written by cmd/katgen. If a change to the
+// protocol is intended, regenerate them with
+//
+//	go run ./cmd/katgen -o testdata/vectors.json
+func TestVectors(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []*TestVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("No test vectors")
+	}
+	for i, want := range vectors {
+		privS, err := x509.ParsePKCS1PrivateKey(want.PrivS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privU, err := x509.ParsePKCS1PrivateKey(want.PrivU)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := NewTestVector(want.Seed, want.Username, want.Password, privS, privU)
+		if err != nil {
+			t.Fatalf("Vector %d: %s", i, err)
+		}
+		if diff := diffFields(t, got.Registration, want.Registration); diff != nil {
+			t.Errorf("Vector %d: registration differs in %v", i, diff)
+		}
+		if diff := diffFields(t, got.Login, want.Login); diff != nil {
+			t.Errorf("Vector %d: login differs in %v", i, diff)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains anonymous tokens in the style of Privacy Pass. After a
+// successful login the server issues a batch of tokens with the verifiable
+// OPRF from package oprf:
+//
+//     Client                                Server
+//     NewTokenRequest   TokenRequest  ->    IssueTokens
+//     FinalizeTokens <- TokenResponse
+//
+// Each token is a random nonce together with the OPRF output for it under the
+// issuer key. The server only sees blinded nonces, so a token can't be linked to
+// the login in which it was issued, and the proof in TokenResponse shows that
+// the same issuer key is used for all users. The client can later spend a token
+// on an anonymous request to any service which holds the issuer key, which
+// checks it with TokenStore.Redeem. Each token can be redeemed once.
+//
+// The number of tokens issued to a user is limited by a TokenQuota, which counts
+// the tokens issued to each user in a sliding time window. A limit per session
+// wouldn't help, as a user can log in as many times as they like.
+
+import (
+	"crypto/hmac"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/frekui/opaque/oprf"
+)
+
+// MaxTokens is the maximum number of tokens issued to a user within the window
+// of a TokenQuota.
+const MaxTokens = 100
+
+// ErrInvalidToken is returned by TokenStore.Redeem if a token wasn't issued
+// with the store's key or if it has already been redeemed.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Token is an anonymous token. It's created by FinalizeTokens.
+type Token struct {
+	Nonce  []byte
+	Output []byte
+}
+
+// TokenRequest is sent from the client to the server to request tokens.
+//
+// Users of package opaque does not need to read nor write to any fields in this
+// struct except to serialize and deserialize the struct when it's sent between
+// the peers.
+type TokenRequest struct {
+	Blinded []oprf.BlindedElement
+}
+
+// TokenResponse is the server's response to a TokenRequest.
+//
+// Users of package opaque does not need to read nor write to any fields in this
+// struct except to serialize and deserialize the struct when it's sent between
+// the peers.
+type TokenResponse struct {
+	Eval  oprf.BatchEvaluation
+	Proof oprf.Proof
+}
+
+// TokenClientSession keeps track of state needed on the client-side between
+// NewTokenRequest and FinalizeTokens.
+type TokenClientSession struct {
+	nonces  [][]byte
+	states  []*oprf.State
+	blinded []oprf.BlindedElement
+}
+
+// NewTokenRequest is invoked on the client after Auth2 has returned
+// successfully. It creates a request for n tokens, which should be sent to the
+// server over the channel protected by the session's secret.
+func NewTokenRequest(sess *AuthClientSession, n int) (*TokenClientSession, TokenRequest, error) {
+	if sess.env == nil {
+		return nil, TokenRequest{}, errors.New("authentication not completed")
+	}
+	if n <= 0 || n > MaxTokens {
+		return nil, TokenRequest{}, errors.New("invalid number of tokens")
+	}
+	tsess := &TokenClientSession{}
+	for i := 0; i < n; i++ {
+		nonce := make([]byte, 32)
+		if _, err := io.ReadFull(randr, nonce); err != nil {
+			return nil, TokenRequest{}, err
+		}
+		state, blinded, err := oprf.Blind(tokenInput(nonce))
+		if err != nil {
+			return nil, TokenRequest{}, err
+		}
+		tsess.nonces = append(tsess.nonces, nonce)
+		tsess.states = append(tsess.states, state)
+		tsess.blinded = append(tsess.blinded, blinded)
+	}
+	return tsess, TokenRequest{Blinded: tsess.blinded}, nil
+}
+
+// IssueTokens is invoked on the server when it has received a TokenRequest.
+// IssueTokens must only be called after Auth3 has returned successfully for
+// sess. key is the issuer key, which is the same for all users. The tokens are
+// counted in quota, which should be shared by all sessions, and
+// ErrTokenQuotaExceeded is returned if the user of sess would get more than
+// MaxTokens tokens within the quota's window. A request is counted even if
+// it's rejected because of an invalid element.
+func IssueTokens(key *oprf.Key, quota *TokenQuota, sess *AuthServerSession, req TokenRequest) (TokenResponse, error) {
+	if !sess.authenticated {
+		return TokenResponse{}, errors.New("authentication not completed")
+	}
+	n := len(req.Blinded)
+	if n == 0 {
+		return TokenResponse{}, errors.New("no tokens requested")
+	}
+	if err := quota.take(sess.user.Username, n); err != nil {
+		return TokenResponse{}, err
+	}
+	eval, proof, err := key.EvaluateBatchWithProof(req.Blinded)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{Eval: eval, Proof: proof}, nil
+}
+
+// ErrTokenQuotaExceeded is returned by IssueTokens if a user requests more
+// tokens than their quota allows.
+var ErrTokenQuotaExceeded = errors.New("too many tokens requested")
+
+// TokenQuota counts the tokens issued to each user by IssueTokens, so that at
+// most MaxTokens tokens are issued to a user within a sliding window. It is
+// safe to use a TokenQuota from multiple goroutines.
+type TokenQuota struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	issued map[string][]tokenGrant
+}
+
+// tokenGrant records that n tokens were issued at a point in time.
+type tokenGrant struct {
+	at time.Time
+	n  int
+}
+
+// NewTokenQuota returns an empty TokenQuota with the given window, e.g., 24
+// hours.
+func NewTokenQuota(window time.Duration) *TokenQuota {
+	return &TokenQuota{window: window, issued: map[string][]tokenGrant{}}
+}
+
+// take records that n tokens are issued to username, unless the user would
+// then have more than MaxTokens tokens within the window. Grants which have
+// left the window are dropped, together with users that have no grants left.
+func (q *TokenQuota) take(username string, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for name, grants := range q.issued {
+		for len(grants) > 0 && now.Sub(grants[0].at) >= q.window {
+			grants = grants[1:]
+		}
+		if len(grants) == 0 {
+			delete(q.issued, name)
+		} else {
+			q.issued[name] = grants
+		}
+	}
+	total := n
+	for _, g := range q.issued[username] {
+		total += g.n
+	}
+	if total > MaxTokens {
+		return ErrTokenQuotaExceeded
+	}
+	q.issued[username] = append(q.issued[username], tokenGrant{at: now, n: n})
+	return nil
+}
+
+// FinalizeTokens is invoked on the client when it has received the
+// TokenResponse. pub is the issuer's public key (oprf.Key.V), which the client
+// must have obtained in a trusted way, e.g., published by the server. An error
+// is returned if the tokens weren't issued with that key.
+func FinalizeTokens(tsess *TokenClientSession, pub *big.Int, resp TokenResponse) ([]Token, error) {
+	if err := oprf.VerifyBatch(pub, tsess.blinded, resp.Eval, resp.Proof); err != nil {
+		return nil, err
+	}
+	outputs, err := oprf.FinalizeBatch(tsess.states, resp.Eval)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]Token, len(outputs))
+	for i := range outputs {
+		tokens[i] = Token{Nonce: tsess.nonces[i], Output: outputs[i]}
+	}
+	return tokens, nil
+}
+
+// TokenStore redeems tokens issued with a given key and remembers which tokens
+// have been redeemed. It is safe to use a TokenStore from multiple goroutines.
+// The store grows with each redeemed token; rotating the issuer key allows the
+// store for the old key to be dropped once its tokens are no longer accepted.
+type TokenStore struct {
+	key *oprf.Key
+
+	mu    sync.Mutex
+	spent map[string]bool
+}
+
+// NewTokenStore returns an empty TokenStore for tokens issued with key.
+func NewTokenStore(key *oprf.Key) *TokenStore {
+	return &TokenStore{key: key, spent: map[string]bool{}}
+}
+
+// Redeem checks that token was issued with the store's key and hasn't been
+// redeemed before. ErrInvalidToken is returned otherwise.
+func (s *TokenStore) Redeem(token Token) error {
+	if len(token.Nonce) != 32 || !hmac.Equal(s.key.Output(tokenInput(token.Nonce)), token.Output) {
+		return ErrInvalidToken
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spent[string(token.Nonce)] {
+		return ErrInvalidToken
+	}
+	s.spent[string(token.Nonce)] = true
+	return nil
+}
+
+// Len returns the number of redeemed tokens.
+func (s *TokenStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.spent)
+}
+
+// tokenInput returns the OPRF input for a token nonce.
+func tokenInput(nonce []byte) []byte {
+	return append([]byte("opaque token"), nonce...)
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/frekui/opaque/oprf"
+)
+
+func TestTokens(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := oprf.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cSess, sSess, err := authenticateCredential(privS, user, "", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota := NewTokenQuota(time.Hour)
+	tSess, req, err := NewTokenRequest(cSess, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := IssueTokens(issuer, quota, sSess, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := FinalizeTokens(tSess, issuer.V, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 3 {
+		t.Fatalf("Expected 3 tokens, got %d", len(tokens))
+	}
+
+	// Each token can be redeemed once.
+	store := NewTokenStore(issuer)
+	for _, token := range tokens {
+		if err := store.Redeem(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Redeem(tokens[0]); err != ErrInvalidToken {
+		t.Fatalf("Double spend: got %v", err)
+	}
+	if store.Len() != 3 {
+		t.Fatalf("Expected 3 redeemed tokens, got %d", store.Len())
+	}
+	forged := Token{Nonce: make([]byte, 32), Output: tokens[1].Output}
+	if err := store.Redeem(forged); err != ErrInvalidToken {
+		t.Fatalf("Forged token: got %v", err)
+	}
+
+	// Tokens issued with another key are rejected by the client.
+	other, err := oprf.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tSess, req, err = NewTokenRequest(cSess, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = IssueTokens(other, quota, sSess, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FinalizeTokens(tSess, issuer.V, resp); err != oprf.ErrProof {
+		t.Fatalf("Tokens from another key: got %v", err)
+	}
+
+	// At most MaxTokens are issued to a user within the window, also
+	// in a new session.
+	_, req, err = NewTokenRequest(cSess, MaxTokens-4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueTokens(issuer, quota, sSess, req); err != ErrTokenQuotaExceeded {
+		t.Fatalf("IssueTokens issued more than MaxTokens tokens: got %v", err)
+	}
+	cSess, sSess, err = authenticateCredential(privS, user, "", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, req, err = NewTokenRequest(cSess, MaxTokens-4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueTokens(issuer, quota, sSess, req); err != ErrTokenQuotaExceeded {
+		t.Fatalf("New session got more than MaxTokens tokens: got %v", err)
+	}
+	if _, err := IssueTokens(issuer, NewTokenQuota(time.Hour), sSess, req); err != nil {
+		t.Fatalf("Fresh quota: got %v", err)
+	}
+	// Tokens issued before the window don't count.
+	for i := range quota.issued["user"] {
+		quota.issued["user"][i].at = quota.issued["user"][i].at.Add(-time.Hour)
+	}
+	if _, err := IssueTokens(issuer, quota, sSess, req); err != nil {
+		t.Fatalf("Tokens before the window were counted: got %v", err)
+	}
+	if _, _, err := NewTokenRequest(cSess, MaxTokens+1); err == nil {
+		t.Fatalf("NewTokenRequest succeeded for more than MaxTokens tokens")
+	}
+
+	// Tokens are only issued in authenticated sessions.
+	_, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unauth, _, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, req, err = NewTokenRequest(cSess, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueTokens(issuer, quota, unauth, req); err == nil {
+		t.Fatalf("IssueTokens succeeded before authentication")
+	}
+}
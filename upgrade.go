@@ -0,0 +1,112 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains the online credential upgrade. Only the client, which
+// knows the password, can create a new envelope. If the server considers a
+// user's record outdated it asks for an upgrade with Auth1WithUpgrade. After a
+// successful run of the authentication protocol the client and server run the
+// password registration protocol again, protected by the shared secret, and
+// the server replaces the old record with the new one:
+//
+//     Client                              Server
+//     UpgradeInit           PwRegMsg1 ->  Upgrade1
+//     PwReg2            <-  PwRegMsg2
+//                           PwRegMsg3 ->  Upgrade3
+//
+// The new record has a new OPRF key and a new envelope. Envelopes for
+// additional devices (see AddDevice) are sealed using the old OPRF output,
+// additional credentials (see AddCredential3) contain the old private key and
+// decoy envelopes (see AddHoneyEnvelopes) are sealed with the old OPRF key and
+// have keys of the old size. None of them can be carried over to the new
+// record, so records which have them can't be upgraded. The devices and
+// credentials have to be removed first.
+
+import (
+	"crypto/rsa"
+	"errors"
+)
+
+// ErrUpgradeNotPossible is returned by Upgrade1 if the user's record can't be
+// upgraded, see CanUpgrade.
+var ErrUpgradeNotPossible = errors.New("record with devices, credentials or honey envelopes can't be upgraded")
+
+// UpgradeInit is invoked on the client after Auth2 has returned successfully.
+// It starts a run of the password registration protocol for the same username
+// and password as sess, using an RSA key with the given number of bits. The
+// rest of the registration is done with PwReg2 (or PwReg2WithDevice) as usual.
+// Application data in the old envelope (see PwReg2WithData) is stored in the
+// new envelope as well. If it holds the account's RSA key, that key is kept and
+// PwReg2 fails if it has fewer than bits bits.
+//
+// UpgradeInit is typically called when sess.UpgradeRequested returns true, but
+// the client may also upgrade on its own initiative.
+func UpgradeInit(sess *AuthClientSession, bits int) (*PwRegClientSession, PwRegMsg1, error) {
+	if sess.env == nil {
+		return nil, PwRegMsg1{}, errors.New("authentication not completed")
+	}
+	regSess, msg1, err := PwRegInit(sess.username, sess.password, bits)
+	if err != nil {
+		return nil, PwRegMsg1{}, err
+	}
+	regSess.data = sess.env.data
+	return regSess, msg1, nil
+}
+
+// Upgrade1 is like PwReg1 but it is invoked on the server for a PwRegMsg1
+// created by UpgradeInit. It verifies that the authentication protocol has
+// completed successfully for sess and that msg1 is for the same user, and
+// returns ErrUpgradeNotPossible if the user's record can't be upgraded. The
+// rest of the registration is done with Upgrade3, and the User it returns
+// should replace the user's old record.
+func Upgrade1(privS *rsa.PrivateKey, sess *AuthServerSession, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMsg2, error) {
+	if err := checkSessionUser(sess, msg1); err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	// The new record replaces the primary credential, so the client must
+	// know its password.
+	if sess.credentialID != "" || msg1.CredentialID != "" {
+		return nil, PwRegMsg2{}, errors.New("upgrade requires the primary credential")
+	}
+	if !CanUpgrade(sess.user) {
+		return nil, PwRegMsg2{}, ErrUpgradeNotPossible
+	}
+	return PwReg1(privS, msg1)
+}
+
+// Upgrade3 is like PwReg3 but it is invoked on the server for a session
+// created by Upgrade1. The returned User should replace the user's old record,
+// unless devices or credentials have been added to it since Upgrade1 was called
+// (CanUpgrade returns false). It keeps the lifecycle metadata and the second
+// factor of the old record. If the server asked for a password change in sess
+// (see AuthServerSession.PasswordChangeRequired) the new record counts as a new
+// password: PasswordChanged is updated and PasswordExpires and
+// MustChangePassword are cleared.
+func Upgrade3(sess *AuthServerSession, regSess *PwRegServerSession, msg3 PwRegMsg3) *User {
+	old := sess.user
+	user := PwReg3(regSess, msg3)
+	user.TOTPSecret = old.TOTPSecret
+	user.TOTPLastStep = old.TOTPLastStep
+	user.TOTPFailures = old.TOTPFailures
+	if !old.Created.IsZero() {
+		user.Created = old.Created
+	}
+	user.LastLogin = old.LastLogin
+	user.Disabled = old.Disabled
+	user.LockedUntil = old.LockedUntil
+	if !sess.passwordChange {
+		user.PasswordChanged = old.PasswordChanged
+		user.PasswordExpires = old.PasswordExpires
+		user.MustChangePassword = old.MustChangePassword
+	}
+	return user
+}
+
+// CanUpgrade returns true if user's record can be replaced by Upgrade3, i.e., if
+// it doesn't have devices, credentials or honey envelopes.
+func CanUpgrade(user *User) bool {
+	return len(user.DeviceEnvU) == 0 && len(user.Credentials) == 0 && user.HoneyEnvU == nil
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/rsa"
+	"testing"
+)
+
+func TestUpgrade(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cSess, amsg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, amsg2, err := Auth1WithUpgrade(privS, user, amsg1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The upgrade flag is covered by the MAC.
+	tampered := amsg2
+	tampered.Upgrade = false
+	if _, _, err := Auth2(cSess, tampered); err == nil || err.Error() != "MAC mismatch" {
+		t.Fatalf("Tampered upgrade flag: got %v", err)
+	}
+
+	_, amsg3, err := Auth2(cSess, amsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cSess.UpgradeRequested() {
+		t.Fatalf("Upgrade not requested")
+	}
+	_, earlyMsg1, err := UpgradeInit(cSess, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Upgrade1(privS, sSess, earlyMsg1); err == nil {
+		t.Fatalf("Upgrade1 succeeded before Auth3")
+	}
+	if _, err := Auth3(sSess, amsg3); err != nil {
+		t.Fatal(err)
+	}
+
+	upgradeClient, msg1, err := UpgradeInit(cSess, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMsg1 := msg1
+	otherMsg1.Username = "other"
+	if _, _, err := Upgrade1(privS, sSess, otherMsg1); err == nil || err.Error() != "username mismatch" {
+		t.Fatalf("Upgrade for other user: got %v", err)
+	}
+	upgradeServer, msg2, err := Upgrade1(privS, sSess, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := PwReg2(upgradeClient, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newUser := PwReg3(upgradeServer, msg3)
+
+	if newUser.PubU.N.BitLen() != 1024 {
+		t.Fatalf("New record has a %d bit key", newUser.PubU.N.BitLen())
+	}
+	if newUser.K.Cmp(user.K) == 0 {
+		t.Fatalf("New record has the same OPRF key")
+	}
+	if err := authenticate(privS, newUser, "password", nil, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client can't upgrade before it has authenticated.
+	cSess2, _, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := UpgradeInit(cSess2, 1024); err == nil {
+		t.Fatalf("UpgradeInit succeeded before Auth2")
+	}
+	if cSess2.UpgradeRequested() {
+		t.Fatalf("Upgrade requested before Auth2")
+	}
+}
+
+func TestUpgradeNotPossible(t *testing.T) {
+	privS, err := rsa.GenerateKey(randr, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := MigrateUser(privS, "user", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The device's envelope would be lost by an upgrade.
+	user.DeviceEnvU = map[string][]byte{"B": user.EnvU}
+
+	cSess, amsg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sSess, amsg2, err := Auth1WithUpgrade(privS, user, amsg1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amsg2.Upgrade {
+		t.Fatalf("Upgrade requested for a record with devices")
+	}
+	_, amsg3, err := Auth2(cSess, amsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Auth3(sSess, amsg3); err != nil {
+		t.Fatal(err)
+	}
+	_, msg1, err := UpgradeInit(cSess, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Upgrade1(privS, sSess, msg1); err != ErrUpgradeNotPossible {
+		t.Fatalf("Upgrade of a record with devices: got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains functions to encrypt the username in AuthMsg1 and
+// PwRegMsg1 so that a passive observer can't tell which user is logging in.
+//
+// The server has a static D-H key pair (s, g^s) and the client has pinned the
+// public key g^s. The client derives a key from g^(xs), where g^x is an
+// ephemeral D-H public key sent in the same message, and encrypts the username
+// with it. This is similar to the base mode of HPKE. In AuthMsg1 the ephemeral
+// key is the client's D-H share DhPubClient.
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/frekui/opaque/internal/pkg/authenc"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted usernames are padded to a multiple of this many bytes to hide the
+// length of the username.
+const usernamePadding = 64
+
+// UsernameKey is the server's static D-H key pair which is used to decrypt
+// encrypted usernames. Clients pin Pub, e.g., by shipping it with the client.
+type UsernameKey struct {
+	Priv *big.Int
+	Pub  *big.Int
+}
+
+// ErrUsernameDecrypt is returned by DecryptUsername and DecryptPwRegUsername if
+// the username can't be decrypted. Servers should handle it in the same way as
+// an unknown user.
+var ErrUsernameDecrypt = errors.New("failed to decrypt username")
+
+// GenerateUsernameKey generates a new UsernameKey.
+func GenerateUsernameKey() (*UsernameKey, error) {
+	priv, err := dhGroup.GeneratePrivateKey(randr)
+	if err != nil {
+		return nil, err
+	}
+	return &UsernameKey{Priv: priv, Pub: dhGroup.GeneratePublicKey(priv)}, nil
+}
+
+// EncryptUsername encrypts msg1.Username to the server's public key pub and
+// clears msg1.Username. msg1 and sess must have been returned by the same call
+// to AuthInit. The server decrypts the username with DecryptUsername.
+func EncryptUsername(sess *AuthClientSession, msg1 *AuthMsg1, pub *big.Int) error {
+	enc, err := encryptUsername(sess.x, sess.dhPubClient, pub, msg1.Username)
+	if err != nil {
+		return err
+	}
+	msg1.EncUsername = enc
+	msg1.Username = ""
+	return nil
+}
+
+// DecryptUsername decrypts msg1.EncUsername and stores the result in
+// msg1.Username. ErrUsernameDecrypt is returned if msg1 doesn't contain a
+// username encrypted to key.
+func DecryptUsername(key *UsernameKey, msg1 *AuthMsg1) error {
+	username, err := decryptUsername(key, msg1.DhPubClient, msg1.EncUsername)
+	if err != nil {
+		return err
+	}
+	msg1.Username = username
+	return nil
+}
+
+// EncryptPwRegUsername encrypts msg1.Username to the server's public key pub
+// and clears msg1.Username. A new ephemeral D-H key is generated and its public
+// part is stored in msg1.UsernameDhPub. The server decrypts the username with
+// DecryptPwRegUsername.
+//
+// If a registration code is used (see PwRegInitWithCode) the MAC in msg1 is
+// computed over the plaintext username, so the server must decrypt the
+// username before PwReg1WithCode is called.
+func EncryptPwRegUsername(msg1 *PwRegMsg1, pub *big.Int) error {
+	priv, err := dhGroup.GeneratePrivateKey(randr)
+	if err != nil {
+		return err
+	}
+	dhPub := dhGroup.GeneratePublicKey(priv)
+	enc, err := encryptUsername(priv, dhPub, pub, msg1.Username)
+	if err != nil {
+		return err
+	}
+	msg1.UsernameDhPub = dhPub
+	msg1.EncUsername = enc
+	msg1.Username = ""
+	return nil
+}
+
+// DecryptPwRegUsername decrypts msg1.EncUsername and stores the result in
+// msg1.Username. ErrUsernameDecrypt is returned if msg1 doesn't contain a
+// username encrypted to key.
+func DecryptPwRegUsername(key *UsernameKey, msg1 *PwRegMsg1) error {
+	username, err := decryptUsername(key, msg1.UsernameDhPub, msg1.EncUsername)
+	if err != nil {
+		return err
+	}
+	msg1.Username = username
+	return nil
+}
+
+func encryptUsername(priv, dhPub, serverPub *big.Int, username string) ([]byte, error) {
+	if !dhGroup.IsInGroup(serverPub) || dhGroup.IsInSmallSubgroup(serverPub) || !dhGroup.IsInSubgroup(serverPub) {
+		return nil, errors.New("invalid username key")
+	}
+	if len(username) > 0xffff {
+		return nil, errors.New("username too long")
+	}
+	key, err := usernameEncKey(dhGroup.SharedSecret(priv, serverPub), dhPub, serverPub)
+	if err != nil {
+		return nil, err
+	}
+	// The plaintext is len(username) || username || zero padding.
+	plaintext := make([]byte, (2+len(username)+usernamePadding-1)/usernamePadding*usernamePadding)
+	binary.BigEndian.PutUint16(plaintext, uint16(len(username)))
+	copy(plaintext[2:], username)
+	return authenc.AuthEnc(randr, key, plaintext)
+}
+
+func decryptUsername(key *UsernameKey, dhPub *big.Int, enc []byte) (string, error) {
+	if dhPub == nil || !dhGroup.IsInGroup(dhPub) || dhGroup.IsInSmallSubgroup(dhPub) || !dhGroup.IsInSubgroup(dhPub) {
+		return "", ErrUsernameDecrypt
+	}
+	encKey, err := usernameEncKey(dhGroup.SharedSecret(key.Priv, dhPub), dhPub, key.Pub)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := authenc.AuthDec(encKey, enc)
+	if err != nil {
+		return "", ErrUsernameDecrypt
+	}
+	if len(plaintext) < 2 {
+		return "", ErrUsernameDecrypt
+	}
+	n := int(binary.BigEndian.Uint16(plaintext))
+	if 2+n > len(plaintext) {
+		return "", ErrUsernameDecrypt
+	}
+	return string(plaintext[2 : 2+n]), nil
+}
+
+// usernameEncKey derives the key used to encrypt the username from the D-H
+// shared secret and both public keys.
+func usernameEncKey(shared []byte, dhPub, serverPub *big.Int) ([]byte, error) {
+	info := append([]byte("opaque username"), dhGroup.Bytes(dhPub)...)
+	info = append(info, dhGroup.Bytes(serverPub)...)
+	kdf := hkdf.New(hasher, shared, nil, info)
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
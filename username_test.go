@@ -0,0 +1,79 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestEncryptUsername(t *testing.T) {
+	key, err := GenerateUsernameKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := GenerateUsernameKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, msg1, err := AuthInit("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptUsername(sess, &msg1, key.Pub); err != nil {
+		t.Fatal(err)
+	}
+	if msg1.Username != "" {
+		t.Fatalf("Username not cleared")
+	}
+	if err := DecryptUsername(otherKey, &msg1); err != ErrUsernameDecrypt {
+		t.Fatalf("Decrypt with other key: got %v", err)
+	}
+	if err := DecryptUsername(key, &msg1); err != nil {
+		t.Fatal(err)
+	}
+	if msg1.Username != "user" {
+		t.Fatalf("Got username '%s'", msg1.Username)
+	}
+
+	// The encrypted username must be bound to DhPubClient.
+	msg1.DhPubClient = big.NewInt(123)
+	if err := DecryptUsername(key, &msg1); err != ErrUsernameDecrypt {
+		t.Fatalf("Modified DhPubClient: got %v", err)
+	}
+	msg1.DhPubClient = big.NewInt(1)
+	if err := DecryptUsername(key, &msg1); err != ErrUsernameDecrypt {
+		t.Fatalf("DhPubClient in small subgroup: got %v", err)
+	}
+
+	if err := EncryptUsername(sess, &AuthMsg1{Username: "user"}, big.NewInt(1)); err == nil {
+		t.Fatalf("Encryption to invalid key succeeded")
+	}
+
+	_, pwRegMsg1, err := PwRegInit("a much longer username", "password", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptPwRegUsername(&pwRegMsg1, key.Pub); err != nil {
+		t.Fatal(err)
+	}
+	// Usernames are padded, so the length of the username doesn't leak.
+	if len(pwRegMsg1.EncUsername) != len(msg1.EncUsername) {
+		t.Fatalf("Length of encrypted usernames differ: %d and %d", len(pwRegMsg1.EncUsername), len(msg1.EncUsername))
+	}
+	pwRegMsg1.EncUsername[len(pwRegMsg1.EncUsername)-1] ^= 42
+	if err := DecryptPwRegUsername(key, &pwRegMsg1); err != ErrUsernameDecrypt {
+		t.Fatalf("Modified EncUsername: got %v", err)
+	}
+	pwRegMsg1.EncUsername[len(pwRegMsg1.EncUsername)-1] ^= 42
+	if err := DecryptPwRegUsername(key, &pwRegMsg1); err != nil {
+		t.Fatal(err)
+	}
+	if pwRegMsg1.Username != "a much longer username" {
+		t.Fatalf("Got username '%s'", pwRegMsg1.Username)
+	}
+}